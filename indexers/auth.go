@@ -0,0 +1,146 @@
+// Copyright 2024 The go-commons Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AuthConfig holds the authentication settings of the ElasticSearch, OpenSearch, remote write and Kafka indexers.
+// Only one of basic auth, API key or bearer token can be configured
+type AuthConfig struct {
+	// Username username for HTTP basic authentication
+	Username Secret `yaml:"username"`
+	// Password password for HTTP basic authentication
+	Password Secret `yaml:"password"`
+	// APIKey base64-encoded API key, sent in the "Authorization: APIKey" header
+	APIKey Secret `yaml:"apiKey"`
+	// BearerToken token sent in the "Authorization: Bearer" header
+	BearerToken Secret `yaml:"bearerToken"`
+	// CACert path to a PEM bundle with the certificate authorities used to verify the server certificate
+	CACert string `yaml:"caCert"`
+	// ClientCert path to the PEM client certificate used for mutual TLS
+	ClientCert string `yaml:"clientCert"`
+	// ClientKey path to the PEM private key of the client certificate
+	ClientKey string `yaml:"clientKey"`
+}
+
+// Secret is a sensitive value that can be set inline, read from a file or read from an environment variable.
+// In YAML it can be either a plain string, or a map with one of the value, file or env keys
+type Secret struct {
+	// Value inline value of the secret
+	Value string `yaml:"value"`
+	// File path of the file holding the secret, trailing new lines are ignored
+	File string `yaml:"file"`
+	// Env name of the environment variable holding the secret
+	Env string `yaml:"env"`
+}
+
+// credentials holds the resolved credentials of an AuthConfig
+type credentials struct {
+	username    string
+	password    string
+	apiKey      string
+	bearerToken string
+}
+
+// UnmarshalYAML allows to set a Secret with a plain string
+func (s *Secret) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&s.Value)
+	}
+	type plainSecret Secret
+	return node.Decode((*plainSecret)(s))
+}
+
+// Resolve returns the value of the secret, or an empty string when it's not set
+func (s Secret) Resolve() (string, error) {
+	switch {
+	case s.Value != "":
+		return s.Value, nil
+	case s.File != "":
+		content, err := os.ReadFile(s.File)
+		if err != nil {
+			return "", fmt.Errorf("error reading secret file: %s", err)
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	case s.Env != "":
+		value, ok := os.LookupEnv(s.Env)
+		if !ok {
+			return "", fmt.Errorf("secret environment variable %s not set", s.Env)
+		}
+		return value, nil
+	}
+	return "", nil
+}
+
+// credentials resolves the configured secrets
+func (a AuthConfig) credentials() (credentials, error) {
+	var creds credentials
+	var err error
+	for _, secret := range []struct {
+		name   string
+		secret Secret
+		value  *string
+	}{
+		{"username", a.Username, &creds.username},
+		{"password", a.Password, &creds.password},
+		{"API key", a.APIKey, &creds.apiKey},
+		{"bearer token", a.BearerToken, &creds.bearerToken},
+	} {
+		if *secret.value, err = secret.secret.Resolve(); err != nil {
+			return creds, fmt.Errorf("error loading %s: %s", secret.name, err)
+		}
+	}
+	methods := 0
+	for _, configured := range []bool{creds.username != "" || creds.password != "", creds.apiKey != "", creds.bearerToken != ""} {
+		if configured {
+			methods++
+		}
+	}
+	if methods > 1 {
+		return creds, fmt.Errorf("only one of basic auth, API key or bearer token can be configured")
+	}
+	return creds, nil
+}
+
+// tlsConfig builds the TLS configuration of the client from the CA bundle and client certificate
+func (a AuthConfig) tlsConfig(insecureSkipVerify bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+	if a.CACert != "" {
+		caCert, err := os.ReadFile(a.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA bundle: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no valid certificates found in CA bundle %s", a.CACert)
+		}
+	}
+	if a.ClientCert != "" || a.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(a.ClientCert, a.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,203 @@
+package indexers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gopkg.in/yaml.v3"
+)
+
+var _ = Describe("Tests for auth.go", func() {
+	Context("Secret", func() {
+		It("resolves inline values", func() {
+			value, err := Secret{Value: "s3cr3t"}.Resolve()
+			Expect(err).To(BeNil())
+			Expect(value).To(Equal("s3cr3t"))
+		})
+
+		It("resolves values from files", func() {
+			secretFile := filepath.Join(GinkgoT().TempDir(), "password")
+			Expect(os.WriteFile(secretFile, []byte("s3cr3t\n"), 0600)).To(Succeed())
+			value, err := Secret{File: secretFile}.Resolve()
+			Expect(err).To(BeNil())
+			Expect(value).To(Equal("s3cr3t"))
+		})
+
+		It("resolves values from environment variables", func() {
+			GinkgoT().Setenv("GO_COMMONS_TEST_SECRET", "s3cr3t")
+			value, err := Secret{Env: "GO_COMMONS_TEST_SECRET"}.Resolve()
+			Expect(err).To(BeNil())
+			Expect(value).To(Equal("s3cr3t"))
+		})
+
+		It("returns err when the environment variable is not set", func() {
+			_, err := Secret{Env: "GO_COMMONS_TEST_UNSET_SECRET"}.Resolve()
+			Expect(err).To(MatchError("secret environment variable GO_COMMONS_TEST_UNSET_SECRET not set"))
+		})
+
+		It("decodes plain strings and maps from YAML", func() {
+			var auth AuthConfig
+			config := "username: elastic\npassword:\n  env: ES_PASSWORD\napiKey:\n  file: /tmp/key\n"
+			Expect(yaml.Unmarshal([]byte(config), &auth)).To(Succeed())
+			Expect(auth.Username).To(Equal(Secret{Value: "elastic"}))
+			Expect(auth.Password).To(Equal(Secret{Env: "ES_PASSWORD"}))
+			Expect(auth.APIKey).To(Equal(Secret{File: "/tmp/key"}))
+		})
+	})
+
+	Context("AuthConfig", func() {
+		It("returns err when several authentication methods are configured", func() {
+			_, err := AuthConfig{Username: Secret{Value: "elastic"}, BearerToken: Secret{Value: "token"}}.credentials()
+			Expect(err).To(MatchError("only one of basic auth, API key or bearer token can be configured"))
+		})
+
+		It("returns err when the CA bundle has no certificates", func() {
+			caFile := filepath.Join(GinkgoT().TempDir(), "ca.pem")
+			Expect(os.WriteFile(caFile, []byte("not a certificate"), 0600)).To(Succeed())
+			_, err := AuthConfig{CACert: caFile}.tlsConfig(false)
+			Expect(err).To(MatchError("no valid certificates found in CA bundle " + caFile))
+		})
+
+		It("returns err when the client key is missing", func() {
+			_, err := AuthConfig{ClientCert: "/nonexistent/cert.pem"}.tlsConfig(false)
+			Expect(err.Error()).To(HavePrefix("error loading client certificate"))
+		})
+	})
+
+	Context("Authentication against ElasticSearch and OpenSearch", func() {
+		var authHeaders []string
+		var server *httptest.Server
+		BeforeEach(func() {
+			authHeaders = nil
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				authHeaders = append(authHeaders, r.Header.Get("Authorization"))
+				_, _ = w.Write(payload)
+			}))
+		})
+		AfterEach(func() {
+			server.Close()
+		})
+
+		for _, indexerType := range []IndexerType{ElasticIndexer, OpenSearchIndexer} {
+			It("sends basic auth credentials to "+string(indexerType), func() {
+				GinkgoT().Setenv("GO_COMMONS_TEST_PASSWORD", "s3cr3t")
+				_, err := NewIndexer(IndexerConfig{
+					Type:    indexerType,
+					Servers: []string{server.URL},
+					Index:   "go-commons-test",
+					Auth:    AuthConfig{Username: Secret{Value: "elastic"}, Password: Secret{Env: "GO_COMMONS_TEST_PASSWORD"}},
+				})
+				Expect(err).To(BeNil())
+				Expect(authHeaders).NotTo(BeEmpty())
+				Expect(authHeaders).To(HaveEach("Basic ZWxhc3RpYzpzM2NyM3Q="))
+			})
+
+			It("sends the API key to "+string(indexerType), func() {
+				_, err := NewIndexer(IndexerConfig{
+					Type:    indexerType,
+					Servers: []string{server.URL},
+					Index:   "go-commons-test",
+					Auth:    AuthConfig{APIKey: Secret{Value: "a2V5"}},
+				})
+				Expect(err).To(BeNil())
+				Expect(authHeaders).To(HaveEach("APIKey a2V5"))
+			})
+
+			It("sends the bearer token to "+string(indexerType), func() {
+				_, err := NewIndexer(IndexerConfig{
+					Type:    indexerType,
+					Servers: []string{server.URL},
+					Index:   "go-commons-test",
+					Auth:    AuthConfig{BearerToken: Secret{Value: "token"}},
+				})
+				Expect(err).To(BeNil())
+				Expect(authHeaders).To(HaveEach("Bearer token"))
+			})
+		}
+	})
+
+	Context("TLS against ElasticSearch and OpenSearch", func() {
+		var server *httptest.Server
+		var caFile, certFile, keyFile string
+		BeforeEach(func() {
+			dir := GinkgoT().TempDir()
+			caFile = filepath.Join(dir, "ca.pem")
+			certFile = filepath.Join(dir, "client.pem")
+			keyFile = filepath.Join(dir, "client-key.pem")
+			clientCert := generateClientCertificate(certFile, keyFile)
+			server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write(payload)
+			}))
+			clientCAs := x509.NewCertPool()
+			clientCAs.AddCert(clientCert)
+			server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+			server.StartTLS()
+			Expect(os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)).To(Succeed())
+		})
+		AfterEach(func() {
+			server.Close()
+		})
+
+		for _, indexerType := range []IndexerType{ElasticIndexer, OpenSearchIndexer} {
+			It("verifies the server with the CA bundle and presents the client certificate to "+string(indexerType), func() {
+				_, err := NewIndexer(IndexerConfig{
+					Type:    indexerType,
+					Servers: []string{server.URL},
+					Index:   "go-commons-test",
+					Auth:    AuthConfig{CACert: caFile, ClientCert: certFile, ClientKey: keyFile},
+				})
+				Expect(err).To(BeNil())
+			})
+
+			It("fails without the client certificate against "+string(indexerType), func() {
+				_, err := NewIndexer(IndexerConfig{
+					Type:    indexerType,
+					Servers: []string{server.URL},
+					Index:   "go-commons-test",
+					Auth:    AuthConfig{CACert: caFile},
+					Retry:   RetryConfig{MaxAttempts: 1},
+				})
+				Expect(err).NotTo(BeNil())
+			})
+		}
+	})
+})
+
+// generateClientCertificate writes a self-signed client certificate and its key to the given paths
+func generateClientCertificate(certFile, keyFile string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(BeNil())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "go-commons-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).To(BeNil())
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err).To(BeNil())
+	Expect(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)).To(Succeed())
+	Expect(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)).To(Succeed())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).To(BeNil())
+	return cert
+}
@@ -0,0 +1,294 @@
+// Copyright 2024 The go-commons Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Default retry settings used when they're not specified in RetryConfig
+var (
+	defaultRetryableStatusCodes = []int{429, 502, 503, 504}
+	defaultBackoffBase          = 500 * time.Millisecond
+	defaultBackoffCap           = 30 * time.Second
+)
+
+// Default bulk indexer settings used when they're not specified in BulkConfig
+const (
+	defaultFlushBytes  = 5e+6
+	defaultBulkTimeout = 10 * time.Minute
+)
+
+// bulkDocument is an encoded document ready to be sent to the bulk API
+type bulkDocument struct {
+	id     string
+	index  string
+	action string
+	body   []byte
+}
+
+// bulkFailure is a document rejected by the bulk API
+type bulkFailure struct {
+	document bulkDocument
+	status   int
+	reason   string
+}
+
+// statusError is returned when ElasticSearch or OpenSearch answer a request with an error status code
+type statusError struct {
+	status  int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return e.message
+}
+
+// bulkFunc sends the given documents to the bulk API, accounts the indexed ones in result and returns the rejected ones.
+// On error, the returned failures also hold the documents that weren't acknowledged
+type bulkFunc func(ctx context.Context, docs []bulkDocument, result *IndexResult) ([]bulkFailure, error)
+
+// encodeBulkDocuments encodes the given documents for the action and ID function of opts, using the SHA256
+// of their JSON representation as ID by default. Documents with an already seen ID are redundant: with the index and
+// upsert actions the last one replaces the previous ones, as indexing them in order would, while with the create
+// action the first one is kept, the others would be rejected. Redundant documents are dropped,
+// their number is returned along with the encoded documents. The index of every document is resolved by
+// router, when not nil
+func encodeBulkDocuments(documents []interface{}, opts IndexingOpts, router *indexRouter) ([]bulkDocument, int, error) {
+	var bulkDocs []bulkDocument
+	action, err := opts.bulkAction()
+	if err != nil {
+		return nil, 0, err
+	}
+	docPositions := make(map[string]int)
+	redundantSkipped := 0
+	for _, document := range documents {
+		j, err := json.Marshal(document)
+		if err != nil {
+			return nil, 0, fmt.Errorf("cannot encode document %v: %s", document, err)
+		}
+		docId, err := documentID(document, j, opts)
+		if err != nil {
+			return nil, 0, err
+		}
+		position, redundant := docPositions[docId]
+		if redundant {
+			log.Debugf("Dropping redundant document with ID: %s", docId)
+			redundantSkipped++
+			if opts.Action == CreateAction {
+				continue
+			}
+		}
+		var index string
+		if router != nil {
+			if index, err = router.resolve(j, opts); err != nil {
+				return nil, 0, err
+			}
+		}
+		if opts.Action == UpsertAction {
+			j = fmt.Appendf(nil, `{"doc":%s,"doc_as_upsert":true}`, j)
+		}
+		doc := bulkDocument{id: docId, index: index, action: action, body: j}
+		if redundant {
+			bulkDocs[position] = doc
+			continue
+		}
+		docPositions[docId] = len(bulkDocs)
+		bulkDocs = append(bulkDocs, doc)
+	}
+	return bulkDocs, redundantSkipped, nil
+}
+
+// documentID returns the ID of a document given its JSON representation, using the ID function of opts when set
+func documentID(document interface{}, j []byte, opts IndexingOpts) (string, error) {
+	if opts.DocumentID != nil {
+		docId, err := opts.DocumentID(document)
+		if err != nil {
+			return "", fmt.Errorf("cannot get ID of document %s: %s", j, err)
+		}
+		return docId, nil
+	}
+	hash := sha256.Sum256(j)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// bulkAction returns the bulk API action of the configured BulkAction
+func (opts IndexingOpts) bulkAction() (string, error) {
+	switch opts.Action {
+	case "", IndexAction:
+		return "index", nil
+	case CreateAction:
+		return "create", nil
+	case UpsertAction:
+		return "update", nil
+	}
+	return "", fmt.Errorf("unsupported bulk action %s", opts.Action)
+}
+
+// IDFromFields returns a DocumentIDFunc joining the values of the given document fields with dashes.
+// Nested fields are referenced with dots, e.g. "metadata.uuid"
+func IDFromFields(fields ...string) DocumentIDFunc {
+	return func(document interface{}) (string, error) {
+		j, err := json.Marshal(document)
+		if err != nil {
+			return "", err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(j))
+		decoder.UseNumber()
+		var doc interface{}
+		if err := decoder.Decode(&doc); err != nil {
+			return "", err
+		}
+		values := make([]string, 0, len(fields))
+		for _, field := range fields {
+			value := doc
+			for _, key := range strings.Split(field, ".") {
+				object, ok := value.(map[string]interface{})
+				if !ok {
+					return "", fmt.Errorf("field %s not found", field)
+				}
+				if value, ok = object[key]; !ok || value == nil {
+					return "", fmt.Errorf("field %s not found", field)
+				}
+			}
+			values = append(values, fmt.Sprint(value))
+		}
+		return strings.Join(values, "-"), nil
+	}
+}
+
+// bulkWithRetries sends the documents using the given bulk function, the documents rejected with a
+// retryable status code are sent again with exponential backoff until they're indexed or the attempts are exhausted.
+// Cancelling the context stops the retries, the pending documents are then reported as failed
+func bulkWithRetries(ctx context.Context, docs []bulkDocument, result *IndexResult, retry RetryConfig, bulk bulkFunc) error {
+	for attempt := 1; ; attempt++ {
+		failures, err := bulk(ctx, docs, result)
+		if err != nil {
+			for _, failure := range failures {
+				result.Failed++
+				result.Failures = append(result.Failures, DocumentFailure{DocumentID: failure.document.id, Reason: failure.reason, Status: failure.status})
+			}
+			return err
+		}
+		docs = nil
+		for _, failure := range failures {
+			if attempt < retry.maxAttempts() && retry.retryable(failure.status) {
+				docs = append(docs, failure.document)
+				continue
+			}
+			result.Failed++
+			result.Failures = append(result.Failures, DocumentFailure{DocumentID: failure.document.id, Reason: failure.reason, Status: failure.status})
+		}
+		if len(docs) == 0 {
+			return nil
+		}
+		backoff := retry.backoff(attempt)
+		log.Infof("Retrying %d rejected documents in %v, attempt %d/%d", len(docs), backoff, attempt+1, retry.maxAttempts())
+		select {
+		case <-ctx.Done():
+			for _, doc := range docs {
+				result.Failed++
+				result.Failures = append(result.Failures, DocumentFailure{DocumentID: doc.id, Reason: ctx.Err().Error()})
+			}
+			return nil
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// unacknowledged adds the documents that didn't get a response from the bulk API to failures, with the given error
+// as reason when not nil
+func unacknowledged(failures []bulkFailure, docs []bulkDocument, acknowledged map[string]bool, err error) []bulkFailure {
+	reason := "document not acknowledged"
+	if err != nil {
+		reason = err.Error()
+	}
+	for _, doc := range docs {
+		if !acknowledged[doc.id] {
+			failures = append(failures, bulkFailure{document: doc, reason: reason})
+		}
+	}
+	return failures
+}
+
+// maxAttempts returns the configured number of attempts, at least 1
+func (r RetryConfig) maxAttempts() int {
+	return max(r.MaxAttempts, 1)
+}
+
+// retryableStatusCodes returns the status codes that trigger a retry
+func (r RetryConfig) retryableStatusCodes() []int {
+	if len(r.RetryableStatusCodes) == 0 {
+		return defaultRetryableStatusCodes
+	}
+	return r.RetryableStatusCodes
+}
+
+// retryable returns true when the given status code triggers a retry
+func (r RetryConfig) retryable(status int) bool {
+	return slices.Contains(r.retryableStatusCodes(), status)
+}
+
+// backoff returns the time to wait before the given retry attempt, starting at 1.
+// The wait time doubles on every attempt and it's capped by BackoffCap
+func (r RetryConfig) backoff(attempt int) time.Duration {
+	base, backoffCap := r.BackoffBase, r.BackoffCap
+	if base <= 0 {
+		base = defaultBackoffBase
+	}
+	if backoffCap <= 0 {
+		backoffCap = defaultBackoffCap
+	}
+	backoff := base
+	for i := 1; i < attempt && backoff < backoffCap; i++ {
+		backoff *= 2
+	}
+	return min(backoff, backoffCap)
+}
+
+// flushBytes returns the configured size of the bulk requests
+func (b BulkConfig) flushBytes() int {
+	if b.FlushBytes <= 0 {
+		return defaultFlushBytes
+	}
+	return b.FlushBytes
+}
+
+// workers returns the configured number of concurrent bulk requests
+func (b BulkConfig) workers() int {
+	if b.Workers <= 0 {
+		return runtime.NumCPU()
+	}
+	return b.Workers
+}
+
+// timeout returns the configured timeout of the bulk requests
+func (b BulkConfig) timeout() time.Duration {
+	if b.Timeout <= 0 {
+		return defaultBulkTimeout
+	}
+	return b.Timeout
+}
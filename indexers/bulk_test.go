@@ -0,0 +1,130 @@
+package indexers
+
+import (
+	"runtime"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gopkg.in/yaml.v3"
+)
+
+var _ = Describe("Tests for bulk.go", func() {
+	Context("encodeBulkDocuments()", func() {
+		It("drops redundant documents", func() {
+			docs, redundantSkipped, err := encodeBulkDocuments([]interface{}{"a", "b", "a", "c"}, IndexingOpts{}, nil)
+			Expect(err).To(BeNil())
+			Expect(redundantSkipped).To(Equal(1))
+			Expect(docs).To(HaveLen(3))
+			Expect(string(docs[2].body)).To(Equal(`"c"`))
+		})
+
+		It("returns err when a document cannot be encoded", func() {
+			_, _, err := encodeBulkDocuments([]interface{}{"a", make(chan string)}, IndexingOpts{}, nil)
+			Expect(err.Error()).To(ContainSubstring("cannot encode document"))
+		})
+
+		It("uses the IDs of the document ID function", func() {
+			docs, redundantSkipped, err := encodeBulkDocuments([]interface{}{
+				map[string]interface{}{"uuid": "abc", "value": 1.5},
+				map[string]interface{}{"uuid": "def", "value": 2.5},
+				map[string]interface{}{"uuid": "abc", "value": 3.5},
+			}, IndexingOpts{DocumentID: IDFromFields("uuid")}, nil)
+			Expect(err).To(BeNil())
+			Expect(redundantSkipped).To(Equal(1))
+			Expect(docs).To(HaveLen(2))
+			Expect(docs[0].id).To(Equal("abc"))
+			Expect(docs[0].action).To(Equal("index"))
+			Expect(string(docs[0].body)).To(Equal(`{"uuid":"abc","value":3.5}`))
+			Expect(docs[1].id).To(Equal("def"))
+		})
+
+		It("keeps the first document of an ID with the create action", func() {
+			docs, redundantSkipped, err := encodeBulkDocuments([]interface{}{
+				map[string]interface{}{"uuid": "abc", "value": 1.5},
+				map[string]interface{}{"uuid": "abc", "value": 3.5},
+			}, IndexingOpts{DocumentID: IDFromFields("uuid"), Action: CreateAction}, nil)
+			Expect(err).To(BeNil())
+			Expect(redundantSkipped).To(Equal(1))
+			Expect(docs).To(HaveLen(1))
+			Expect(string(docs[0].body)).To(Equal(`{"uuid":"abc","value":1.5}`))
+		})
+
+		It("wraps upserted documents", func() {
+			docs, _, err := encodeBulkDocuments([]interface{}{map[string]interface{}{"uuid": "abc"}}, IndexingOpts{Action: UpsertAction}, nil)
+			Expect(err).To(BeNil())
+			Expect(docs[0].action).To(Equal("update"))
+			Expect(string(docs[0].body)).To(Equal(`{"doc":{"uuid":"abc"},"doc_as_upsert":true}`))
+		})
+
+		It("returns err on unsupported actions", func() {
+			_, _, err := encodeBulkDocuments([]interface{}{"a"}, IndexingOpts{Action: "delete"}, nil)
+			Expect(err).To(MatchError("unsupported bulk action delete"))
+		})
+
+		It("returns err when the document ID cannot be extracted", func() {
+			_, _, err := encodeBulkDocuments([]interface{}{map[string]interface{}{"uuid": "abc"}}, IndexingOpts{DocumentID: IDFromFields("timestamp")}, nil)
+			Expect(err).To(MatchError(`cannot get ID of document {"uuid":"abc"}: field timestamp not found`))
+		})
+	})
+
+	Context("IDFromFields()", func() {
+		It("joins the values of nested fields", func() {
+			document := struct {
+				UUID       string                 `json:"uuid"`
+				MetricName string                 `json:"metricName"`
+				Value      float64                `json:"value"`
+				Labels     map[string]interface{} `json:"labels"`
+			}{UUID: "abc", MetricName: "podLatency", Value: 1234567890123, Labels: map[string]interface{}{"node": "worker-0"}}
+			id, err := IDFromFields("uuid", "metricName", "value", "labels.node")(document)
+			Expect(err).To(BeNil())
+			Expect(id).To(Equal("abc-podLatency-1234567890123-worker-0"))
+		})
+
+		It("returns err when a nested field is not an object", func() {
+			_, err := IDFromFields("uuid.value")(map[string]interface{}{"uuid": "abc"})
+			Expect(err).To(MatchError("field uuid.value not found"))
+		})
+	})
+
+	Context("RetryConfig", func() {
+		It("doubles the backoff on every attempt up to the cap", func() {
+			retry := RetryConfig{BackoffBase: 100 * time.Millisecond, BackoffCap: time.Second}
+			Expect(retry.backoff(1)).To(Equal(100 * time.Millisecond))
+			Expect(retry.backoff(2)).To(Equal(200 * time.Millisecond))
+			Expect(retry.backoff(4)).To(Equal(800 * time.Millisecond))
+			Expect(retry.backoff(5)).To(Equal(time.Second))
+			Expect(retry.backoff(50)).To(Equal(time.Second))
+		})
+
+		It("uses the default settings when not configured", func() {
+			var retry RetryConfig
+			Expect(retry.maxAttempts()).To(Equal(1))
+			Expect(retry.backoff(1)).To(Equal(defaultBackoffBase))
+			Expect(retry.backoff(20)).To(Equal(defaultBackoffCap))
+			Expect(retry.retryable(429)).To(BeTrue())
+			Expect(retry.retryable(400)).To(BeFalse())
+		})
+
+		It("retries only the configured status codes", func() {
+			retry := RetryConfig{RetryableStatusCodes: []int{503}}
+			Expect(retry.retryable(503)).To(BeTrue())
+			Expect(retry.retryable(429)).To(BeFalse())
+		})
+	})
+
+	Context("BulkConfig", func() {
+		It("uses the default settings when not configured", func() {
+			var bulk BulkConfig
+			Expect(bulk.flushBytes()).To(Equal(5000000))
+			Expect(bulk.workers()).To(Equal(runtime.NumCPU()))
+			Expect(bulk.timeout()).To(Equal(defaultBulkTimeout))
+		})
+
+		It("decodes the settings from YAML", func() {
+			var config IndexerConfig
+			Expect(yaml.Unmarshal([]byte("bulk:\n  flushBytes: 1048576\n  flushInterval: 5s\n  workers: 2\n  timeout: 1m\n  compress: true\n"), &config)).To(Succeed())
+			Expect(config.Bulk).To(Equal(BulkConfig{FlushBytes: 1048576, FlushInterval: 5 * time.Second, Workers: 2, Timeout: time.Minute, Compress: true}))
+		})
+	})
+})
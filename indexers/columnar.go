@@ -0,0 +1,149 @@
+// Copyright 2024 The go-commons Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// columnKind type of a column of the Parquet and CSV metric files
+type columnKind int
+
+const (
+	stringColumn columnKind = iota
+	numberColumn
+	boolColumn
+)
+
+// column of the Parquet and CSV metric files
+type column struct {
+	name string
+	kind columnKind
+}
+
+// flattenDocument returns the fields of a document keyed by their dotted path, such as labels.namespace.
+// Arrays are kept as their JSON encoding and numbers as json.Number
+func flattenDocument(document interface{}) (map[string]interface{}, error) {
+	j, err := json.Marshal(document)
+	if err != nil {
+		return nil, fmt.Errorf("JSON encoding error: %s", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(j))
+	decoder.UseNumber()
+	var fields map[string]interface{}
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, fmt.Errorf("document %s isn't a JSON object", j)
+	}
+	flattened := make(map[string]interface{})
+	if err := flattenFields("", fields, flattened); err != nil {
+		return nil, err
+	}
+	return flattened, nil
+}
+
+// flattenFields adds the fields of the object to the flattened fields, prefixing their names
+func flattenFields(prefix string, fields map[string]interface{}, flattened map[string]interface{}) error {
+	for name, value := range fields {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if err := flattenFields(prefix+name+".", v, flattened); err != nil {
+				return err
+			}
+		case []interface{}:
+			j, err := json.Marshal(v)
+			if err != nil {
+				return fmt.Errorf("JSON encoding error: %s", err)
+			}
+			flattened[prefix+name] = string(j)
+		default:
+			flattened[prefix+name] = v
+		}
+	}
+	return nil
+}
+
+// inferColumns returns the columns of the flattened documents sorted by name. Columns holding
+// values of different types, or only null values, are string columns
+func inferColumns(rows []map[string]interface{}) []column {
+	kinds := make(map[string]columnKind)
+	conflicts := make(map[string]bool)
+	for _, row := range rows {
+		for name, value := range row {
+			var kind columnKind
+			switch value.(type) {
+			case nil:
+				if _, ok := kinds[name]; !ok {
+					conflicts[name] = true
+				}
+				continue
+			case json.Number:
+				kind = numberColumn
+			case bool:
+				kind = boolColumn
+			default:
+				kind = stringColumn
+			}
+			if existing, ok := kinds[name]; ok && existing != kind {
+				conflicts[name] = true
+			} else if !ok {
+				kinds[name] = kind
+				delete(conflicts, name)
+			}
+		}
+	}
+	columns := make([]column, 0, len(kinds))
+	for name := range conflicts {
+		kinds[name] = stringColumn
+	}
+	for name, kind := range kinds {
+		columns = append(columns, column{name: name, kind: kind})
+	}
+	sort.Slice(columns, func(i, j int) bool {
+		return columns[i].name < columns[j].name
+	})
+	return columns
+}
+
+// flattenDocuments flattens every document
+func flattenDocuments(documents []interface{}) ([]map[string]interface{}, error) {
+	rows := make([]map[string]interface{}, 0, len(documents))
+	for _, document := range documents {
+		row, err := flattenDocument(document)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// formatValue returns the string representation of a flattened value, empty for null values
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return v.String()
+	}
+	return fmt.Sprint(value)
+}
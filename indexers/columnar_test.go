@@ -0,0 +1,105 @@
+package indexers
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/parquet-go/parquet-go"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tests for columnar.go, parquet.go and csv.go", func() {
+	var indexerConfig IndexerConfig
+	var documents []interface{}
+	BeforeEach(func() {
+		indexerConfig = IndexerConfig{
+			Type:             LocalIndexer,
+			MetricsDirectory: GinkgoT().TempDir(),
+		}
+		documents = []interface{}{
+			map[string]interface{}{"metricName": "podLatency", "value": 1, "ready": true, "labels": map[string]interface{}{"namespace": "default"}},
+			map[string]interface{}{"metricName": "podLatency", "value": 2.5, "quantiles": []int{1, 2}, "metadata": map[string]interface{}{"platform": "AWS"}},
+		}
+	})
+
+	It("flattens the documents and infers the columns", func() {
+		rows, err := flattenDocuments(documents)
+		Expect(err).To(BeNil())
+		Expect(rows[0]).To(Equal(map[string]interface{}{"metricName": "podLatency", "value": json.Number("1"), "ready": true, "labels.namespace": "default"}))
+		Expect(rows[1]).To(HaveKeyWithValue("quantiles", "[1,2]"))
+		rows = append(rows, map[string]interface{}{"ready": "yes", "unset": nil})
+		Expect(inferColumns(rows)).To(Equal([]column{
+			{name: "labels.namespace", kind: stringColumn},
+			{name: "metadata.platform", kind: stringColumn},
+			{name: "metricName", kind: stringColumn},
+			{name: "quantiles", kind: stringColumn},
+			{name: "ready", kind: stringColumn},
+			{name: "unset", kind: stringColumn},
+			{name: "value", kind: numberColumn},
+		}))
+		_, err = flattenDocument("document")
+		Expect(err).To(MatchError(`document "document" isn't a JSON object`))
+	})
+
+	It("writes typed Parquet metric files completed on close", func() {
+		indexerConfig.Local = LocalConfig{Format: ParquetFormat, Compression: ZstdCompression}
+		indexer, err := NewLocalIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		result, err := indexer.Index(documents, IndexingOpts{MetricName: "podLatency"})
+		Expect(err).To(BeNil())
+		Expect(result.Target).To(Equal(filepath.Join(indexerConfig.MetricsDirectory, "podLatency.parquet")))
+		_, err = indexer.Index([]interface{}{map[string]interface{}{"value": 3, "extra": "dropped"}}, IndexingOpts{MetricName: "podLatency"})
+		Expect(err).To(BeNil())
+		_, err = indexer.Index([]interface{}{
+			map[string]interface{}{"value": "high", "ready": 1},
+			map[string]interface{}{"value": "4.5", "ready": "false"},
+		}, IndexingOpts{MetricName: "podLatency"})
+		Expect(err).To(BeNil())
+		Expect(indexer.Close()).To(Succeed())
+		rows, err := parquet.ReadFile[any](result.Target)
+		Expect(err).To(BeNil())
+		Expect(rows).To(HaveLen(5))
+		Expect(rows[0]).To(HaveKeyWithValue("labels.namespace", "default"))
+		Expect(rows[0]).To(HaveKeyWithValue("ready", true))
+		Expect(rows[1]).To(HaveKeyWithValue("value", 2.5))
+		Expect(rows[2]).To(HaveKeyWithValue("value", 3.0))
+		Expect(rows[2]).NotTo(HaveKey("extra"))
+		Expect(rows[3]).To(HaveKeyWithValue("value", BeNil()))
+		Expect(rows[3]).To(HaveKeyWithValue("ready", BeNil()))
+		Expect(rows[4]).To(HaveKeyWithValue("value", 4.5))
+		Expect(rows[4]).To(HaveKeyWithValue("ready", false))
+		Expect(countDocuments(result.Target)).To(Equal(5))
+	})
+
+	It("doesn't overwrite existing Parquet metric files", func() {
+		indexerConfig.Local = LocalConfig{Format: ParquetFormat}
+		filename := filepath.Join(indexerConfig.MetricsDirectory, "podLatency.parquet")
+		Expect(os.WriteFile(filename, []byte("existing"), 0644)).To(Succeed())
+		indexer, err := NewLocalIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		_, err = indexer.Index(documents, IndexingOpts{MetricName: "podLatency"})
+		Expect(err).To(MatchError("error writing metrics file " + filename + ": open " + filename + ": file exists"))
+		Expect(os.ReadFile(filename)).To(Equal([]byte("existing")))
+		Expect(indexer.Close()).To(Succeed())
+	})
+
+	It("appends the documents to CSV metric files with a header", func() {
+		indexerConfig.Local = LocalConfig{Format: CSVFormat}
+		indexer, err := NewLocalIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		result, err := indexer.Index(documents, IndexingOpts{MetricName: "podLatency"})
+		Expect(err).To(BeNil())
+		Expect(result.Target).To(Equal(filepath.Join(indexerConfig.MetricsDirectory, "podLatency.csv")))
+		_, err = indexer.Index([]interface{}{map[string]interface{}{"value": 3, "extra": "dropped"}}, IndexingOpts{MetricName: "podLatency"})
+		Expect(err).To(BeNil())
+		Expect(os.ReadFile(result.Target)).To(Equal([]byte(
+			"labels.namespace,metadata.platform,metricName,quantiles,ready,value\n" +
+				"default,,podLatency,,true,1\n" +
+				",AWS,podLatency,\"[1,2]\",,2.5\n" +
+				",,,,,3\n")))
+		Expect(countDocuments(result.Target)).To(Equal(3))
+	})
+})
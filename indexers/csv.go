@@ -0,0 +1,110 @@
+// Copyright 2024 The go-commons Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexers
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// appendCSV appends the documents to the CSV metric file. Its header is written with the columns inferred
+// from the first batch of documents, fields missing from the header are dropped
+func (l *Local) appendCSV(ctx context.Context, documents []interface{}, opts IndexingOpts) (IndexResult, error) {
+	start := time.Now().UTC()
+	rows, err := flattenDocuments(documents)
+	if err != nil {
+		return IndexResult{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return IndexResult{}, fmt.Errorf("indexing interrupted: %w", err)
+	}
+	filename := path.Join(l.metricsDirectory, opts.MetricName+".csv")
+	unlock, err := lockFile(filename)
+	if err != nil {
+		return IndexResult{}, err
+	}
+	defer unlock()
+	header, err := readCSVHeader(filename)
+	if err != nil {
+		return IndexResult{}, fmt.Errorf("error reading metrics file %s: %s", filename, err)
+	}
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	if header == nil {
+		for _, c := range inferColumns(rows) {
+			header = append(header, c.name)
+		}
+		writer.Write(header)
+	}
+	columns := make(map[string]bool, len(header))
+	for _, name := range header {
+		columns[name] = true
+	}
+	dropped := make(map[string]bool)
+	for _, row := range rows {
+		record := make([]string, len(header))
+		for i, name := range header {
+			record[i] = formatValue(row[name])
+		}
+		for name := range row {
+			if !columns[name] {
+				dropped[name] = true
+			}
+		}
+		writer.Write(record)
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return IndexResult{}, fmt.Errorf("CSV encoding error: %s", err)
+	}
+	if len(dropped) > 0 {
+		log.Warnf("Fields %s not in the header of %s, dropping them", strings.Join(sortedKeys(dropped), ", "), filename)
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return IndexResult{}, fmt.Errorf("error writing metrics file %s: %s", filename, err)
+	}
+	_, err = file.Write(buffer.Bytes())
+	if err = errors.Join(err, file.Close()); err != nil {
+		return IndexResult{}, fmt.Errorf("error writing metrics file %s: %s", filename, err)
+	}
+	return IndexResult{Target: filename, Indexed: len(documents), Duration: time.Since(start)}, nil
+}
+
+// readCSVHeader returns the header of the CSV metric file, nil when it doesn't exist or is empty
+func readCSVHeader(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	header, err := csv.NewReader(file).Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	return header, err
+}
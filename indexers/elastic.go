@@ -16,14 +16,11 @@ package indexers
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
-	"crypto/sha256"
-	"crypto/tls"
-	"encoding/hex"
-	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
-	"runtime"
 	"strings"
 	"sync"
 	"time"
@@ -35,29 +32,62 @@ import (
 
 // Elastic ElasticSearch instance
 type Elastic struct {
-	index string
+	client           *elasticsearch.Client
+	index            string
+	failureThreshold float64
+	retry            RetryConfig
+	bulkConfig       BulkConfig
+	mappingMode      MappingMode
+	mapping          map[string]interface{}
+	router           *indexRouter
+	lifecycle        LifecycleConfig
 }
 
-// ESClient elasticsearch client instance
-var ESClient *elasticsearch.Client
-
 // Returns new indexer for Elastic
 func NewElasticIndexer(indexerConfig IndexerConfig) (*Elastic, error) {
-	var err error
 	var esIndexer Elastic
 	if indexerConfig.Index == "" {
 		return &esIndexer, fmt.Errorf("index name not specified")
 	}
+	if indexerConfig.FailureThreshold < 0 || indexerConfig.FailureThreshold > 1 {
+		return &esIndexer, fmt.Errorf("failure threshold must be between 0 and 1")
+	}
 	esIndex := strings.ToLower(indexerConfig.Index)
+	router, err := newIndexRouter(indexerConfig.Index)
+	if err != nil {
+		return &esIndexer, err
+	}
+	tlsConfig, err := indexerConfig.Auth.tlsConfig(indexerConfig.InsecureSkipVerify)
+	if err != nil {
+		return &esIndexer, err
+	}
+	creds, err := indexerConfig.Auth.credentials()
+	if err != nil {
+		return &esIndexer, err
+	}
 	cfg := elasticsearch.Config{
-		Addresses: indexerConfig.Servers,
-		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: indexerConfig.InsecureSkipVerify}},
+		Addresses:    indexerConfig.Servers,
+		Username:     creds.username,
+		Password:     creds.password,
+		APIKey:       creds.apiKey,
+		ServiceToken: creds.bearerToken,
+		Transport:    &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	// This version of the ES client can't compress the request bodies by itself
+	if indexerConfig.Bulk.Compress {
+		cfg.Transport = &gzipTransport{next: cfg.Transport}
+	}
+	if indexerConfig.Retry.MaxAttempts > 0 {
+		cfg.MaxRetries = indexerConfig.Retry.MaxAttempts - 1
+		cfg.DisableRetry = indexerConfig.Retry.MaxAttempts == 1
+		cfg.RetryOnStatus = indexerConfig.Retry.retryableStatusCodes()
+		cfg.RetryBackoff = indexerConfig.Retry.backoff
 	}
-	ESClient, err = elasticsearch.NewClient(cfg)
+	esIndexer.client, err = elasticsearch.NewClient(cfg)
 	if err != nil {
 		return &esIndexer, fmt.Errorf("error creating the ES client: %s", err)
 	}
-	r, err := ESClient.Cluster.Health()
+	r, err := esIndexer.client.Cluster.Health()
 	if err != nil {
 		return &esIndexer, fmt.Errorf("ES health check failed: %s", err)
 	}
@@ -65,86 +95,316 @@ func NewElasticIndexer(indexerConfig IndexerConfig) (*Elastic, error) {
 		return &esIndexer, fmt.Errorf("unexpected ES status code: %d", r.StatusCode)
 	}
 	esIndexer.index = esIndex
-	r, _ = ESClient.Indices.Exists([]string{esIndex})
-	if r.IsError() {
-		r, _ = ESClient.Indices.Create(esIndex)
-		if r.IsError() {
-			return &esIndexer, fmt.Errorf("error creating index %s on ES: %s", esIndex, r.String())
+	esIndexer.failureThreshold = indexerConfig.FailureThreshold
+	esIndexer.retry = indexerConfig.Retry
+	esIndexer.bulkConfig = indexerConfig.Bulk
+	esIndexer.mappingMode = indexerConfig.Mapping.Mode
+	if esIndexer.mapping, err = indexerConfig.Mapping.load(); err != nil {
+		return &esIndexer, err
+	}
+	esIndexer.lifecycle = indexerConfig.Lifecycle
+	if esIndexer.lifecycle.Policy != "" {
+		if err := esIndexer.ensurePolicy(); err != nil {
+			return &esIndexer, err
 		}
 	}
+	// Data streams are created from a matching index template
+	installTemplate := esIndexer.mappingMode == MappingTemplate || esIndexer.lifecycle.DataStream
+	// Templated indexes are created on demand, when documents are routed to them
+	if router != nil {
+		esIndexer.index = indexerConfig.Index
+		esIndexer.router = router
+		if installTemplate {
+			if err := esIndexer.putIndexTemplate(router.templateName(), router.indexPatterns()); err != nil {
+				return &esIndexer, err
+			}
+		}
+		return &esIndexer, nil
+	}
+	if installTemplate {
+		if err := esIndexer.putIndexTemplate(esIndex, []string{esIndex}); err != nil {
+			return &esIndexer, err
+		}
+	}
+	if err := esIndexer.ensureIndex(esIndex); err != nil {
+		return &esIndexer, err
+	}
 	return &esIndexer, nil
 }
 
-// Index uses bulkIndexer to index the documents in the given index
-func (esIndexer *Elastic) Index(documents []interface{}, opts IndexingOpts) (string, error) {
-	var statString string
-	var indexerStatsLock sync.Mutex
-	indexerStats := make(map[string]int)
+// gzipTransport gzip compresses the body of the requests before sending them through the next transport
+type gzipTransport struct {
+	next http.RoundTripper
+}
 
-	if len(documents) <= 0 {
-		return fmt.Sprintf("Indexing skipped due to %v docs", len(documents)), nil
+// RoundTrip compresses the request body into a new request. The body is read from GetBody when set,
+// so the body of the original request is left unread and the request can be retried
+func (t *gzipTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return t.next.RoundTrip(req)
 	}
-	hasher := sha256.New()
-	bi, err := esutil.NewBulkIndexer(esutil.BulkIndexerConfig{
-		Client:     ESClient,
-		Index:      esIndexer.index,
-		FlushBytes: 5e+6,
-		NumWorkers: runtime.NumCPU(),
-		Timeout:    10 * time.Minute, // TODO: hardcoded
-	})
+	body := req.Body
+	if req.GetBody != nil {
+		var err error
+		if body, err = req.GetBody(); err != nil {
+			return nil, fmt.Errorf("error reading request body: %s", err)
+		}
+		defer body.Close()
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := io.Copy(zw, body); err != nil {
+		return nil, fmt.Errorf("error compressing request body: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("error compressing request body: %s", err)
+	}
+	if req.GetBody == nil {
+		_ = req.Body.Close()
+	}
+	compressedReq := req.Clone(req.Context())
+	compressedReq.Body = io.NopCloser(&buf)
+	compressedReq.GetBody = nil
+	compressedReq.ContentLength = int64(buf.Len())
+	compressedReq.Header.Set("Content-Encoding", "gzip")
+	return t.next.RoundTrip(compressedReq)
+}
+
+// putIndexTemplate installs a composable index template applying the configured mapping to the given index patterns
+func (esIndexer *Elastic) putIndexTemplate(name string, indexPatterns []string) error {
+	body, err := indexTemplateBody(indexPatterns, esIndexer.mapping, esIndexer.indexSettings(), esIndexer.lifecycle.DataStream)
 	if err != nil {
-		return "", fmt.Errorf("error creating the indexer: %s", err)
+		return err
 	}
-	start := time.Now().UTC()
-	docHash := make(map[string]bool)
-	redundantSkipped := 0
-	for _, document := range documents {
-		j, err := json.Marshal(document)
+	r, err := esIndexer.client.Indices.PutIndexTemplate(name, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error installing index template %s on ES: %s", name, err)
+	}
+	defer r.Body.Close()
+	if r.IsError() {
+		return fmt.Errorf("error installing index template %s on ES: %s", name, r.String())
+	}
+	return nil
+}
+
+// ensureIndex creates the given index, or data stream, when it doesn't exist, otherwise it checks its mapping is compatible with the configured one
+func (esIndexer *Elastic) ensureIndex(index string) error {
+	r, err := esIndexer.client.Indices.Exists([]string{index})
+	if err != nil {
+		return fmt.Errorf("error checking index %s on ES: %w", index, err)
+	}
+	if r.IsError() && esIndexer.lifecycle.DataStream {
+		r, err = esIndexer.client.Indices.CreateDataStream(index)
 		if err != nil {
-			return "", fmt.Errorf("cannot encode document %v: %s", document, err)
+			return fmt.Errorf("error creating data stream %s on ES: %w", index, err)
 		}
+		if r.IsError() {
+			return fmt.Errorf("error creating data stream %s on ES: %w", index, &statusError{status: r.StatusCode, message: r.String()})
+		}
+		return nil
+	}
+	if r.IsError() {
+		var body io.Reader
+		var mapping map[string]interface{}
+		if esIndexer.mappingMode == MappingIndex {
+			mapping = esIndexer.mapping
+		}
+		createBody, err := createIndexBody(mapping, esIndexer.indexSettings())
+		if err != nil {
+			return err
+		}
+		if createBody != nil {
+			body = bytes.NewReader(createBody)
+		}
+		r, err = esIndexer.client.Indices.Create(index, esIndexer.client.Indices.Create.WithBody(body))
+		if err != nil {
+			return fmt.Errorf("error creating index %s on ES: %w", index, err)
+		}
+		if r.IsError() {
+			return fmt.Errorf("error creating index %s on ES: %w", index, &statusError{status: r.StatusCode, message: r.String()})
+		}
+		return nil
+	}
+	if esIndexer.mapping == nil {
+		return nil
+	}
+	r, err = esIndexer.client.Indices.GetMapping(esIndexer.client.Indices.GetMapping.WithIndex(index))
+	if err != nil {
+		return fmt.Errorf("error getting mapping of index %s on ES: %w", index, err)
+	}
+	defer r.Body.Close()
+	if r.IsError() {
+		return fmt.Errorf("error getting mapping of index %s on ES: %w", index, &statusError{status: r.StatusCode, message: r.String()})
+	}
+	return checkMappingCompatibility(index, esIndexer.mapping, r.Body)
+}
+
+// indexSettings returns the settings of the created indexes, or nil when there are none
+func (esIndexer *Elastic) indexSettings() map[string]interface{} {
+	if esIndexer.lifecycle.Policy == "" {
+		return nil
+	}
+	return map[string]interface{}{"index.lifecycle.name": esIndexer.lifecycle.Policy}
+}
 
-		hasher.Write(j)
-		docId := hex.EncodeToString(hasher.Sum(nil))
-		if _, exists := docHash[docId]; exists {
-			log.Debugf("Skipping redundant document with ID: %s", docId)
-			redundantSkipped++
-			continue
+// ensurePolicy creates the configured ILM policy from the policy file when it doesn't exist
+func (esIndexer *Elastic) ensurePolicy() error {
+	policyName := esIndexer.lifecycle.Policy
+	r, err := esIndexer.client.ILM.GetLifecycle(esIndexer.client.ILM.GetLifecycle.WithPolicy(policyName))
+	if err != nil {
+		return fmt.Errorf("error getting ILM policy %s on ES: %s", policyName, err)
+	}
+	defer r.Body.Close()
+	if r.StatusCode == http.StatusOK {
+		log.Debugf("ILM policy %s found", policyName)
+		existing, err := io.ReadAll(r.Body)
+		if err != nil {
+			return fmt.Errorf("error getting ILM policy %s on ES: %s", policyName, err)
 		}
+		return esIndexer.lifecycle.checkRollover(existing)
+	}
+	if r.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("error getting ILM policy %s on ES: %s", policyName, r.String())
+	}
+	policy, err := esIndexer.lifecycle.policy()
+	if err != nil {
+		return err
+	}
+	if policy == nil {
+		return fmt.Errorf("ILM policy %s not found on ES and no policy file configured", policyName)
+	}
+	if err := esIndexer.lifecycle.checkRollover(policy); err != nil {
+		return err
+	}
+	r, err = esIndexer.client.ILM.PutLifecycle(policyName, esIndexer.client.ILM.PutLifecycle.WithBody(bytes.NewReader(policy)))
+	if err != nil {
+		return fmt.Errorf("error creating ILM policy %s on ES: %s", policyName, err)
+	}
+	defer r.Body.Close()
+	if r.IsError() {
+		return fmt.Errorf("error creating ILM policy %s on ES: %s", policyName, r.String())
+	}
+	log.Infof("ILM policy %s created", policyName)
+	return nil
+}
+
+// Client returns the ElasticSearch client used by the indexer
+func (esIndexer *Elastic) Client() *elasticsearch.Client {
+	return esIndexer.client
+}
 
+// Index uses bulkIndexer to index the documents in the given index
+func (esIndexer *Elastic) Index(documents []interface{}, opts IndexingOpts) (IndexResult, error) {
+	return esIndexer.IndexWithContext(context.Background(), documents, opts)
+}
+
+// IndexWithContext uses bulkIndexer to index the documents in the given index.
+// The context is propagated to every bulk request, so cancelling it aborts the in-flight requests
+func (esIndexer *Elastic) IndexWithContext(ctx context.Context, documents []interface{}, opts IndexingOpts) (IndexResult, error) {
+	result := IndexResult{Target: esIndexer.index}
+	if len(documents) <= 0 {
+		return result, nil
+	}
+	start := time.Now().UTC()
+	var err error
+	if esIndexer.lifecycle.DataStream {
+		if opts, err = dataStreamOpts(opts); err != nil {
+			return result, err
+		}
+	}
+	docs, redundantSkipped, err := encodeBulkDocuments(documents, opts, esIndexer.router)
+	if err != nil {
+		return result, err
+	}
+	if esIndexer.lifecycle.DataStream {
+		addDataStreamTimestamp(docs)
+	}
+	result.SkippedDuplicates = redundantSkipped
+	if esIndexer.router != nil {
+		result.Target = routedIndexes(docs)
+		if err := esIndexer.router.ensureIndexes(docs, esIndexer.ensureIndex); err != nil {
+			return result, err
+		}
+	}
+	if err := bulkWithRetries(ctx, docs, &result, esIndexer.retry, esIndexer.bulk); err != nil {
+		result.Duration = time.Since(start)
+		return result, err
+	}
+	result.Duration = time.Since(start)
+	if err := ctx.Err(); err != nil {
+		return result, fmt.Errorf("ES indexing interrupted: %w", err)
+	}
+	return result, checkFailureThreshold(result, len(docs), esIndexer.failureThreshold)
+}
+
+// bulk sends the documents through a bulk indexer and returns the rejected ones
+func (esIndexer *Elastic) bulk(ctx context.Context, docs []bulkDocument, result *IndexResult) ([]bulkFailure, error) {
+	var indexerStatsLock sync.Mutex
+	var flushErr error
+	var failures []bulkFailure
+	acknowledged := make(map[string]bool)
+	bi, err := esutil.NewBulkIndexer(esutil.BulkIndexerConfig{
+		Client:        esIndexer.client,
+		Index:         esIndexer.index,
+		FlushBytes:    esIndexer.bulkConfig.flushBytes(),
+		FlushInterval: esIndexer.bulkConfig.FlushInterval,
+		NumWorkers:    esIndexer.bulkConfig.workers(),
+		Timeout:       esIndexer.bulkConfig.timeout(),
+		// Bulk workers flush using context.Background() by default, hand them the caller's context instead
+		OnFlushStart: func(context.Context) context.Context {
+			return ctx
+		},
+		// Documents of a failed bulk request don't trigger OnFailure, keep the error to report them later
+		OnError: func(c context.Context, err error) {
+			indexerStatsLock.Lock()
+			defer indexerStatsLock.Unlock()
+			flushErr = err
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating the indexer: %s", err)
+	}
+	for _, doc := range docs {
 		err = bi.Add(
-			context.Background(),
+			ctx,
 			esutil.BulkIndexerItem{
-				Action:     "index",
-				Body:       bytes.NewReader(j),
-				DocumentID: docId,
+				Index:      doc.index,
+				Action:     doc.action,
+				Body:       bytes.NewReader(doc.body),
+				DocumentID: doc.id,
 				OnSuccess: func(c context.Context, bii esutil.BulkIndexerItem, biri esutil.BulkIndexerResponseItem) {
 					indexerStatsLock.Lock()
 					defer indexerStatsLock.Unlock()
-					indexerStats[biri.Result]++
+					acknowledged[bii.DocumentID] = true
+					result.Indexed++
+					switch biri.Result {
+					case "created":
+						result.Created++
+					case "updated":
+						result.Updated++
+					}
 				},
 				OnFailure: func(c context.Context, bii esutil.BulkIndexerItem, biri esutil.BulkIndexerResponseItem, err error) {
 					log.Infof("Failed to index document with ID %s: %s, error: %v", bii.DocumentID, biri.Error.Reason, err)
+					reason := fmt.Sprintf("%s: %s", biri.Error.Type, biri.Error.Reason)
+					if err != nil {
+						reason = err.Error()
+					}
+					indexerStatsLock.Lock()
+					defer indexerStatsLock.Unlock()
+					acknowledged[bii.DocumentID] = true
+					failures = append(failures, bulkFailure{document: doc, status: biri.Status, reason: reason})
 				},
 			},
 		)
 		if err != nil {
-			log.Infof("Error adding document with ID %s: %s", docId, err)
-			return "", fmt.Errorf("unexpected ES indexing error: %s", err)
+			log.Infof("Error adding document with ID %s: %s", doc.id, err)
+			_ = bi.Close(ctx)
+			return unacknowledged(failures, docs, acknowledged, err), fmt.Errorf("unexpected ES indexing error: %w", err)
 		}
-
-		docHash[docId] = true
-		hasher.Reset()
-	}
-	if err := bi.Close(context.Background()); err != nil {
-		return "", fmt.Errorf("unexpected ES error: %s", err)
-	}
-	dur := time.Since(start)
-	for stat, val := range indexerStats {
-		statString += fmt.Sprintf(" %s=%d", stat, val)
 	}
-	if redundantSkipped > 0 {
-		statString += fmt.Sprintf(" redundantskipped=%d", redundantSkipped)
+	if err := bi.Close(ctx); err != nil {
+		return unacknowledged(failures, docs, acknowledged, err), fmt.Errorf("unexpected ES error: %w", err)
 	}
-	return fmt.Sprintf("Indexing finished in %v:%v", dur.Truncate(time.Millisecond), statString), nil
+	return unacknowledged(failures, docs, acknowledged, flushErr), nil
 }
@@ -22,6 +22,10 @@ import (
 func NewIndexer(indexerConfig IndexerConfig) (*Indexer, error) {
 	var indexer Indexer
 	var err error
+	if indexerConfig.Spool.Directory != "" {
+		indexer, err = NewSpoolIndexer(indexerConfig)
+		return &indexer, err
+	}
 	switch indexerConfig.Type {
 	case LocalIndexer:
 		indexer, err = NewLocalIndexer(indexerConfig)
@@ -31,6 +35,12 @@ func NewIndexer(indexerConfig IndexerConfig) (*Indexer, error) {
 		indexer, err = NewOpenSearchIndexer(indexerConfig)
 	case TSDBIndexer:
 		indexer, err = NewTSDBIndexer(indexerConfig)
+	case MultiIndexer:
+		indexer, err = NewMultiIndexer(indexerConfig)
+	case RemoteWriteIndexer:
+		indexer, err = NewRemoteWriteIndexer(indexerConfig)
+	case KafkaIndexer:
+		indexer, err = NewKafkaIndexer(indexerConfig)
 	default:
 		return &indexer, fmt.Errorf("Indexer not found: %s", indexerConfig.Type)
 	}
@@ -0,0 +1,105 @@
+// Copyright 2024 The go-commons Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexers
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// Hidden directory holding the lock files of the metric files of a directory
+	lockDirectory = ".locks"
+	// Suffix of the lock files of the metric files
+	lockSuffix = ".lock"
+)
+
+// fileLock is the mutex of a metric file, along with the number of goroutines holding or waiting for it
+type fileLock struct {
+	sync.Mutex
+	refs int
+}
+
+var (
+	// fileLocks holds the mutex of every metric file being written by this process, keyed by absolute path,
+	// so Local indexers sharing a directory exclude each other. Unused mutexes are removed
+	fileLocks     = map[string]*fileLock{}
+	fileLocksLock sync.Mutex
+)
+
+// lockFile locks the given metric file against the other goroutines of this process and, through a
+// lock file in the hidden lock directory next to it, against other processes. The returned function releases the lock
+func lockFile(filename string) (func(), error) {
+	absPath, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error locking metrics file %s: %s", filename, err)
+	}
+	fileLocksLock.Lock()
+	mutex, ok := fileLocks[absPath]
+	if !ok {
+		mutex = &fileLock{}
+		fileLocks[absPath] = mutex
+	}
+	mutex.refs++
+	fileLocksLock.Unlock()
+	mutex.Lock()
+	release := func() {
+		mutex.Unlock()
+		fileLocksLock.Lock()
+		defer fileLocksLock.Unlock()
+		if mutex.refs--; mutex.refs == 0 {
+			delete(fileLocks, absPath)
+		}
+	}
+	lockDir := filepath.Join(filepath.Dir(filename), lockDirectory)
+	if err := os.Mkdir(lockDir, 0755); err != nil && !errors.Is(err, fs.ErrExist) {
+		release()
+		return nil, fmt.Errorf("error locking metrics file %s: %s", filename, err)
+	}
+	unlock, err := flockFile(filepath.Join(lockDir, filepath.Base(filename)+lockSuffix))
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("error locking metrics file %s: %s", filename, err)
+	}
+	return func() {
+		unlock()
+		release()
+	}, nil
+}
+
+// writeFileAtomic writes the content to a temporary file of the same directory and renames it
+// to the given file name, so readers never see a partially written file
+func writeFileAtomic(filename string, content []byte) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(content)
+	err = errors.Join(err, tmpFile.Close())
+	if err == nil {
+		err = os.Chmod(tmpFile.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+	}
+	return err
+}
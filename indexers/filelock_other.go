@@ -0,0 +1,31 @@
+// Copyright 2024 The go-commons Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !unix
+
+package indexers
+
+import "os"
+
+// flockFile creates the given lock file, file locks aren't supported on this platform
+// so metric files are only locked against the goroutines of the current process
+func flockFile(lockName string) (func(), error) {
+	file, err := os.OpenFile(lockName, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		file.Close()
+	}, nil
+}
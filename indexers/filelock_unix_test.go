@@ -0,0 +1,35 @@
+//go:build unix
+
+package indexers
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tests for filelock_unix.go", func() {
+	It("excludes other holders of the lock file", func() {
+		lockName := filepath.Join(GinkgoT().TempDir(), "podLatency.json"+lockSuffix)
+		unlock, err := flockFile(lockName)
+		Expect(err).To(BeNil())
+		var acquired atomic.Bool
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(done)
+			// A second open file description behaves as another process would
+			secondUnlock, err := flockFile(lockName)
+			Expect(err).To(BeNil())
+			acquired.Store(true)
+			secondUnlock()
+		}()
+		Consistently(acquired.Load, 100*time.Millisecond).Should(BeFalse())
+		unlock()
+		Eventually(done).Should(BeClosed())
+		Expect(acquired.Load()).To(BeTrue())
+	})
+})
@@ -0,0 +1,144 @@
+// Copyright 2024 The go-commons Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Name of the index template installed for templated index names without a static prefix
+const defaultIndexTemplateName = "go-commons"
+
+var (
+	templateActionRegex = regexp.MustCompile(`{{.*?}}`)
+	repeatedSeparators  = regexp.MustCompile(`[-_.]{2,}`)
+)
+
+// indexRouter routes every document to the index rendered from an index name template such as
+// ripsaw-{{.MetricName}}-{{.Date "2006.01"}}, the indexes are created on demand
+type indexRouter struct {
+	indexName string
+	template  *template.Template
+	lock      sync.Mutex
+	ensured   map[string]bool
+}
+
+// indexNameData is the data available to index name templates
+type indexNameData struct {
+	// MetricName metric name of the indexing options, or the metricName field of the document when not set
+	MetricName string
+	timestamp  time.Time
+}
+
+// Date formats the timestamp field of the document, or the current time when it has none, with the given layout
+func (d indexNameData) Date(layout string) string {
+	return d.timestamp.UTC().Format(layout)
+}
+
+// newIndexRouter returns a router for the given index name, or nil when it isn't a template
+func newIndexRouter(indexName string) (*indexRouter, error) {
+	if !strings.Contains(indexName, "{{") {
+		return nil, nil
+	}
+	tmpl, err := template.New("index").Parse(indexName)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing index name template: %s", err)
+	}
+	return &indexRouter{indexName: indexName, template: tmpl, ensured: make(map[string]bool)}, nil
+}
+
+// resolve returns the index of the given JSON encoded document, index names being lowercase
+func (r *indexRouter) resolve(document []byte, opts IndexingOpts) (string, error) {
+	index, err := r.render(document, opts)
+	return strings.ToLower(index), err
+}
+
+// render renders the name template for the given JSON encoded document, keeping its case
+func (r *indexRouter) render(document []byte, opts IndexingOpts) (string, error) {
+	var doc struct {
+		MetricName string `json:"metricName"`
+		Timestamp  string `json:"timestamp"`
+	}
+	// Documents that aren't objects, or have fields of other types, just lack the routing fields
+	_ = json.Unmarshal(document, &doc)
+	data := indexNameData{MetricName: opts.MetricName, timestamp: time.Now()}
+	if data.MetricName == "" {
+		data.MetricName = doc.MetricName
+	}
+	if timestamp, err := time.Parse(time.RFC3339Nano, doc.Timestamp); err == nil {
+		data.timestamp = timestamp
+	}
+	var index bytes.Buffer
+	if err := r.template.Execute(&index, data); err != nil {
+		return "", fmt.Errorf("error rendering index name: %s", err)
+	}
+	if index.Len() == 0 {
+		return "", fmt.Errorf("index name template %s rendered an empty index name", r.indexName)
+	}
+	return index.String(), nil
+}
+
+// ensureIndexes calls ensureIndex once for every index the documents are routed to
+func (r *indexRouter) ensureIndexes(docs []bulkDocument, ensureIndex func(string) error) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, doc := range docs {
+		if r.ensured[doc.index] {
+			continue
+		}
+		if err := ensureIndex(doc.index); err != nil {
+			return err
+		}
+		r.ensured[doc.index] = true
+	}
+	return nil
+}
+
+// indexPatterns returns the index patterns matching every index rendered from the template
+func (r *indexRouter) indexPatterns() []string {
+	return []string{strings.ToLower(templateActionRegex.ReplaceAllString(r.indexName, "*"))}
+}
+
+// templateName returns the name of the index template of the rendered indexes, derived from the static parts of the index name
+func (r *indexRouter) templateName() string {
+	name := strings.ToLower(templateActionRegex.ReplaceAllString(r.indexName, ""))
+	name = strings.Trim(repeatedSeparators.ReplaceAllString(name, "-"), "-_.")
+	if name == "" {
+		return defaultIndexTemplateName
+	}
+	return name
+}
+
+// routedIndexes returns the sorted list of indexes the documents are routed to, separated by commas
+func routedIndexes(docs []bulkDocument) string {
+	var indexes []string
+	seen := make(map[string]bool)
+	for _, doc := range docs {
+		if !seen[doc.index] {
+			seen[doc.index] = true
+			indexes = append(indexes, doc.index)
+		}
+	}
+	sort.Strings(indexes)
+	return strings.Join(indexes, ",")
+}
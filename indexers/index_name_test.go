@@ -0,0 +1,90 @@
+package indexers
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tests for index_name.go", func() {
+	Context("indexRouter", func() {
+		It("isn't used for static index names", func() {
+			router, err := newIndexRouter("ripsaw-kube-burner")
+			Expect(err).To(BeNil())
+			Expect(router).To(BeNil())
+		})
+
+		It("returns err on invalid templates", func() {
+			_, err := newIndexRouter("ripsaw-{{.MetricName")
+			Expect(err.Error()).To(HavePrefix("error parsing index name template"))
+		})
+
+		It("renders the metric name of the indexing options and the document timestamp", func() {
+			router, err := newIndexRouter(`ripsaw-{{.MetricName}}-{{.Date "2006.01"}}`)
+			Expect(err).To(BeNil())
+			index, err := router.resolve([]byte(`{"metricName":"nodeCPU","timestamp":"2024-03-05T10:00:00.123456789Z"}`), IndexingOpts{MetricName: "PodLatency"})
+			Expect(err).To(BeNil())
+			Expect(index).To(Equal("ripsaw-podlatency-2024.03"))
+		})
+
+		It("renders the metric name of the document and the current date", func() {
+			router, err := newIndexRouter(`ripsaw-{{.MetricName}}-{{.Date "2006"}}`)
+			Expect(err).To(BeNil())
+			index, err := router.resolve([]byte(`{"metricName":"nodeCPU","timestamp":1709632800}`), IndexingOpts{})
+			Expect(err).To(BeNil())
+			Expect(index).To(Equal("ripsaw-nodecpu-" + time.Now().UTC().Format("2006")))
+		})
+
+		It("returns err when the index name is empty", func() {
+			router, err := newIndexRouter(`{{.MetricName}}`)
+			Expect(err).To(BeNil())
+			_, err = router.resolve([]byte(`"document"`), IndexingOpts{})
+			Expect(err).To(MatchError("index name template {{.MetricName}} rendered an empty index name"))
+		})
+
+		It("derives the index template name and patterns", func() {
+			router, err := newIndexRouter(`Ripsaw-{{.MetricName}}-{{.Date "2006.01"}}`)
+			Expect(err).To(BeNil())
+			Expect(router.templateName()).To(Equal("ripsaw"))
+			Expect(router.indexPatterns()).To(ConsistOf("ripsaw-*-*"))
+			router, err = newIndexRouter(`{{.MetricName}}`)
+			Expect(err).To(BeNil())
+			Expect(router.templateName()).To(Equal(defaultIndexTemplateName))
+		})
+	})
+
+	for _, indexerType := range []IndexerType{ElasticIndexer, OpenSearchIndexer} {
+		Context("Index routing of "+string(indexerType), func() {
+			It("creates the rendered indexes on demand and routes every document", func() {
+				server := newMappingMockServer(map[string]map[string]interface{}{"ripsaw-nodecpu-2024.03": nil})
+				defer server.Close()
+				indexer, err := NewIndexer(IndexerConfig{
+					Type:    indexerType,
+					Servers: []string{server.URL},
+					Index:   `ripsaw-{{.MetricName}}-{{.Date "2006.01"}}`,
+					Mapping: MappingConfig{Mode: MappingTemplate},
+				})
+				Expect(err).To(BeNil())
+				Expect(server.indexes).To(HaveLen(1))
+				Expect(server.templates).To(HaveKeyWithValue("ripsaw", HaveKeyWithValue("index_patterns", ConsistOf("ripsaw-*-*"))))
+				documents := []interface{}{
+					map[string]interface{}{"metricName": "nodeCPU", "timestamp": "2024-03-05T10:00:00Z", "value": 1},
+					map[string]interface{}{"metricName": "nodeCPU", "timestamp": "2024-04-05T10:00:00Z", "value": 2},
+					map[string]interface{}{"metricName": "podLatency", "timestamp": "2024-04-05T10:00:00Z", "value": 3},
+					map[string]interface{}{"metricName": "podLatency", "timestamp": "2024-04-05T11:00:00Z", "value": 4},
+				}
+				result, err := (*indexer).Index(documents, IndexingOpts{})
+				Expect(err).To(BeNil())
+				Expect(result.Indexed).To(Equal(4))
+				Expect(result.Target).To(Equal("ripsaw-nodecpu-2024.03,ripsaw-nodecpu-2024.04,ripsaw-podlatency-2024.04"))
+				Expect(server.indexes).To(HaveLen(3))
+				Expect(server.indexedDocs).To(Equal(map[string]int{
+					"ripsaw-nodecpu-2024.03":    1,
+					"ripsaw-nodecpu-2024.04":    1,
+					"ripsaw-podlatency-2024.04": 2,
+				}))
+			})
+		})
+	}
+})
@@ -0,0 +1,288 @@
+// Copyright 2024 The go-commons Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+// Default Kafka indexer settings used when they're not specified in KafkaConfig
+const defaultKafkaTimeout = 30 * time.Second
+
+// SASLMechanism SASL mechanism used to authenticate to the Kafka brokers
+type SASLMechanism string
+
+// Supported SASL mechanisms
+const (
+	SASLPlain       SASLMechanism = "PLAIN"
+	SASLScramSHA256 SASLMechanism = "SCRAM-SHA-256"
+	SASLScramSHA512 SASLMechanism = "SCRAM-SHA-512"
+)
+
+// KafkaAcks acknowledgements the Kafka brokers send before a record is considered delivered
+type KafkaAcks string
+
+// Supported acknowledgements
+const (
+	// AcksAll waits for every in-sync replica
+	AcksAll KafkaAcks = "all"
+	// AcksLeader waits for the partition leader only
+	AcksLeader KafkaAcks = "leader"
+	// AcksNone doesn't wait for any acknowledgement, records are delivered once sent
+	AcksNone KafkaAcks = "none"
+)
+
+// KafkaConfig holds the settings of the Kafka indexer. The SASL credentials are the username and password
+// of IndexerConfig.Auth, its CA bundle and client certificate are used with TLS
+type KafkaConfig struct {
+	// Brokers seed brokers of the Kafka cluster
+	Brokers []string `yaml:"brokers"`
+	// Topic topic the documents are produced to. As the index name, it can be a template such as
+	// ripsaw-{{.MetricName}}, rendered from the indexing options metric name or the document. Unlike index names,
+	// topics are case-sensitive and aren't lowercased
+	Topic string `yaml:"topic"`
+	// Key record key, either a template rendered with the document fields such as {{.uuid}}-{{.jobName}}, or a
+	// dotted field path such as uuid. The ID function of the indexing options is used when not set
+	Key string `yaml:"key"`
+	// SASLMechanism SASL mechanism, SASL isn't used when not set
+	SASLMechanism SASLMechanism `yaml:"saslMechanism"`
+	// TLS connects to the brokers using TLS
+	TLS bool `yaml:"tls"`
+	// Acks acknowledgements waited for every record. Defaults to AcksAll
+	Acks KafkaAcks `yaml:"acks"`
+	// BatchMaxBytes maximum size in bytes of the record batches sent to every partition. The client default is used when not set
+	BatchMaxBytes int32 `yaml:"batchMaxBytes"`
+	// Linger time records are buffered to build larger batches. Records aren't buffered when not set
+	Linger time.Duration `yaml:"linger"`
+	// Timeout maximum time to deliver every record, including retries. Defaults to 30s
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Kafka indexer instance, it produces every document as a JSON record of a Kafka topic
+type Kafka struct {
+	client           *kgo.Client
+	topic            string
+	router           *indexRouter
+	key              *template.Template
+	keyFields        DocumentIDFunc
+	failureThreshold float64
+}
+
+// NewKafkaIndexer returns a new Kafka indexer, checking the brokers are reachable
+func NewKafkaIndexer(indexerConfig IndexerConfig) (*Kafka, error) {
+	var kafkaIndexer Kafka
+	config := indexerConfig.Kafka
+	if len(config.Brokers) == 0 {
+		return &kafkaIndexer, fmt.Errorf("no Kafka brokers configured")
+	}
+	if config.Topic == "" {
+		return &kafkaIndexer, fmt.Errorf("Kafka topic not specified")
+	}
+	if indexerConfig.FailureThreshold < 0 || indexerConfig.FailureThreshold > 1 {
+		return &kafkaIndexer, fmt.Errorf("failure threshold must be between 0 and 1")
+	}
+	var err error
+	if kafkaIndexer.router, err = newIndexRouter(config.Topic); err != nil {
+		return &kafkaIndexer, err
+	}
+	if strings.Contains(config.Key, "{{") {
+		if kafkaIndexer.key, err = template.New("key").Option("missingkey=error").Parse(config.Key); err != nil {
+			return &kafkaIndexer, fmt.Errorf("error parsing key template %s: %s", config.Key, err)
+		}
+	} else if config.Key != "" {
+		kafkaIndexer.keyFields = IDFromFields(config.Key)
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultKafkaTimeout
+	}
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(config.Brokers...),
+		kgo.RecordDeliveryTimeout(timeout),
+		kgo.ProducerLinger(config.Linger),
+	}
+	switch config.Acks {
+	case "", AcksAll:
+		opts = append(opts, kgo.RequiredAcks(kgo.AllISRAcks()))
+	case AcksLeader:
+		opts = append(opts, kgo.RequiredAcks(kgo.LeaderAck()), kgo.DisableIdempotentWrite())
+	case AcksNone:
+		opts = append(opts, kgo.RequiredAcks(kgo.NoAck()), kgo.DisableIdempotentWrite())
+	default:
+		return &kafkaIndexer, fmt.Errorf("unsupported acks %s", config.Acks)
+	}
+	if config.BatchMaxBytes > 0 {
+		opts = append(opts, kgo.ProducerBatchMaxBytes(config.BatchMaxBytes))
+	}
+	if config.SASLMechanism != "" {
+		mechanism, err := saslMechanism(config.SASLMechanism, indexerConfig.Auth)
+		if err != nil {
+			return &kafkaIndexer, err
+		}
+		opts = append(opts, kgo.SASL(mechanism))
+	}
+	if config.TLS {
+		tlsConfig, err := indexerConfig.Auth.tlsConfig(indexerConfig.InsecureSkipVerify)
+		if err != nil {
+			return &kafkaIndexer, err
+		}
+		opts = append(opts, kgo.DialTLSConfig(tlsConfig))
+	}
+	if kafkaIndexer.client, err = kgo.NewClient(opts...); err != nil {
+		return &kafkaIndexer, fmt.Errorf("error creating Kafka client: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := kafkaIndexer.client.Ping(ctx); err != nil {
+		kafkaIndexer.client.Close()
+		return &kafkaIndexer, fmt.Errorf("Kafka brokers not reachable: %s", err)
+	}
+	kafkaIndexer.topic = config.Topic
+	kafkaIndexer.failureThreshold = indexerConfig.FailureThreshold
+	return &kafkaIndexer, nil
+}
+
+// saslMechanism returns the SASL mechanism authenticating with the configured username and password
+func saslMechanism(mechanism SASLMechanism, auth AuthConfig) (sasl.Mechanism, error) {
+	creds, err := auth.credentials()
+	if err != nil {
+		return nil, err
+	}
+	if creds.username == "" {
+		return nil, fmt.Errorf("SASL mechanism %s requires a username and password", mechanism)
+	}
+	switch mechanism {
+	case SASLPlain:
+		return plain.Auth{User: creds.username, Pass: creds.password}.AsMechanism(), nil
+	case SASLScramSHA256:
+		return scram.Auth{User: creds.username, Pass: creds.password}.AsSha256Mechanism(), nil
+	case SASLScramSHA512:
+		return scram.Auth{User: creds.username, Pass: creds.password}.AsSha512Mechanism(), nil
+	}
+	return nil, fmt.Errorf("unsupported SASL mechanism %s", mechanism)
+}
+
+// Index produces the documents to the Kafka topic
+func (k *Kafka) Index(documents []interface{}, opts IndexingOpts) (IndexResult, error) {
+	return k.IndexWithContext(context.Background(), documents, opts)
+}
+
+// IndexWithContext produces the documents to the Kafka topic and waits for their acknowledgements.
+// Acknowledged records are counted as indexed, the rest as failed
+func (k *Kafka) IndexWithContext(ctx context.Context, documents []interface{}, opts IndexingOpts) (IndexResult, error) {
+	start := time.Now().UTC()
+	result := IndexResult{Target: k.topic}
+	records := make([]*kgo.Record, 0, len(documents))
+	documentIDs := make([]string, 0, len(documents))
+	topics := make(map[string]bool)
+	for j, document := range documents {
+		record, docId, err := k.record(document, opts)
+		if err != nil {
+			return result, fmt.Errorf("error encoding document %d: %w", j, err)
+		}
+		if metricName := opts.MetricName; metricName != "" {
+			record.Headers = append(record.Headers, kgo.RecordHeader{Key: "metricName", Value: []byte(metricName)})
+		}
+		topics[record.Topic] = true
+		records = append(records, record)
+		documentIDs = append(documentIDs, docId)
+	}
+	if k.router != nil {
+		result.Target = strings.Join(sortedKeys(topics), ",")
+	}
+	if err := ctx.Err(); err != nil {
+		return result, fmt.Errorf("indexing interrupted: %w", err)
+	}
+	produceResults := k.client.ProduceSync(ctx, records...)
+	for j, produceResult := range produceResults {
+		if produceResult.Err != nil {
+			result.Failed++
+			result.Failures = append(result.Failures, DocumentFailure{DocumentID: documentIDs[j], Reason: produceResult.Err.Error()})
+			continue
+		}
+		result.Indexed++
+		log.Debugf("Record %s delivered to %s/%d at offset %d", documentIDs[j], produceResult.Record.Topic, produceResult.Record.Partition, produceResult.Record.Offset)
+	}
+	result.Duration = time.Since(start)
+	if ctx.Err() != nil && result.Failed > 0 {
+		return result, fmt.Errorf("indexing interrupted: %w", ctx.Err())
+	}
+	return result, checkFailureThreshold(result, len(documents), k.failureThreshold)
+}
+
+// record encodes the document as a record, it also returns the ID of the document used to report failures
+func (k *Kafka) record(document interface{}, opts IndexingOpts) (*kgo.Record, string, error) {
+	j, err := json.Marshal(document)
+	if err != nil {
+		return nil, "", fmt.Errorf("JSON encoding error: %s", err)
+	}
+	record := &kgo.Record{Topic: k.topic, Value: j}
+	if k.router != nil {
+		// Kafka topics are case-sensitive, unlike index names they're not lowercased
+		if record.Topic, err = k.router.render(j, opts); err != nil {
+			return nil, "", err
+		}
+	}
+	var key string
+	switch {
+	case k.key != nil:
+		decoder := json.NewDecoder(bytes.NewReader(j))
+		decoder.UseNumber()
+		var fields interface{}
+		if err := decoder.Decode(&fields); err != nil {
+			return nil, "", err
+		}
+		var buffer bytes.Buffer
+		if err := k.key.Execute(&buffer, fields); err != nil {
+			return nil, "", fmt.Errorf("error rendering key: %s", err)
+		}
+		key = buffer.String()
+	case k.keyFields != nil:
+		if key, err = k.keyFields(document); err != nil {
+			return nil, "", fmt.Errorf("error getting key: %s", err)
+		}
+	case opts.DocumentID != nil:
+		if key, err = documentID(document, j, opts); err != nil {
+			return nil, "", err
+		}
+	}
+	if key != "" {
+		record.Key = []byte(key)
+		return record, key, nil
+	}
+	docId, err := documentID(document, j, opts)
+	return record, docId, err
+}
+
+// Close flushes the buffered records and closes the Kafka client
+func (k *Kafka) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultKafkaTimeout)
+	defer cancel()
+	err := k.client.Flush(ctx)
+	k.client.Close()
+	return err
+}
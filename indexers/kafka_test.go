@@ -0,0 +1,132 @@
+package indexers
+
+import (
+	"context"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tests for kafka.go", func() {
+	var cluster *kfake.Cluster
+	var indexerConfig IndexerConfig
+	var documents []interface{}
+	BeforeEach(func() {
+		var err error
+		cluster, err = kfake.NewCluster(kfake.NumBrokers(1), kfake.SeedTopics(2, "benchmarks", "ripsaw-podLatency"))
+		Expect(err).To(BeNil())
+		indexerConfig = IndexerConfig{
+			Type:  KafkaIndexer,
+			Kafka: KafkaConfig{Brokers: cluster.ListenAddrs(), Topic: "benchmarks", Key: "uuid", Timeout: 5 * time.Second},
+		}
+		documents = []interface{}{
+			map[string]interface{}{"uuid": "abc", "jobName": "density", "value": 1},
+			map[string]interface{}{"uuid": "def", "jobName": "density", "value": 2},
+		}
+	})
+	AfterEach(func() {
+		cluster.Close()
+	})
+
+	consume := func(topic string, count int) []*kgo.Record {
+		client, err := kgo.NewClient(kgo.SeedBrokers(cluster.ListenAddrs()...), kgo.ConsumeTopics(topic), kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()))
+		Expect(err).To(BeNil())
+		defer client.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		var records []*kgo.Record
+		for len(records) < count {
+			fetches := client.PollFetches(ctx)
+			Expect(fetches.Errors()).To(BeEmpty())
+			records = append(records, fetches.Records()...)
+		}
+		return records
+	}
+
+	It("produces the documents keyed by field and reports the acknowledged records", func() {
+		indexer, err := NewIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		DeferCleanup((*indexer).(*Kafka).Close)
+		result, err := (*indexer).Index(documents, IndexingOpts{MetricName: "podLatency"})
+		Expect(err).To(BeNil())
+		Expect(result.Target).To(Equal("benchmarks"))
+		Expect(result.Indexed).To(Equal(2))
+		Expect(result.Failed).To(BeZero())
+		keys := map[string]string{}
+		for _, record := range consume("benchmarks", 2) {
+			keys[string(record.Key)] = string(record.Value)
+			Expect(record.Headers).To(ContainElement(kgo.RecordHeader{Key: "metricName", Value: []byte("podLatency")}))
+		}
+		Expect(keys).To(Equal(map[string]string{
+			"abc": `{"jobName":"density","uuid":"abc","value":1}`,
+			"def": `{"jobName":"density","uuid":"def","value":2}`,
+		}))
+	})
+
+	It("renders the topic and key templates", func() {
+		indexerConfig.Kafka.Topic = "ripsaw-{{.MetricName}}"
+		indexerConfig.Kafka.Key = "{{.jobName}}-{{.value}}"
+		indexer, err := NewKafkaIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		defer indexer.Close()
+		result, err := indexer.Index(documents, IndexingOpts{MetricName: "podLatency"})
+		Expect(err).To(BeNil())
+		Expect(result.Target).To(Equal("ripsaw-podLatency"))
+		var keys []string
+		for _, record := range consume("ripsaw-podLatency", 2) {
+			keys = append(keys, string(record.Key))
+		}
+		Expect(keys).To(ConsistOf("density-1", "density-2"))
+		_, err = indexer.Index([]interface{}{map[string]interface{}{"value": 1}}, IndexingOpts{MetricName: "podLatency"})
+		Expect(err.Error()).To(HavePrefix("error encoding document 0: error rendering key"))
+	})
+
+	It("authenticates with SASL", func() {
+		cluster.Close()
+		var err error
+		cluster, err = kfake.NewCluster(kfake.NumBrokers(1), kfake.SeedTopics(1, "benchmarks"), kfake.EnableSASL(), kfake.Superuser("PLAIN", "admin", "secret"))
+		Expect(err).To(BeNil())
+		indexerConfig.Kafka.Brokers = cluster.ListenAddrs()
+		indexerConfig.Kafka.SASLMechanism = SASLPlain
+		indexerConfig.Auth = AuthConfig{Username: Secret{Value: "admin"}, Password: Secret{Value: "secret"}}
+		indexer, err := NewKafkaIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		defer indexer.Close()
+		result, err := indexer.Index(documents, IndexingOpts{})
+		Expect(err).To(BeNil())
+		Expect(result.Indexed).To(Equal(2))
+	})
+
+	It("reports the records that weren't delivered", func() {
+		indexerConfig.Kafka.Timeout = time.Second
+		indexer, err := NewKafkaIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		defer indexer.Close()
+		indexer.topic = "missing"
+		result, err := indexer.Index(documents, IndexingOpts{})
+		var bulkErr *BulkIndexError
+		Expect(err).To(BeAssignableToTypeOf(bulkErr))
+		Expect(result.Failed).To(Equal(2))
+		Expect(result.Failures[0].DocumentID).To(Equal("abc"))
+	})
+
+	It("returns err with missing or unsupported settings", func() {
+		_, err := NewKafkaIndexer(IndexerConfig{Type: KafkaIndexer})
+		Expect(err).To(MatchError("no Kafka brokers configured"))
+		indexerConfig.FailureThreshold = 1.5
+		_, err = NewKafkaIndexer(indexerConfig)
+		Expect(err).To(MatchError("failure threshold must be between 0 and 1"))
+		indexerConfig.FailureThreshold = 0
+		indexerConfig.Kafka.Acks = "some"
+		_, err = NewKafkaIndexer(indexerConfig)
+		Expect(err).To(MatchError("unsupported acks some"))
+		indexerConfig.Kafka.Acks = AcksLeader
+		indexerConfig.Kafka.SASLMechanism = SASLScramSHA512
+		_, err = NewKafkaIndexer(indexerConfig)
+		Expect(err).To(MatchError("SASL mechanism SCRAM-SHA-512 requires a username and password"))
+	})
+})
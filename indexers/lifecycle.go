@@ -0,0 +1,109 @@
+// Copyright 2024 The go-commons Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// LifecycleConfig holds the rollover and retention settings of the ElasticSearch and OpenSearch indexers
+type LifecycleConfig struct {
+	// DataStream writes the documents to a data stream named after the index using the create action, ElasticSearch only.
+	// The documents get a @timestamp field copied from their timestamp field when they don't have one
+	DataStream bool `yaml:"dataStream"`
+	// Policy name of the ILM policy (ElasticSearch) or ISM policy (OpenSearch) managing the indexes.
+	// Policies with a rollover action require DataStream, the rollover alias of plain indexes isn't bootstrapped
+	Policy string `yaml:"policy"`
+	// PolicyFile path of a JSON file holding the policy, used to create it when it doesn't exist.
+	// The policy must already exist when not set
+	PolicyFile string `yaml:"policyFile"`
+}
+
+// policy returns the body of the configured policy, or nil when no policy file is set
+func (l LifecycleConfig) policy() ([]byte, error) {
+	if l.PolicyFile == "" {
+		return nil, nil
+	}
+	policy, err := os.ReadFile(l.PolicyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading policy file: %s", err)
+	}
+	if !json.Valid(policy) {
+		return nil, fmt.Errorf("policy file %s isn't valid JSON", l.PolicyFile)
+	}
+	return policy, nil
+}
+
+// checkRollover returns an error when the given policy, or the response describing it, has a rollover action
+// and the documents aren't written to a data stream
+func (l LifecycleConfig) checkRollover(policy []byte) error {
+	var value interface{}
+	if l.DataStream || json.Unmarshal(policy, &value) != nil || !hasRollover(value, false) {
+		return nil
+	}
+	return fmt.Errorf("policy %s has a rollover action, only supported by ElasticSearch data streams", l.Policy)
+}
+
+// hasRollover returns true when the decoded policy has a rollover action, in the actions object of an
+// ILM phase or in the actions list of an ISM state
+func hasRollover(value interface{}, inActions bool) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if inActions && key == "rollover" {
+				return true
+			}
+			if hasRollover(child, key == "actions") {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			if hasRollover(child, inActions) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dataStreamOpts returns the indexing options for a data stream, which only support the create action
+func dataStreamOpts(opts IndexingOpts) (IndexingOpts, error) {
+	if opts.Action != "" && opts.Action != CreateAction {
+		return opts, fmt.Errorf("data streams only support the %s action", CreateAction)
+	}
+	opts.Action = CreateAction
+	return opts, nil
+}
+
+// addDataStreamTimestamp copies the timestamp field of the documents to the @timestamp field required by data streams
+func addDataStreamTimestamp(docs []bulkDocument) {
+	for i, doc := range docs {
+		var timestamps struct {
+			DataStreamTimestamp json.RawMessage `json:"@timestamp"`
+			Timestamp           json.RawMessage `json:"timestamp"`
+		}
+		if len(doc.body) == 0 || doc.body[0] != '{' || json.Unmarshal(doc.body, &timestamps) != nil {
+			continue
+		}
+		if timestamps.DataStreamTimestamp != nil || timestamps.Timestamp == nil {
+			continue
+		}
+		body := append([]byte(`{"@timestamp":`), timestamps.Timestamp...)
+		docs[i].body = append(append(body, ','), doc.body[1:]...)
+	}
+}
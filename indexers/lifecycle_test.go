@@ -0,0 +1,162 @@
+package indexers
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tests for lifecycle.go", func() {
+	var policyFile string
+	BeforeEach(func() {
+		policyFile = filepath.Join(GinkgoT().TempDir(), "policy.json")
+		Expect(os.WriteFile(policyFile, []byte(`{"policy":{"phases":{"delete":{"min_age":"30d","actions":{"delete":{}}}}}}`), 0600)).To(Succeed())
+	})
+
+	Context("Data stream documents", func() {
+		It("copies the timestamp field to @timestamp", func() {
+			docs := []bulkDocument{
+				{body: []byte(`{"timestamp":"2024-03-05T10:00:00Z","value":1}`)},
+				{body: []byte(`{"@timestamp":"2024-03-05T11:00:00Z","timestamp":"2024-03-05T10:00:00Z"}`)},
+				{body: []byte(`{"value":1}`)},
+				{body: []byte(`"document"`)},
+			}
+			addDataStreamTimestamp(docs)
+			Expect(string(docs[0].body)).To(Equal(`{"@timestamp":"2024-03-05T10:00:00Z","timestamp":"2024-03-05T10:00:00Z","value":1}`))
+			Expect(string(docs[1].body)).To(Equal(`{"@timestamp":"2024-03-05T11:00:00Z","timestamp":"2024-03-05T10:00:00Z"}`))
+			Expect(string(docs[2].body)).To(Equal(`{"value":1}`))
+			Expect(string(docs[3].body)).To(Equal(`"document"`))
+		})
+
+		It("only supports the create action", func() {
+			opts, err := dataStreamOpts(IndexingOpts{MetricName: "podLatency"})
+			Expect(err).To(BeNil())
+			Expect(opts).To(Equal(IndexingOpts{MetricName: "podLatency", Action: CreateAction}))
+			_, err = dataStreamOpts(IndexingOpts{Action: UpsertAction})
+			Expect(err).To(MatchError("data streams only support the create action"))
+		})
+
+		It("finds the rollover actions of ILM and ISM policies", func() {
+			ilmPolicy := []byte(`{"metrics":{"policy":{"phases":{"hot":{"actions":{"rollover":{"max_age":"1d"}}}}}}}`)
+			ismPolicy := []byte(`{"_id":"metrics","policy":{"states":[{"name":"hot","actions":[{"rollover":{"min_index_age":"1d"}}]}]}}`)
+			for _, policy := range [][]byte{ilmPolicy, ismPolicy} {
+				Expect(LifecycleConfig{Policy: "metrics"}.checkRollover(policy)).To(MatchError("policy metrics has a rollover action, only supported by ElasticSearch data streams"))
+				Expect(LifecycleConfig{Policy: "metrics", DataStream: true}.checkRollover(policy)).To(Succeed())
+			}
+			Expect(LifecycleConfig{Policy: "metrics"}.checkRollover([]byte(`{"policy":{"phases":{"rollover":{"actions":{"delete":{}}}}}}`))).To(Succeed())
+		})
+
+		It("returns err when the policy file isn't valid JSON", func() {
+			Expect(os.WriteFile(policyFile, []byte("policy:"), 0600)).To(Succeed())
+			_, err := LifecycleConfig{Policy: "metrics", PolicyFile: policyFile}.policy()
+			Expect(err).To(MatchError("policy file " + policyFile + " isn't valid JSON"))
+		})
+	})
+
+	Context("ElasticSearch data streams and ILM policies", func() {
+		It("creates the ILM policy, the data stream template and the data stream", func() {
+			server := newMappingMockServer(map[string]map[string]interface{}{})
+			defer server.Close()
+			indexer, err := NewElasticIndexer(IndexerConfig{
+				Type:      ElasticIndexer,
+				Servers:   []string{server.URL},
+				Index:     "kube-burner-metrics",
+				Lifecycle: LifecycleConfig{DataStream: true, Policy: "metrics", PolicyFile: policyFile},
+			})
+			Expect(err).To(BeNil())
+			Expect(server.policyRequests).To(Equal([]string{"GET metrics", "PUT metrics"}))
+			Expect(server.policies).To(HaveKey("metrics"))
+			Expect(server.templates).To(HaveKeyWithValue("kube-burner-metrics", HaveKey("data_stream")))
+			Expect(server.templates["kube-burner-metrics"]).To(HaveKeyWithValue("template", HaveKeyWithValue("settings", HaveKeyWithValue("index.lifecycle.name", "metrics"))))
+			Expect(server.dataStreams).To(ConsistOf("kube-burner-metrics"))
+			result, err := indexer.Index([]interface{}{map[string]interface{}{"timestamp": "2024-03-05T10:00:00Z", "value": 1}}, IndexingOpts{})
+			Expect(err).To(BeNil())
+			Expect(result.Indexed).To(Equal(1))
+			Expect(server.bulkActions).To(Equal(map[string]int{"create": 1}))
+			_, err = indexer.Index([]interface{}{"document"}, IndexingOpts{Action: IndexAction})
+			Expect(err).To(MatchError("data streams only support the create action"))
+		})
+
+		It("applies an existing ILM policy to the created index", func() {
+			server := newMappingMockServer(map[string]map[string]interface{}{})
+			server.policies["metrics"] = map[string]interface{}{}
+			defer server.Close()
+			_, err := NewElasticIndexer(IndexerConfig{
+				Type:      ElasticIndexer,
+				Servers:   []string{server.URL},
+				Index:     "kube-burner-metrics",
+				Lifecycle: LifecycleConfig{Policy: "metrics"},
+			})
+			Expect(err).To(BeNil())
+			Expect(server.policyRequests).To(Equal([]string{"GET metrics"}))
+			Expect(server.indexPolicies).To(HaveKeyWithValue("kube-burner-metrics", "metrics"))
+		})
+
+		It("returns err when an ILM policy with a rollover action manages plain indexes", func() {
+			server := newMappingMockServer(map[string]map[string]interface{}{})
+			server.policies["metrics"] = map[string]interface{}{"policy": map[string]interface{}{"phases": map[string]interface{}{
+				"hot": map[string]interface{}{"actions": map[string]interface{}{"rollover": map[string]interface{}{"max_age": "1d"}}},
+			}}}
+			defer server.Close()
+			_, err := NewElasticIndexer(IndexerConfig{
+				Type:      ElasticIndexer,
+				Servers:   []string{server.URL},
+				Index:     "kube-burner-metrics",
+				Lifecycle: LifecycleConfig{Policy: "metrics"},
+			})
+			Expect(err).To(MatchError("policy metrics has a rollover action, only supported by ElasticSearch data streams"))
+		})
+
+		It("returns err when the ILM policy doesn't exist and there's no policy file", func() {
+			server := newMappingMockServer(map[string]map[string]interface{}{})
+			defer server.Close()
+			_, err := NewElasticIndexer(IndexerConfig{
+				Type:      ElasticIndexer,
+				Servers:   []string{server.URL},
+				Index:     "kube-burner-metrics",
+				Lifecycle: LifecycleConfig{Policy: "metrics"},
+			})
+			Expect(err).To(MatchError("ILM policy metrics not found on ES and no policy file configured"))
+		})
+	})
+
+	Context("OpenSearch ISM policies", func() {
+		It("creates the ISM policy and adds it to the created index", func() {
+			server := newMappingMockServer(map[string]map[string]interface{}{})
+			defer server.Close()
+			_, err := NewOpenSearchIndexer(IndexerConfig{
+				Type:      OpenSearchIndexer,
+				Servers:   []string{server.URL},
+				Index:     "kube-burner-metrics",
+				Lifecycle: LifecycleConfig{Policy: "metrics", PolicyFile: policyFile},
+			})
+			Expect(err).To(BeNil())
+			Expect(server.policyRequests).To(Equal([]string{"GET metrics", "PUT metrics"}))
+			Expect(server.policies).To(HaveKeyWithValue("metrics", HaveKey("policy")))
+			Expect(server.indexPolicies).To(HaveKeyWithValue("kube-burner-metrics", "metrics"))
+		})
+
+		It("returns err when the ISM policy doesn't exist and there's no policy file", func() {
+			server := newMappingMockServer(map[string]map[string]interface{}{})
+			defer server.Close()
+			_, err := NewOpenSearchIndexer(IndexerConfig{
+				Type:      OpenSearchIndexer,
+				Servers:   []string{server.URL},
+				Index:     "kube-burner-metrics",
+				Lifecycle: LifecycleConfig{Policy: "metrics"},
+			})
+			Expect(err).To(MatchError("ISM policy metrics not found on OpenSearch and no policy file configured"))
+		})
+
+		It("returns err on data streams", func() {
+			_, err := NewOpenSearchIndexer(IndexerConfig{
+				Type:      OpenSearchIndexer,
+				Index:     "kube-burner-metrics",
+				Lifecycle: LifecycleConfig{DataStream: true},
+			})
+			Expect(err).To(MatchError("data streams are only supported by the ElasticSearch indexer"))
+		})
+	})
+})
@@ -15,15 +15,59 @@
 package indexers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path"
+	"sync"
+	"time"
 )
 
+// LocalFormat format of the metric files written by the Local indexer
+type LocalFormat string
+
+// Local indexer formats
+const (
+	// JSONFormat writes every metric file as a JSON array, rewritten on every call
+	JSONFormat LocalFormat = "json"
+	// NDJSONFormat appends the documents to the metric files as JSON lines
+	NDJSONFormat LocalFormat = "ndjson"
+	// ParquetFormat writes the documents to Parquet metric files, complete once the indexer is closed
+	ParquetFormat LocalFormat = "parquet"
+	// CSVFormat appends the documents to CSV metric files
+	CSVFormat LocalFormat = "csv"
+)
+
+// Compression compression algorithm of the NDJSON and Parquet metric files
+type Compression string
+
+// Supported compression algorithms
+const (
+	// GzipCompression compresses the metric files with gzip, using the .gz extension
+	GzipCompression Compression = "gzip"
+	// ZstdCompression compresses the metric files with zstd, using the .zst extension
+	ZstdCompression Compression = "zstd"
+)
+
+// LocalConfig holds the output format settings of the Local indexer
+type LocalConfig struct {
+	// Format format of the metric files. Defaults to JSONFormat
+	Format LocalFormat `yaml:"format"`
+	// Compression compression of the NDJSON metric files, or codec of the Parquet metric files. They're not compressed when not set
+	Compression Compression `yaml:"compression"`
+	// MaxFileSize size in bytes of the NDJSON metric files above which they're rotated, they're never rotated when not set
+	MaxFileSize int64 `yaml:"maxFileSize"`
+}
+
 // Local indexer instance
 type Local struct {
 	metricsDirectory string
+	config           LocalConfig
+	createTarball    bool
+	tarballName      string
+	parquetFiles     map[string]*parquetFile
+	lock             sync.Mutex
 }
 
 // NewLocalIndexer returns a new Local Indexer
@@ -32,35 +76,100 @@ func NewLocalIndexer(indexerConfig IndexerConfig) (*Local, error) {
 	if indexerConfig.MetricsDirectory == "" {
 		return &localIndexer, fmt.Errorf("directory name not specified")
 	}
+	localIndexer.config = indexerConfig.Local
+	switch localIndexer.config.Format {
+	case "":
+		localIndexer.config.Format = JSONFormat
+	case JSONFormat, NDJSONFormat, ParquetFormat, CSVFormat:
+	default:
+		return &localIndexer, fmt.Errorf("unsupported local format %s", localIndexer.config.Format)
+	}
+	switch localIndexer.config.Compression {
+	case "":
+	case GzipCompression, ZstdCompression:
+		if localIndexer.config.Format != NDJSONFormat && localIndexer.config.Format != ParquetFormat {
+			return &localIndexer, fmt.Errorf("compression is only supported by the %s and %s formats", NDJSONFormat, ParquetFormat)
+		}
+	default:
+		return &localIndexer, fmt.Errorf("unsupported compression %s", localIndexer.config.Compression)
+	}
 	localIndexer.metricsDirectory = indexerConfig.MetricsDirectory
+	localIndexer.createTarball = indexerConfig.CreateTarball
+	localIndexer.tarballName = indexerConfig.TarballName
+	if localIndexer.tarballName == "" {
+		localIndexer.tarballName = path.Clean(indexerConfig.MetricsDirectory) + ".tar.gz"
+	}
 	err := os.MkdirAll(localIndexer.metricsDirectory, 0744)
 	return &localIndexer, err
 }
 
 // Index uses generates a local file with the given name and metrics
-func (l *Local) Index(documents []interface{}, opts IndexingOpts) (string, error) {
+func (l *Local) Index(documents []interface{}, opts IndexingOpts) (IndexResult, error) {
+	return l.IndexWithContext(context.Background(), documents, opts)
+}
+
+// IndexWithContext generates a local file with the given name and metrics, the file is not
+// written if the context is cancelled before the documents are encoded. It's safe for concurrent
+// use, also by other processes writing the same metrics directory. Parquet metric files are the
+// exception: they're written by a single indexer, the others fail to create them
+func (l *Local) IndexWithContext(ctx context.Context, documents []interface{}, opts IndexingOpts) (IndexResult, error) {
 	if len(documents) == 0 {
-		return "", fmt.Errorf("empty document list in %v", opts.MetricName)
+		return IndexResult{}, fmt.Errorf("empty document list in %v", opts.MetricName)
 	}
 	if opts.MetricName == "" {
-		return "", fmt.Errorf("MetricName shouldn't be empty")
+		return IndexResult{}, fmt.Errorf("MetricName shouldn't be empty")
+	}
+	if err := ctx.Err(); err != nil {
+		return IndexResult{}, fmt.Errorf("indexing interrupted: %w", err)
 	}
+	switch l.config.Format {
+	case NDJSONFormat:
+		return l.appendNDJSON(ctx, documents, opts)
+	case ParquetFormat:
+		return l.writeParquet(ctx, documents, opts)
+	case CSVFormat:
+		return l.appendCSV(ctx, documents, opts)
+	}
+	start := time.Now().UTC()
 	metricName := fmt.Sprintf("%s.json", opts.MetricName)
 	filename := path.Join(l.metricsDirectory, metricName)
+	result := IndexResult{Target: filename, Indexed: len(documents)}
+	// The metric file is locked during the whole read-modify-write cycle, so concurrent calls don't lose documents
+	unlock, err := lockFile(filename)
+	if err != nil {
+		return IndexResult{}, err
+	}
+	defer unlock()
 	if content, err := os.ReadFile(filename); err == nil {
 		var existingDocs []interface{}
 		if err := json.Unmarshal(content, &existingDocs); err != nil {
-			return "", fmt.Errorf("JSON decoding error in %s: %s", filename, err)
+			return IndexResult{}, fmt.Errorf("JSON decoding error in %s: %s", filename, err)
 		}
 		documents = append(existingDocs, documents...)
 	}
 
 	content, err := json.Marshal(documents)
 	if err != nil {
-		return "", fmt.Errorf("JSON encoding error: %s", err)
+		return IndexResult{}, fmt.Errorf("JSON encoding error: %s", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return IndexResult{}, fmt.Errorf("indexing interrupted: %w", err)
+	}
+	if err := writeFileAtomic(filename, content); err != nil {
+		return IndexResult{}, fmt.Errorf("error writing metrics file %s: %s", filename, err)
+	}
+	result.Duration = time.Since(start)
+	return result, nil
+}
+
+// Close finalizes the metrics directory: the Parquet metric files are completed, then the directory
+// is packaged into a gzip tarball with a manifest when CreateTarball is set
+func (l *Local) Close() error {
+	if err := l.closeParquet(); err != nil {
+		return err
 	}
-	if err := os.WriteFile(filename, content, 0644); err != nil {
-		return "", fmt.Errorf("error writing metrics file %s: %s", filename, err)
+	if !l.createTarball {
+		return nil
 	}
-	return fmt.Sprintf("File %s now contains %d documents", filename, len(documents)), nil
+	return createTarball(l.metricsDirectory, l.tarballName)
 }
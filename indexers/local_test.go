@@ -1,12 +1,14 @@
 package indexers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path"
+	"sync"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -88,16 +90,18 @@ var _ = Describe("Tests for local.go", func() {
 		})
 
 		It("Metric file is created", func() {
-			_, err := indexer.Index(testcase.documents, testcase.opts)
+			result, err := indexer.Index(testcase.documents, testcase.opts)
 			Expect(err).To(BeNil())
-			_, err = os.Stat(path.Join(indexer.metricsDirectory, testcase.opts.MetricName+".json"))
+			Expect(result.Target).To(Equal(path.Join(indexer.metricsDirectory, testcase.opts.MetricName+".json")))
+			Expect(result.Indexed).To(Equal(len(testcase.documents)))
+			_, err = os.Stat(result.Target)
 			Expect(err).To(BeNil())
 		})
 
 		It("Err is returned metricsdirectory has fault", func() {
 			indexer.metricsDirectory = "abc"
 			_, err := indexer.Index(testcase.documents, testcase.opts)
-			Expect(err).To(MatchError(errors.New("error writing metrics file abc/placeholder.json: open abc/placeholder.json: no such file or directory")))
+			Expect(err).To(MatchError(errors.New("error locking metrics file abc/placeholder.json: mkdir abc/.locks: no such file or directory")))
 		})
 
 		It("Err is returned by documents not processed", func() {
@@ -137,6 +141,62 @@ var _ = Describe("Tests for local.go", func() {
 			Expect(len(updatedDocs)).To(Equal(len(existingDocs) + len(testcase.documents)))
 		})
 
+		It("does not write the metric file when the context is cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := indexer.IndexWithContext(ctx, testcase.documents, testcase.opts)
+			Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+			_, err = os.Stat(path.Join(indexer.metricsDirectory, testcase.opts.MetricName+".json"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("doesn't lose documents written concurrently", func() {
+			for _, format := range []LocalFormat{JSONFormat, NDJSONFormat} {
+				// Every goroutine gets its own indexer, as different processes would
+				var wg sync.WaitGroup
+				for i := 0; i < 16; i++ {
+					wg.Add(1)
+					go func() {
+						defer GinkgoRecover()
+						defer wg.Done()
+						localIndexer, err := NewLocalIndexer(IndexerConfig{MetricsDirectory: indexer.metricsDirectory, Local: LocalConfig{Format: format}})
+						Expect(err).To(BeNil())
+						for j := 0; j < 25; j++ {
+							_, err := localIndexer.Index(testcase.documents[:2], testcase.opts)
+							Expect(err).To(BeNil())
+						}
+					}()
+				}
+				wg.Wait()
+				var documents int
+				if format == NDJSONFormat {
+					reader, err := OpenNDJSON(indexer.metricsDirectory, testcase.opts.MetricName)
+					Expect(err).To(BeNil())
+					var document interface{}
+					for reader.Next(&document) == nil {
+						documents++
+					}
+					Expect(reader.Close()).To(Succeed())
+				} else {
+					content, err := os.ReadFile(path.Join(indexer.metricsDirectory, testcase.opts.MetricName+".json"))
+					Expect(err).To(BeNil())
+					var existingDocs []interface{}
+					Expect(json.Unmarshal(content, &existingDocs)).To(Succeed())
+					documents = len(existingDocs)
+				}
+				Expect(documents).To(Equal(16 * 25 * 2))
+			}
+			// Lock files are kept out of the metrics directory and the mutexes of the metric files are released
+			entries, err := os.ReadDir(indexer.metricsDirectory)
+			Expect(err).To(BeNil())
+			for _, entry := range entries {
+				Expect(entry.Name()).NotTo(HaveSuffix(lockSuffix))
+			}
+			fileLocksLock.Lock()
+			defer fileLocksLock.Unlock()
+			Expect(fileLocks).To(BeEmpty())
+		})
+
 		It("returns err when existing metric file has invalid JSON", func() {
 			filename := path.Join(indexer.metricsDirectory, testcase.opts.MetricName+".json")
 			err := os.WriteFile(filename, []byte("not-json"), 0644)
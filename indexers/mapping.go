@@ -0,0 +1,159 @@
+// Copyright 2024 The go-commons Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexers
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Mapping of the metric documents generated by kube-burner, used when MappingConfig.File is not set
+//
+//go:embed mappings/metrics.json
+var defaultMapping []byte
+
+// MappingMode how the mapping of the ElasticSearch and OpenSearch indexes is installed
+type MappingMode string
+
+// Mapping modes
+const (
+	// MappingTemplate installs a composable index template, named after the index, matching the index
+	MappingTemplate MappingMode = "template"
+	// MappingIndex sets the mapping when the indexer creates the index
+	MappingIndex MappingMode = "index"
+)
+
+// MappingConfig holds the mapping settings of the ElasticSearch and OpenSearch indexers.
+// The mapping of an already existing index is checked to be compatible with the configured one
+type MappingConfig struct {
+	// Mode how the mapping is installed, dynamic mapping is used when not set
+	Mode MappingMode `yaml:"mode"`
+	// File path of a JSON file holding the mapping, the embedded mapping of kube-burner metric documents is used when not set
+	File string `yaml:"file"`
+}
+
+// load returns the configured mapping, or nil when dynamic mapping is used
+func (m MappingConfig) load() (map[string]interface{}, error) {
+	switch m.Mode {
+	case "":
+		return nil, nil
+	case MappingTemplate, MappingIndex:
+	default:
+		return nil, fmt.Errorf("unsupported mapping mode %s", m.Mode)
+	}
+	content := defaultMapping
+	if m.File != "" {
+		var err error
+		if content, err = os.ReadFile(m.File); err != nil {
+			return nil, fmt.Errorf("error reading mapping file: %s", err)
+		}
+	}
+	var mapping map[string]interface{}
+	if err := json.Unmarshal(content, &mapping); err != nil {
+		return nil, fmt.Errorf("error decoding mapping %s: %s", m.File, err)
+	}
+	return mapping, nil
+}
+
+// indexTemplateBody returns the body of a composable index template applying the mapping and index settings to the
+// given index patterns, which are data streams when dataStream is true
+func indexTemplateBody(indexPatterns []string, mapping, settings map[string]interface{}, dataStream bool) ([]byte, error) {
+	template := map[string]interface{}{}
+	if mapping != nil {
+		template["mappings"] = mapping
+	}
+	if settings != nil {
+		template["settings"] = settings
+	}
+	body := map[string]interface{}{
+		"index_patterns": indexPatterns,
+		"template":       template,
+	}
+	if dataStream {
+		body["data_stream"] = map[string]interface{}{}
+	}
+	return json.Marshal(body)
+}
+
+// createIndexBody returns the body of an index creation request with the given mapping and index settings,
+// or nil when both are empty
+func createIndexBody(mapping, settings map[string]interface{}) ([]byte, error) {
+	if mapping == nil && settings == nil {
+		return nil, nil
+	}
+	body := map[string]interface{}{}
+	if mapping != nil {
+		body["mappings"] = mapping
+	}
+	if settings != nil {
+		body["settings"] = settings
+	}
+	return json.Marshal(body)
+}
+
+// checkMappingCompatibility returns an error when any of the fields of the expected mapping
+// has a different type in the get mapping response of the given index
+func checkMappingCompatibility(index string, expected map[string]interface{}, getMappingResponse io.Reader) error {
+	var response map[string]struct {
+		Mappings map[string]interface{} `json:"mappings"`
+	}
+	if err := json.NewDecoder(getMappingResponse).Decode(&response); err != nil {
+		return fmt.Errorf("error decoding mapping of index %s: %s", index, err)
+	}
+	var conflicts []string
+	for _, indexMapping := range response {
+		conflicts = append(conflicts, mappingConflicts("", expected, indexMapping.Mappings)...)
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return fmt.Errorf("mapping of index %s is not compatible: %s", index, strings.Join(conflicts, "; "))
+	}
+	return nil
+}
+
+// mappingConflicts returns the fields of the expected mapping whose type differs in the actual one.
+// Fields missing from the actual mapping aren't conflicts, they're added to the mapping when indexed
+func mappingConflicts(prefix string, expected, actual map[string]interface{}) []string {
+	var conflicts []string
+	expectedProperties, _ := expected["properties"].(map[string]interface{})
+	actualProperties, _ := actual["properties"].(map[string]interface{})
+	for field, expectedField := range expectedProperties {
+		expectedFieldMapping, _ := expectedField.(map[string]interface{})
+		actualFieldMapping, ok := actualProperties[field].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		expectedType, actualType := mappingType(expectedFieldMapping), mappingType(actualFieldMapping)
+		if expectedType != actualType {
+			conflicts = append(conflicts, fmt.Sprintf("field %s%s is %s, expected %s", prefix, field, actualType, expectedType))
+			continue
+		}
+		conflicts = append(conflicts, mappingConflicts(prefix+field+".", expectedFieldMapping, actualFieldMapping)...)
+	}
+	return conflicts
+}
+
+// mappingType returns the type of a field mapping, fields without type are objects
+func mappingType(fieldMapping map[string]interface{}) string {
+	if fieldType, ok := fieldMapping["type"].(string); ok {
+		return fieldType
+	}
+	return "object"
+}
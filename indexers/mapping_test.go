@@ -0,0 +1,225 @@
+package indexers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// mappingMockServer is a mock ElasticSearch/OpenSearch server recording the index templates, indexes, data streams and
+// lifecycle policies created, along with the number of documents sent to every index and the bulk actions used.
+// Documents sent to the default index of the bulk request are accounted to an empty index name
+type mappingMockServer struct {
+	*httptest.Server
+	lock           sync.Mutex
+	indexes        map[string]map[string]interface{}
+	templates      map[string]map[string]interface{}
+	indexedDocs    map[string]int
+	bulkActions    map[string]int
+	dataStreams    []string
+	policies       map[string]map[string]interface{}
+	policyRequests []string
+	indexPolicies  map[string]string
+}
+
+// newMappingMockServer returns a mock server where the given indexes already exist with the given mappings
+func newMappingMockServer(indexes map[string]map[string]interface{}) *mappingMockServer {
+	server := &mappingMockServer{
+		indexes:       indexes,
+		templates:     map[string]map[string]interface{}{},
+		indexedDocs:   map[string]int{},
+		bulkActions:   map[string]int{},
+		policies:      map[string]map[string]interface{}{},
+		indexPolicies: map[string]string{},
+	}
+	bulkHandler := bulkMockHandler(func(action string, meta map[string]interface{}) map[string]interface{} {
+		index, _ := meta["_index"].(string)
+		server.indexedDocs[index]++
+		server.bulkActions[action]++
+		return createdItem(action, meta)
+	})
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.lock.Lock()
+		defer server.lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/_bulk"):
+			bulkHandler(w, r)
+		case strings.HasPrefix(r.URL.Path, "/_ilm/policy/") || strings.HasPrefix(r.URL.Path, "/_plugins/_ism/policies/"):
+			name := path[len(path)-1]
+			server.policyRequests = append(server.policyRequests, r.Method+" "+name)
+			if r.Method == http.MethodPut {
+				var policy map[string]interface{}
+				_ = json.NewDecoder(r.Body).Decode(&policy)
+				server.policies[name] = policy
+				w.WriteHeader(http.StatusCreated)
+				_, _ = w.Write([]byte(`{"acknowledged":true}`))
+				return
+			}
+			if _, ok := server.policies[name]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{name: server.policies[name]})
+		case strings.HasPrefix(r.URL.Path, "/_plugins/_ism/add/"):
+			var body struct {
+				PolicyID string `json:"policy_id"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			server.indexPolicies[path[len(path)-1]] = body.PolicyID
+			_, _ = w.Write([]byte(`{"updated_indices":1,"failures":false,"failed_indices":[]}`))
+		case r.Method == http.MethodPut && len(path) == 2 && path[0] == "_data_stream":
+			server.dataStreams = append(server.dataStreams, path[1])
+			server.indexes[path[1]] = nil
+			_, _ = w.Write([]byte(`{"acknowledged":true}`))
+		case r.Method == http.MethodPut && len(path) == 2 && path[0] == "_index_template":
+			var template map[string]interface{}
+			_ = json.NewDecoder(r.Body).Decode(&template)
+			server.templates[path[1]] = template
+			_, _ = w.Write([]byte(`{"acknowledged":true}`))
+		case r.Method == http.MethodHead && len(path) == 1 && !strings.HasPrefix(path[0], "_"):
+			if _, ok := server.indexes[path[0]]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case r.Method == http.MethodPut && len(path) == 1:
+			var body struct {
+				Mappings map[string]interface{} `json:"mappings"`
+				Settings map[string]interface{} `json:"settings"`
+			}
+			content, _ := io.ReadAll(r.Body)
+			_ = json.Unmarshal(content, &body)
+			server.indexes[path[0]] = body.Mappings
+			if policy, ok := body.Settings["index.lifecycle.name"].(string); ok {
+				server.indexPolicies[path[0]] = policy
+			}
+			_, _ = w.Write([]byte(`{"acknowledged":true}`))
+		case r.Method == http.MethodGet && len(path) == 2 && path[1] == "_mapping":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{path[0]: map[string]interface{}{"mappings": server.indexes[path[0]]}})
+		default:
+			_, _ = w.Write(payload)
+		}
+	}))
+	return server
+}
+
+var _ = Describe("Tests for mapping.go", func() {
+	Context("MappingConfig", func() {
+		It("loads the embedded mapping by default", func() {
+			mapping, err := MappingConfig{Mode: MappingIndex}.load()
+			Expect(err).To(BeNil())
+			Expect(mapping).To(HaveKeyWithValue("properties", HaveKeyWithValue("timestamp", HaveKeyWithValue("type", "date"))))
+			Expect(mapping).To(HaveKeyWithValue("properties", HaveKeyWithValue("value", HaveKeyWithValue("type", "double"))))
+		})
+
+		It("uses dynamic mapping when no mode is set", func() {
+			mapping, err := MappingConfig{File: "/nonexistent/mapping.json"}.load()
+			Expect(err).To(BeNil())
+			Expect(mapping).To(BeNil())
+		})
+
+		It("returns err on unsupported modes", func() {
+			_, err := MappingConfig{Mode: "legacy"}.load()
+			Expect(err).To(MatchError("unsupported mapping mode legacy"))
+		})
+
+		It("returns err when the mapping file isn't valid JSON", func() {
+			mappingFile := filepath.Join(GinkgoT().TempDir(), "mapping.json")
+			Expect(os.WriteFile(mappingFile, []byte("properties: {}"), 0600)).To(Succeed())
+			_, err := MappingConfig{Mode: MappingIndex, File: mappingFile}.load()
+			Expect(err.Error()).To(HavePrefix("error decoding mapping " + mappingFile))
+		})
+	})
+
+	Context("checkMappingCompatibility()", func() {
+		var expected map[string]interface{}
+		BeforeEach(func() {
+			var err error
+			expected, err = MappingConfig{Mode: MappingIndex}.load()
+			Expect(err).To(BeNil())
+		})
+
+		It("accepts mappings with the same or missing fields", func() {
+			response := `{"go-commons-test":{"mappings":{"properties":{"timestamp":{"type":"date"},"labels":{"properties":{"node":{"type":"keyword"}}}}}}}`
+			Expect(checkMappingCompatibility("go-commons-test", expected, strings.NewReader(response))).To(Succeed())
+		})
+
+		It("returns err listing the fields with different types", func() {
+			response := `{"go-commons-test":{"mappings":{"properties":{"timestamp":{"type":"text"},"value":{"type":"long"},"uuid":{"type":"keyword"}}}}}`
+			err := checkMappingCompatibility("go-commons-test", expected, strings.NewReader(response))
+			Expect(err).To(MatchError("mapping of index go-commons-test is not compatible: field timestamp is text, expected date; field value is long, expected double"))
+		})
+	})
+
+	for _, indexerType := range []IndexerType{ElasticIndexer, OpenSearchIndexer} {
+		Context("Mapping management of "+string(indexerType), func() {
+			It("creates the index with the configured mapping", func() {
+				mappingFile := filepath.Join(GinkgoT().TempDir(), "mapping.json")
+				Expect(os.WriteFile(mappingFile, []byte(`{"properties":{"timestamp":{"type":"date_nanos"}}}`), 0600)).To(Succeed())
+				server := newMappingMockServer(map[string]map[string]interface{}{})
+				defer server.Close()
+				_, err := NewIndexer(IndexerConfig{
+					Type:    indexerType,
+					Servers: []string{server.URL},
+					Index:   "go-commons-test",
+					Mapping: MappingConfig{Mode: MappingIndex, File: mappingFile},
+				})
+				Expect(err).To(BeNil())
+				Expect(server.templates).To(BeEmpty())
+				Expect(server.indexes).To(HaveKeyWithValue("go-commons-test", HaveKeyWithValue("properties", HaveKeyWithValue("timestamp", HaveKeyWithValue("type", "date_nanos")))))
+			})
+
+			It("installs a composable index template before creating the index", func() {
+				server := newMappingMockServer(map[string]map[string]interface{}{})
+				defer server.Close()
+				_, err := NewIndexer(IndexerConfig{
+					Type:    indexerType,
+					Servers: []string{server.URL},
+					Index:   "go-commons-test",
+					Mapping: MappingConfig{Mode: MappingTemplate},
+				})
+				Expect(err).To(BeNil())
+				Expect(server.templates).To(HaveKey("go-commons-test"))
+				Expect(server.templates["go-commons-test"]).To(HaveKeyWithValue("index_patterns", ConsistOf("go-commons-test")))
+				Expect(server.templates["go-commons-test"]).To(HaveKeyWithValue("template", HaveKey("mappings")))
+				Expect(server.indexes).To(HaveKeyWithValue("go-commons-test", BeNil()))
+			})
+
+			It("accepts an existing index with a compatible mapping", func() {
+				server := newMappingMockServer(map[string]map[string]interface{}{
+					"go-commons-test": {"properties": map[string]interface{}{"timestamp": map[string]interface{}{"type": "date"}}},
+				})
+				defer server.Close()
+				_, err := NewIndexer(IndexerConfig{
+					Type:    indexerType,
+					Servers: []string{server.URL},
+					Index:   "go-commons-test",
+					Mapping: MappingConfig{Mode: MappingIndex},
+				})
+				Expect(err).To(BeNil())
+			})
+
+			It("returns err when the existing index mapping isn't compatible", func() {
+				server := newMappingMockServer(map[string]map[string]interface{}{
+					"go-commons-test": {"properties": map[string]interface{}{"timestamp": map[string]interface{}{"type": "text"}}},
+				})
+				defer server.Close()
+				_, err := NewIndexer(IndexerConfig{
+					Type:    indexerType,
+					Servers: []string{server.URL},
+					Index:   "go-commons-test",
+					Mapping: MappingConfig{Mode: MappingTemplate},
+				})
+				Expect(err).To(MatchError("mapping of index go-commons-test is not compatible: field timestamp is text, expected date"))
+			})
+		})
+	}
+})
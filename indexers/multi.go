@@ -0,0 +1,149 @@
+// Copyright 2024 The go-commons Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FailurePolicy decides whether the failure of some backends fails a multi indexer call
+type FailurePolicy string
+
+// Failure policies
+const (
+	// FailOnAny fails the call when any backend fails
+	FailOnAny FailurePolicy = "any"
+	// FailOnAll fails the call only when every backend fails
+	FailOnAll FailurePolicy = "all"
+)
+
+// Multi indexer instance, it sends the documents to several indexers concurrently
+type Multi struct {
+	indexers      []Indexer
+	types         []IndexerType
+	failurePolicy FailurePolicy
+}
+
+// MultiIndexError is returned by the multi indexer when the failed backends break its failure policy
+type MultiIndexError struct {
+	// Total number of backends
+	Total int
+	// Failures result of every failed backend
+	Failures []BackendResult
+}
+
+func (e *MultiIndexError) Error() string {
+	var reasons []string
+	for _, failure := range e.Failures {
+		reasons = append(reasons, fmt.Sprintf("%s: %s", failure.Type, failure.Err))
+	}
+	return fmt.Sprintf("indexing failed on %d out of %d backends: %s", len(e.Failures), e.Total, strings.Join(reasons, "; "))
+}
+
+// Unwrap returns the errors of the failed backends
+func (e *MultiIndexError) Unwrap() []error {
+	var errs []error
+	for _, failure := range e.Failures {
+		errs = append(errs, failure.Err)
+	}
+	return errs
+}
+
+// NewMultiIndexer returns a new Multi indexer sending the documents to the indexers of IndexerConfig.Indexers.
+// When an indexer can't be created, the ones already created are closed
+func NewMultiIndexer(indexerConfig IndexerConfig) (*Multi, error) {
+	var multiIndexer Multi
+	if len(indexerConfig.Indexers) == 0 {
+		return nil, fmt.Errorf("no indexers configured")
+	}
+	switch indexerConfig.FailurePolicy {
+	case "":
+		multiIndexer.failurePolicy = FailOnAny
+	case FailOnAny, FailOnAll:
+		multiIndexer.failurePolicy = indexerConfig.FailurePolicy
+	default:
+		return nil, fmt.Errorf("unsupported failure policy %s", indexerConfig.FailurePolicy)
+	}
+	for _, backendConfig := range indexerConfig.Indexers {
+		indexer, err := NewIndexer(backendConfig)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("error creating %s indexer: %w", backendConfig.Type, err), multiIndexer.Close())
+		}
+		multiIndexer.indexers = append(multiIndexer.indexers, *indexer)
+		multiIndexer.types = append(multiIndexer.types, backendConfig.Type)
+	}
+	return &multiIndexer, nil
+}
+
+// Index sends the documents to every indexer concurrently
+func (m *Multi) Index(documents []interface{}, opts IndexingOpts) (IndexResult, error) {
+	return m.IndexWithContext(context.Background(), documents, opts)
+}
+
+// IndexWithContext sends the documents to every indexer concurrently. The result holds the result of
+// every backend, its counters are the sum of the backend ones
+func (m *Multi) IndexWithContext(ctx context.Context, documents []interface{}, opts IndexingOpts) (IndexResult, error) {
+	var wg sync.WaitGroup
+	start := time.Now().UTC()
+	backends := make([]BackendResult, len(m.indexers))
+	for i, indexer := range m.indexers {
+		wg.Add(1)
+		go func(i int, indexer Indexer) {
+			defer wg.Done()
+			result, err := indexer.IndexWithContext(ctx, documents, opts)
+			backends[i] = BackendResult{Type: m.types[i], Result: result, Err: err}
+		}(i, indexer)
+	}
+	wg.Wait()
+	result := IndexResult{Duration: time.Since(start), Backends: backends}
+	var targets []string
+	var failures []BackendResult
+	for _, backend := range backends {
+		if backend.Result.Target != "" {
+			targets = append(targets, backend.Result.Target)
+		}
+		result.add(backend.Result)
+		if backend.Err != nil {
+			log.Errorf("Indexing into %s backend failed: %s", backend.Type, backend.Err)
+			failures = append(failures, backend)
+		}
+	}
+	result.Target = strings.Join(targets, ",")
+	if len(failures) > 0 && (m.failurePolicy == FailOnAny || len(failures) == len(backends)) {
+		return result, &MultiIndexError{Total: len(backends), Failures: failures}
+	}
+	return result, nil
+}
+
+// Close closes the indexers finalizing their output, such as the Local one
+func (m *Multi) Close() error {
+	var errs []error
+	for i, indexer := range m.indexers {
+		if closer, ok := indexer.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("error closing %s indexer: %w", m.types[i], err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
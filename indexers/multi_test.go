@@ -0,0 +1,105 @@
+package indexers
+
+import (
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tests for multi.go", func() {
+	var server *httptest.Server
+	var indexerConfig IndexerConfig
+	var documents []interface{}
+	BeforeEach(func() {
+		server = newBulkMockServer(createdItem)
+		indexerConfig = IndexerConfig{
+			Type: MultiIndexer,
+			Indexers: []IndexerConfig{
+				{Type: OpenSearchIndexer, Servers: []string{server.URL}, Index: "go-commons-test"},
+				{Type: LocalIndexer, MetricsDirectory: GinkgoT().TempDir()},
+			},
+		}
+		documents = []interface{}{
+			map[string]interface{}{"metricName": "podLatency", "value": 1},
+			map[string]interface{}{"metricName": "podLatency", "value": 2},
+		}
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("indexes the documents into every backend", func() {
+		indexer, err := NewIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		result, err := (*indexer).Index(documents, IndexingOpts{MetricName: "podLatency"})
+		Expect(err).To(BeNil())
+		localFile := filepath.Join(indexerConfig.Indexers[1].MetricsDirectory, "podLatency.json")
+		Expect(result.Target).To(Equal("go-commons-test," + localFile))
+		Expect(result.Indexed).To(Equal(4))
+		Expect(result.Backends).To(HaveLen(2))
+		Expect(result.Backends[0].Type).To(Equal(OpenSearchIndexer))
+		Expect(result.Backends[0].Result.Created).To(Equal(2))
+		Expect(result.Backends[1].Type).To(Equal(LocalIndexer))
+		Expect(result.Backends[1].Result.Target).To(Equal(localFile))
+		Expect(localFile).To(BeAnExistingFile())
+	})
+
+	It("fails when any backend fails by default", func() {
+		indexer, err := NewMultiIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		result, err := indexer.Index(documents, IndexingOpts{})
+		var multiErr *MultiIndexError
+		Expect(errors.As(err, &multiErr)).To(BeTrue())
+		Expect(err).To(MatchError("indexing failed on 1 out of 2 backends: local: MetricName shouldn't be empty"))
+		Expect(multiErr.Failures).To(HaveLen(1))
+		Expect(result.Backends[0].Err).To(BeNil())
+		Expect(result.Backends[0].Result.Indexed).To(Equal(2))
+		Expect(result.Backends[1].Err).To(MatchError("MetricName shouldn't be empty"))
+	})
+
+	It("tolerates failed backends with the all failure policy", func() {
+		indexerConfig.FailurePolicy = FailOnAll
+		indexer, err := NewMultiIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		result, err := indexer.Index(documents, IndexingOpts{})
+		Expect(err).To(BeNil())
+		Expect(result.Backends[1].Err).NotTo(BeNil())
+		server.Close()
+		_, err = indexer.Index(documents, IndexingOpts{})
+		Expect(err.Error()).To(HavePrefix("indexing failed on 2 out of 2 backends"))
+	})
+
+	It("closes the backends finalizing their output", func() {
+		indexerConfig.Indexers[1].CreateTarball = true
+		indexerConfig.Indexers[1].TarballName = filepath.Join(GinkgoT().TempDir(), "metrics.tar.gz")
+		indexer, err := NewMultiIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		_, err = indexer.Index(documents, IndexingOpts{MetricName: "podLatency"})
+		Expect(err).To(BeNil())
+		Expect(indexer.Close()).To(Succeed())
+		Expect(indexerConfig.Indexers[1].TarballName).To(BeAnExistingFile())
+	})
+
+	It("returns err when a backend cannot be created, closing the created ones", func() {
+		tarballName := filepath.Join(GinkgoT().TempDir(), "metrics.tar.gz")
+		indexerConfig.Indexers = []IndexerConfig{
+			{Type: LocalIndexer, MetricsDirectory: GinkgoT().TempDir(), CreateTarball: true, TarballName: tarballName},
+			{Type: LocalIndexer},
+		}
+		indexer, err := NewMultiIndexer(indexerConfig)
+		Expect(err).To(MatchError("error creating local indexer: directory name not specified"))
+		Expect(indexer).To(BeNil())
+		Expect(tarballName).To(BeAnExistingFile())
+	})
+
+	It("returns err without backends or with an unsupported failure policy", func() {
+		_, err := NewMultiIndexer(IndexerConfig{Type: MultiIndexer})
+		Expect(err).To(MatchError("no indexers configured"))
+		indexerConfig.FailurePolicy = "some"
+		_, err = NewMultiIndexer(indexerConfig)
+		Expect(err).To(MatchError("unsupported failure policy some"))
+	})
+})
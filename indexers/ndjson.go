@@ -0,0 +1,286 @@
+// Copyright 2024 The go-commons Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Extensions of the NDJSON metric files
+const (
+	ndjsonExtension     = ".ndjson"
+	ndjsonGzipExtension = ".ndjson.gz"
+	ndjsonZstdExtension = ".ndjson.zst"
+)
+
+// extension returns the extension of the NDJSON metric files for the configured compression
+func (c LocalConfig) extension() string {
+	switch c.Compression {
+	case GzipCompression:
+		return ndjsonGzipExtension
+	case ZstdCompression:
+		return ndjsonZstdExtension
+	}
+	return ndjsonExtension
+}
+
+// appendNDJSON appends the documents to the NDJSON metric file as JSON lines, rotating it first when it's
+// above the maximum file size. Compressed files get a new gzip member or zstd frame on every call
+func (l *Local) appendNDJSON(ctx context.Context, documents []interface{}, opts IndexingOpts) (IndexResult, error) {
+	start := time.Now().UTC()
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for _, document := range documents {
+		if err := encoder.Encode(document); err != nil {
+			return IndexResult{}, fmt.Errorf("JSON encoding error: %s", err)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return IndexResult{}, fmt.Errorf("indexing interrupted: %w", err)
+	}
+	extension := l.config.extension()
+	filename := path.Join(l.metricsDirectory, opts.MetricName+extension)
+	unlock, err := lockFile(filename)
+	if err != nil {
+		return IndexResult{}, err
+	}
+	defer unlock()
+	if err := l.rotate(filename, opts.MetricName, extension); err != nil {
+		return IndexResult{}, err
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return IndexResult{}, fmt.Errorf("error writing metrics file %s: %s", filename, err)
+	}
+	writer, err := compressWriter(file, l.config.Compression)
+	if err == nil {
+		_, err = writer.Write(buffer.Bytes())
+		err = errors.Join(err, writer.Close())
+	}
+	if err = errors.Join(err, file.Close()); err != nil {
+		return IndexResult{}, fmt.Errorf("error writing metrics file %s: %s", filename, err)
+	}
+	return IndexResult{Target: filename, Indexed: len(documents), Duration: time.Since(start)}, nil
+}
+
+// rotate renames the metric file once it reaches the maximum file size, rotated files are
+// numbered in rotation order as <metric>.<n>.ndjson so they can be read back in order
+func (l *Local) rotate(filename, metricName, extension string) error {
+	if l.config.MaxFileSize <= 0 {
+		return nil
+	}
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error rotating metrics file %s: %s", filename, err)
+	}
+	if info.Size() < l.config.MaxFileSize {
+		return nil
+	}
+	entries, err := os.ReadDir(l.metricsDirectory)
+	if err != nil {
+		return fmt.Errorf("error rotating metrics file %s: %s", filename, err)
+	}
+	var sequence int
+	for _, entry := range entries {
+		if n, ok := rotatedSequence(entry.Name(), metricName, extension); ok && n > sequence {
+			sequence = n
+		}
+	}
+	rotatedName := path.Join(l.metricsDirectory, fmt.Sprintf("%s.%d%s", metricName, sequence+1, extension))
+	if err := os.Rename(filename, rotatedName); err != nil {
+		return fmt.Errorf("error rotating metrics file %s: %s", filename, err)
+	}
+	return nil
+}
+
+// rotatedSequence returns the sequence number of a rotated metric file
+func rotatedSequence(name, metricName, extension string) (int, bool) {
+	sequence, found := strings.CutPrefix(name, metricName+".")
+	if !found {
+		return 0, false
+	}
+	if sequence, found = strings.CutSuffix(sequence, extension); !found {
+		return 0, false
+	}
+	n, err := strconv.Atoi(sequence)
+	return n, err == nil && n > 0
+}
+
+// compressWriter wraps the file with the writer of the given compression
+func compressWriter(file io.Writer, compression Compression) (io.WriteCloser, error) {
+	switch compression {
+	case GzipCompression:
+		return gzip.NewWriter(file), nil
+	case ZstdCompression:
+		return zstd.NewWriter(file)
+	}
+	return nopWriteCloser{file}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// NDJSONFiles returns the NDJSON metric files of the given metric in the order they were written:
+// the rotated files first, then the current one
+func NDJSONFiles(directory, metricName string) ([]string, error) {
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	type metricFile struct {
+		name     string
+		sequence int
+	}
+	var metricFiles []metricFile
+	for _, entry := range entries {
+		for _, extension := range []string{ndjsonExtension, ndjsonGzipExtension, ndjsonZstdExtension} {
+			if entry.Name() == metricName+extension {
+				// The current file is always the last one
+				metricFiles = append(metricFiles, metricFile{name: entry.Name(), sequence: int(^uint(0) >> 1)})
+			} else if n, ok := rotatedSequence(entry.Name(), metricName, extension); ok {
+				metricFiles = append(metricFiles, metricFile{name: entry.Name(), sequence: n})
+			}
+		}
+	}
+	sort.SliceStable(metricFiles, func(i, j int) bool {
+		return metricFiles[i].sequence < metricFiles[j].sequence
+	})
+	var filenames []string
+	for _, metricFile := range metricFiles {
+		filenames = append(filenames, path.Join(directory, metricFile.name))
+	}
+	return filenames, nil
+}
+
+// NDJSONReader streams back the documents of NDJSON metric files one at a time,
+// files with the .gz and .zst extensions are decompressed
+type NDJSONReader struct {
+	filenames []string
+	filename  string
+	file      *os.File
+	// reader decompresses the file, nil when it isn't compressed
+	reader  io.ReadCloser
+	decoder *json.Decoder
+}
+
+// NewNDJSONReader returns a NDJSONReader reading the given files in order
+func NewNDJSONReader(filenames ...string) *NDJSONReader {
+	return &NDJSONReader{filenames: filenames}
+}
+
+// OpenNDJSON returns a NDJSONReader reading every NDJSON metric file of the given metric in the order they were written
+func OpenNDJSON(directory, metricName string) (*NDJSONReader, error) {
+	filenames, err := NDJSONFiles(directory, metricName)
+	if err != nil {
+		return nil, err
+	}
+	return NewNDJSONReader(filenames...), nil
+}
+
+// Next decodes the next document into document, it returns io.EOF once every file has been read
+func (r *NDJSONReader) Next(document interface{}) error {
+	for {
+		if r.decoder == nil {
+			if len(r.filenames) == 0 {
+				return io.EOF
+			}
+			if err := r.open(r.filenames[0]); err != nil {
+				return err
+			}
+			r.filenames = r.filenames[1:]
+		}
+		err := r.decoder.Decode(document)
+		if err == io.EOF {
+			if err := r.closeFile(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("JSON decoding error in %s: %s", r.filename, err)
+		}
+		return nil
+	}
+}
+
+// open opens the given file, decompressing it according to its extension
+func (r *NDJSONReader) open(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	var reader io.ReadCloser
+	switch {
+	case strings.HasSuffix(filename, ".gz"):
+		reader, err = gzip.NewReader(file)
+	case strings.HasSuffix(filename, ".zst"):
+		var decoder *zstd.Decoder
+		if decoder, err = zstd.NewReader(file); err == nil {
+			reader = decoder.IOReadCloser()
+		}
+	}
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("error decompressing %s: %s", filename, err)
+	}
+	r.filename, r.file, r.reader = filename, file, reader
+	if reader != nil {
+		r.decoder = json.NewDecoder(reader)
+	} else {
+		r.decoder = json.NewDecoder(file)
+	}
+	return nil
+}
+
+// Close closes the reader, the remaining files aren't read
+func (r *NDJSONReader) Close() error {
+	r.filenames = nil
+	return r.closeFile()
+}
+
+// closeFile closes the file being read
+func (r *NDJSONReader) closeFile() error {
+	if r.file == nil {
+		return nil
+	}
+	var err error
+	if r.reader != nil {
+		err = r.reader.Close()
+	}
+	err = errors.Join(err, r.file.Close())
+	r.file, r.reader, r.decoder = nil, nil, nil
+	return err
+}
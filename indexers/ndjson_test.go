@@ -0,0 +1,114 @@
+package indexers
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tests for ndjson.go", func() {
+	var indexerConfig IndexerConfig
+	var documents []interface{}
+	BeforeEach(func() {
+		indexerConfig = IndexerConfig{
+			Type:             LocalIndexer,
+			MetricsDirectory: GinkgoT().TempDir(),
+			Local:            LocalConfig{Format: NDJSONFormat},
+		}
+		documents = []interface{}{
+			map[string]interface{}{"metricName": "podLatency", "value": 1},
+			map[string]interface{}{"metricName": "podLatency", "value": 2},
+		}
+	})
+
+	readDocuments := func(reader *NDJSONReader) []interface{} {
+		defer reader.Close()
+		var read []interface{}
+		for {
+			var document map[string]interface{}
+			err := reader.Next(&document)
+			if errors.Is(err, io.EOF) {
+				return read
+			}
+			Expect(err).To(BeNil())
+			read = append(read, document["value"])
+		}
+	}
+
+	for _, compression := range []Compression{"", GzipCompression, ZstdCompression} {
+		It("appends the documents as JSON lines and streams them back with compression "+string(compression), func() {
+			indexerConfig.Local.Compression = compression
+			indexer, err := NewLocalIndexer(indexerConfig)
+			Expect(err).To(BeNil())
+			result, err := indexer.Index(documents, IndexingOpts{MetricName: "podLatency"})
+			Expect(err).To(BeNil())
+			Expect(result.Target).To(Equal(filepath.Join(indexerConfig.MetricsDirectory, "podLatency"+indexerConfig.Local.extension())))
+			Expect(result.Indexed).To(Equal(2))
+			_, err = indexer.Index(documents[:1], IndexingOpts{MetricName: "podLatency"})
+			Expect(err).To(BeNil())
+			reader, err := OpenNDJSON(indexerConfig.MetricsDirectory, "podLatency")
+			Expect(err).To(BeNil())
+			Expect(readDocuments(reader)).To(Equal([]interface{}{1.0, 2.0, 1.0}))
+		})
+	}
+
+	It("writes one document per line", func() {
+		indexer, err := NewLocalIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		result, err := indexer.Index(documents, IndexingOpts{MetricName: "podLatency"})
+		Expect(err).To(BeNil())
+		Expect(os.ReadFile(result.Target)).To(Equal([]byte("{\"metricName\":\"podLatency\",\"value\":1}\n{\"metricName\":\"podLatency\",\"value\":2}\n")))
+	})
+
+	It("rotates the metric files above the maximum file size", func() {
+		indexerConfig.Local = LocalConfig{Format: NDJSONFormat, Compression: GzipCompression, MaxFileSize: 1}
+		indexer, err := NewLocalIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		for _, document := range documents {
+			_, err = indexer.Index([]interface{}{document}, IndexingOpts{MetricName: "podLatency"})
+			Expect(err).To(BeNil())
+		}
+		_, err = indexer.Index(documents[:1], IndexingOpts{MetricName: "podLatency"})
+		Expect(err).To(BeNil())
+		files, err := NDJSONFiles(indexerConfig.MetricsDirectory, "podLatency")
+		Expect(err).To(BeNil())
+		Expect(files).To(Equal([]string{
+			filepath.Join(indexerConfig.MetricsDirectory, "podLatency.1.ndjson.gz"),
+			filepath.Join(indexerConfig.MetricsDirectory, "podLatency.2.ndjson.gz"),
+			filepath.Join(indexerConfig.MetricsDirectory, "podLatency.ndjson.gz"),
+		}))
+		file, err := os.Open(files[0])
+		Expect(err).To(BeNil())
+		defer file.Close()
+		_, err = gzip.NewReader(file)
+		Expect(err).To(BeNil())
+		Expect(readDocuments(NewNDJSONReader(files...))).To(Equal([]interface{}{1.0, 2.0, 1.0}))
+	})
+
+	It("returns err when a metric file isn't valid NDJSON", func() {
+		filename := filepath.Join(indexerConfig.MetricsDirectory, "podLatency.ndjson")
+		Expect(os.WriteFile(filename, []byte("{}\nnot-json\n"), 0644)).To(Succeed())
+		reader := NewNDJSONReader(filename)
+		defer reader.Close()
+		var document interface{}
+		Expect(reader.Next(&document)).To(Succeed())
+		Expect(reader.Next(&document)).To(MatchError("JSON decoding error in " + filename + ": invalid character 'o' in literal null (expecting 'u')"))
+	})
+
+	It("returns err with unsupported formats or compressions", func() {
+		indexerConfig.Local = LocalConfig{Format: "xml"}
+		_, err := NewLocalIndexer(indexerConfig)
+		Expect(err).To(MatchError("unsupported local format xml"))
+		indexerConfig.Local = LocalConfig{Format: NDJSONFormat, Compression: "lz4"}
+		_, err = NewLocalIndexer(indexerConfig)
+		Expect(err).To(MatchError("unsupported compression lz4"))
+		indexerConfig.Local = LocalConfig{Compression: GzipCompression}
+		_, err = NewLocalIndexer(indexerConfig)
+		Expect(err).To(MatchError("compression is only supported by the ndjson and parquet formats"))
+	})
+})
@@ -17,13 +17,10 @@ package indexers
 import (
 	"bytes"
 	"context"
-	"crypto/sha256"
-	"crypto/tls"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
-	"runtime"
 	"strings"
 	"sync"
 	"time"
@@ -33,31 +30,80 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-// OSClient OpenSearch client instance
-var OSClient *opensearch.Client
-
 // OpenSearch OpenSearch instance
 type OpenSearch struct {
-	index string
+	client           *opensearch.Client
+	index            string
+	failureThreshold float64
+	retry            RetryConfig
+	bulkConfig       BulkConfig
+	mappingMode      MappingMode
+	mapping          map[string]interface{}
+	router           *indexRouter
+	lifecycle        LifecycleConfig
 }
 
 // Returns new indexer for OpenSearch
 func NewOpenSearchIndexer(indexerConfig IndexerConfig) (*OpenSearch, error) {
-	var err error
 	var osIndexer OpenSearch
 	if indexerConfig.Index == "" {
 		return &osIndexer, fmt.Errorf("index name not specified")
 	}
+	if indexerConfig.FailureThreshold < 0 || indexerConfig.FailureThreshold > 1 {
+		return &osIndexer, fmt.Errorf("failure threshold must be between 0 and 1")
+	}
+	if indexerConfig.Lifecycle.DataStream {
+		return &osIndexer, fmt.Errorf("data streams are only supported by the ElasticSearch indexer")
+	}
 	OpenSearchIndex := strings.ToLower(indexerConfig.Index)
+	router, err := newIndexRouter(indexerConfig.Index)
+	if err != nil {
+		return &osIndexer, err
+	}
+	tlsConfig, err := indexerConfig.Auth.tlsConfig(indexerConfig.InsecureSkipVerify)
+	if err != nil {
+		return &osIndexer, err
+	}
+	creds, err := indexerConfig.Auth.credentials()
+	if err != nil {
+		return &osIndexer, err
+	}
 	cfg := opensearch.Config{
 		Addresses: indexerConfig.Servers,
-		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: indexerConfig.InsecureSkipVerify}},
+		Username:  creds.username,
+		Password:  creds.password,
+		Header:    http.Header{},
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+
+		CompressRequestBody: indexerConfig.Bulk.Compress,
+	}
+	// The OpenSearch client has no built-in support for API keys and bearer tokens
+	if creds.apiKey != "" {
+		cfg.Header.Set("Authorization", "APIKey "+creds.apiKey)
 	}
-	OSClient, err = opensearch.NewClient(cfg)
+	if creds.bearerToken != "" {
+		cfg.Header.Set("Authorization", "Bearer "+creds.bearerToken)
+	}
+	if indexerConfig.SigV4.Region != "" {
+		// The signature replaces the Authorization header of the other authentication methods
+		if creds != (credentials{}) {
+			return &osIndexer, fmt.Errorf("SigV4 signing can't be combined with basic auth, API key or bearer token")
+		}
+		if cfg.Signer, err = newSigV4Signer(indexerConfig.SigV4); err != nil {
+			return &osIndexer, err
+		}
+	}
+	if indexerConfig.Retry.MaxAttempts > 0 {
+		cfg.MaxRetries = indexerConfig.Retry.MaxAttempts - 1
+		cfg.DisableRetry = indexerConfig.Retry.MaxAttempts == 1
+		cfg.RetryOnStatus = indexerConfig.Retry.retryableStatusCodes()
+		cfg.RetryBackoff = indexerConfig.Retry.backoff
+	}
+	osIndexer.client, err = opensearch.NewClient(cfg)
 	if err != nil {
 		return &osIndexer, fmt.Errorf("error creating the OpenSearch client: %s", err)
 	}
-	r, err := OSClient.Cluster.Health()
+	r, err := osIndexer.client.Cluster.Health()
 	if err != nil {
 		return &osIndexer, fmt.Errorf("OpenSearch health check failed: %s", err)
 	}
@@ -65,85 +111,303 @@ func NewOpenSearchIndexer(indexerConfig IndexerConfig) (*OpenSearch, error) {
 		return &osIndexer, fmt.Errorf("unexpected OpenSearch status code: %d", r.StatusCode)
 	}
 	osIndexer.index = OpenSearchIndex
-	r, _ = OSClient.Indices.Exists([]string{OpenSearchIndex})
+	osIndexer.failureThreshold = indexerConfig.FailureThreshold
+	osIndexer.retry = indexerConfig.Retry
+	osIndexer.bulkConfig = indexerConfig.Bulk
+	osIndexer.mappingMode = indexerConfig.Mapping.Mode
+	if osIndexer.mapping, err = indexerConfig.Mapping.load(); err != nil {
+		return &osIndexer, err
+	}
+	osIndexer.lifecycle = indexerConfig.Lifecycle
+	if osIndexer.lifecycle.Policy != "" {
+		if err := osIndexer.ensurePolicy(); err != nil {
+			return &osIndexer, err
+		}
+	}
+	// Templated indexes are created on demand, when documents are routed to them
+	if router != nil {
+		osIndexer.index = indexerConfig.Index
+		osIndexer.router = router
+		if osIndexer.mappingMode == MappingTemplate {
+			if err := osIndexer.putIndexTemplate(router.templateName(), router.indexPatterns()); err != nil {
+				return &osIndexer, err
+			}
+		}
+		return &osIndexer, nil
+	}
+	if osIndexer.mappingMode == MappingTemplate {
+		if err := osIndexer.putIndexTemplate(OpenSearchIndex, []string{OpenSearchIndex}); err != nil {
+			return &osIndexer, err
+		}
+	}
+	if err := osIndexer.ensureIndex(OpenSearchIndex); err != nil {
+		return &osIndexer, err
+	}
+	return &osIndexer, nil
+}
+
+// putIndexTemplate installs a composable index template applying the configured mapping to the given index patterns
+func (OpenSearchIndexer *OpenSearch) putIndexTemplate(name string, indexPatterns []string) error {
+	body, err := indexTemplateBody(indexPatterns, OpenSearchIndexer.mapping, nil, false)
+	if err != nil {
+		return err
+	}
+	r, err := OpenSearchIndexer.client.Indices.PutIndexTemplate(name, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error installing index template %s on OpenSearch: %s", name, err)
+	}
+	defer r.Body.Close()
+	if r.IsError() {
+		return fmt.Errorf("error installing index template %s on OpenSearch: %s", name, r.String())
+	}
+	return nil
+}
+
+// ensureIndex creates the given index when it doesn't exist, otherwise it checks its mapping is compatible with the configured one
+func (OpenSearchIndexer *OpenSearch) ensureIndex(index string) error {
+	r, err := OpenSearchIndexer.client.Indices.Exists([]string{index})
+	if err != nil {
+		return fmt.Errorf("error checking index %s on OpenSearch: %w", index, err)
+	}
 	if r.IsError() {
-		r, _ = OSClient.Indices.Create(OpenSearchIndex)
+		var body io.Reader
+		if OpenSearchIndexer.mappingMode == MappingIndex {
+			createBody, err := createIndexBody(OpenSearchIndexer.mapping, nil)
+			if err != nil {
+				return err
+			}
+			body = bytes.NewReader(createBody)
+		}
+		r, err = OpenSearchIndexer.client.Indices.Create(index, OpenSearchIndexer.client.Indices.Create.WithBody(body))
+		if err != nil {
+			return fmt.Errorf("error creating index %s on OpenSearch: %w", index, err)
+		}
 		if r.IsError() {
-			return &osIndexer, fmt.Errorf("error creating index %s on OpenSearch: %s", OpenSearchIndex, r.String())
+			return fmt.Errorf("error creating index %s on OpenSearch: %w", index, &statusError{status: r.StatusCode, message: r.String()})
+		}
+		if OpenSearchIndexer.lifecycle.Policy != "" {
+			return OpenSearchIndexer.addPolicy(index)
 		}
+		return nil
 	}
-	return &osIndexer, nil
+	if OpenSearchIndexer.mapping == nil {
+		return nil
+	}
+	r, err = OpenSearchIndexer.client.Indices.GetMapping(OpenSearchIndexer.client.Indices.GetMapping.WithIndex(index))
+	if err != nil {
+		return fmt.Errorf("error getting mapping of index %s on OpenSearch: %w", index, err)
+	}
+	defer r.Body.Close()
+	if r.IsError() {
+		return fmt.Errorf("error getting mapping of index %s on OpenSearch: %w", index, &statusError{status: r.StatusCode, message: r.String()})
+	}
+	return checkMappingCompatibility(index, OpenSearchIndexer.mapping, r.Body)
+}
+
+// ensurePolicy creates the configured ISM policy from the policy file when it doesn't exist
+func (OpenSearchIndexer *OpenSearch) ensurePolicy() error {
+	policyName := OpenSearchIndexer.lifecycle.Policy
+	// This version of the OpenSearch client has no ISM API
+	res, err := OpenSearchIndexer.perform(http.MethodGet, "/_plugins/_ism/policies/"+policyName, nil)
+	if err != nil {
+		return fmt.Errorf("error getting ISM policy %s on OpenSearch: %s", policyName, err)
+	}
+	if res.StatusCode == http.StatusOK {
+		log.Debugf("ISM policy %s found", policyName)
+		return OpenSearchIndexer.lifecycle.checkRollover(res.body)
+	}
+	if res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("error getting ISM policy %s on OpenSearch: %s", policyName, res.String())
+	}
+	policy, err := OpenSearchIndexer.lifecycle.policy()
+	if err != nil {
+		return err
+	}
+	if policy == nil {
+		return fmt.Errorf("ISM policy %s not found on OpenSearch and no policy file configured", policyName)
+	}
+	if err := OpenSearchIndexer.lifecycle.checkRollover(policy); err != nil {
+		return err
+	}
+	res, err = OpenSearchIndexer.perform(http.MethodPut, "/_plugins/_ism/policies/"+policyName, policy)
+	if err != nil {
+		return fmt.Errorf("error creating ISM policy %s on OpenSearch: %s", policyName, err)
+	}
+	if res.IsError() {
+		return fmt.Errorf("error creating ISM policy %s on OpenSearch: %s", policyName, res.String())
+	}
+	log.Infof("ISM policy %s created", policyName)
+	return nil
+}
+
+// addPolicy attaches the configured ISM policy to the given index
+func (OpenSearchIndexer *OpenSearch) addPolicy(index string) error {
+	body, err := json.Marshal(map[string]string{"policy_id": OpenSearchIndexer.lifecycle.Policy})
+	if err != nil {
+		return err
+	}
+	res, err := OpenSearchIndexer.perform(http.MethodPost, "/_plugins/_ism/add/"+index, body)
+	if err != nil {
+		return fmt.Errorf("error adding ISM policy to index %s on OpenSearch: %s", index, err)
+	}
+	var addResponse struct {
+		Failures bool `json:"failures"`
+	}
+	if res.IsError() || json.Unmarshal(res.body, &addResponse) != nil || addResponse.Failures {
+		return fmt.Errorf("error adding ISM policy to index %s on OpenSearch: %s", index, res.String())
+	}
+	return nil
+}
+
+// rawResponse holds the response of a request sent with perform
+type rawResponse struct {
+	StatusCode int
+	body       []byte
+}
+
+// IsError returns true when the response status code isn't 2xx
+func (r rawResponse) IsError() bool {
+	return r.StatusCode > 299
+}
+
+// String returns the status code and body of the response
+func (r rawResponse) String() string {
+	return fmt.Sprintf("[%d] %s", r.StatusCode, r.body)
+}
+
+// perform sends a request with an optional JSON body to the APIs not covered by the OpenSearch client
+func (OpenSearchIndexer *OpenSearch) perform(method, path string, body []byte) (rawResponse, error) {
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, path, reqBody)
+	if err != nil {
+		return rawResponse{}, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := OpenSearchIndexer.client.Perform(req)
+	if err != nil {
+		return rawResponse{}, err
+	}
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return rawResponse{}, err
+	}
+	return rawResponse{StatusCode: res.StatusCode, body: resBody}, nil
+}
+
+// Client returns the OpenSearch client used by the indexer
+func (OpenSearchIndexer *OpenSearch) Client() *opensearch.Client {
+	return OpenSearchIndexer.client
 }
 
 // Index uses bulkIndexer to index the documents in the given index
-func (OpenSearchIndexer *OpenSearch) Index(documents []interface{}, opts IndexingOpts) (string, error) {
-	var statString string
-	var indexerStatsLock sync.Mutex
-	indexerStats := make(map[string]int)
+func (OpenSearchIndexer *OpenSearch) Index(documents []interface{}, opts IndexingOpts) (IndexResult, error) {
+	return OpenSearchIndexer.IndexWithContext(context.Background(), documents, opts)
+}
 
+// IndexWithContext uses bulkIndexer to index the documents in the given index.
+// The context is propagated to every bulk request, so cancelling it aborts the in-flight requests
+func (OpenSearchIndexer *OpenSearch) IndexWithContext(ctx context.Context, documents []interface{}, opts IndexingOpts) (IndexResult, error) {
+	result := IndexResult{Target: OpenSearchIndexer.index}
 	if len(documents) <= 0 {
-		return fmt.Sprintf("Indexing skipped due to %v docs", len(documents)), nil
+		return result, nil
 	}
-	hasher := sha256.New()
-	bi, err := opensearchutil.NewBulkIndexer(opensearchutil.BulkIndexerConfig{
-		Client:     OSClient,
-		Index:      OpenSearchIndexer.index,
-		FlushBytes: 5e+6,
-		NumWorkers: runtime.NumCPU(),
-		Timeout:    10 * time.Minute, // TODO: hardcoded
-	})
+	start := time.Now().UTC()
+	docs, redundantSkipped, err := encodeBulkDocuments(documents, opts, OpenSearchIndexer.router)
 	if err != nil {
-		return "", fmt.Errorf("error creating the indexer: %s", err)
+		return result, err
 	}
-	start := time.Now().UTC()
-	docHash := make(map[string]bool)
-	redundantSkipped := 0
-	for _, document := range documents {
-		j, err := json.Marshal(document)
-		if err != nil {
-			return "", fmt.Errorf("cannot encode document %v: %s", document, err)
-		}
-
-		hasher.Write(j)
-		docId := hex.EncodeToString(hasher.Sum(nil))
-		if _, exists := docHash[docId]; exists {
-			log.Debugf("Skipping redundant document: %s", docId)
-			redundantSkipped++
-			continue
+	result.SkippedDuplicates = redundantSkipped
+	if OpenSearchIndexer.router != nil {
+		result.Target = routedIndexes(docs)
+		if err := OpenSearchIndexer.router.ensureIndexes(docs, OpenSearchIndexer.ensureIndex); err != nil {
+			return result, err
 		}
+	}
+	if err := bulkWithRetries(ctx, docs, &result, OpenSearchIndexer.retry, OpenSearchIndexer.bulk); err != nil {
+		result.Duration = time.Since(start)
+		return result, err
+	}
+	result.Duration = time.Since(start)
+	if err := ctx.Err(); err != nil {
+		return result, fmt.Errorf("OpenSearch indexing interrupted: %w", err)
+	}
+	return result, checkFailureThreshold(result, len(docs), OpenSearchIndexer.failureThreshold)
+}
 
+// bulk sends the documents through a bulk indexer and returns the rejected ones
+func (OpenSearchIndexer *OpenSearch) bulk(ctx context.Context, docs []bulkDocument, result *IndexResult) ([]bulkFailure, error) {
+	var indexerStatsLock sync.Mutex
+	var flushErr error
+	var failures []bulkFailure
+	acknowledged := make(map[string]bool)
+	bi, err := opensearchutil.NewBulkIndexer(opensearchutil.BulkIndexerConfig{
+		Client:        OpenSearchIndexer.client,
+		Index:         OpenSearchIndexer.index,
+		FlushBytes:    OpenSearchIndexer.bulkConfig.flushBytes(),
+		FlushInterval: OpenSearchIndexer.bulkConfig.FlushInterval,
+		NumWorkers:    OpenSearchIndexer.bulkConfig.workers(),
+		Timeout:       OpenSearchIndexer.bulkConfig.timeout(),
+		// Bulk workers flush using context.Background() by default, hand them the caller's context instead
+		OnFlushStart: func(context.Context) context.Context {
+			return ctx
+		},
+		// Documents of a failed bulk request don't trigger OnFailure, keep the error to report them later
+		OnError: func(c context.Context, err error) {
+			indexerStatsLock.Lock()
+			defer indexerStatsLock.Unlock()
+			flushErr = err
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating the indexer: %s", err)
+	}
+	for _, doc := range docs {
 		err = bi.Add(
-			context.Background(),
+			ctx,
 			opensearchutil.BulkIndexerItem{
-				Action:     "index",
-				Body:       bytes.NewReader(j),
-				DocumentID: docId,
+				Index:      doc.index,
+				Action:     doc.action,
+				Body:       bytes.NewReader(doc.body),
+				DocumentID: doc.id,
 				OnSuccess: func(c context.Context, bii opensearchutil.BulkIndexerItem, biri opensearchutil.BulkIndexerResponseItem) {
 					indexerStatsLock.Lock()
 					defer indexerStatsLock.Unlock()
-					indexerStats[biri.Result]++
+					acknowledged[bii.DocumentID] = true
+					result.Indexed++
+					switch biri.Result {
+					case "created":
+						result.Created++
+					case "updated":
+						result.Updated++
+					}
 				},
 				OnFailure: func(c context.Context, bii opensearchutil.BulkIndexerItem, beri opensearchutil.BulkIndexerResponseItem, err error) {
 					log.Infof("Failed to index document %s: %s, error: %v", bii.DocumentID, beri.Error.Reason, err)
+					reason := fmt.Sprintf("%s: %s", beri.Error.Type, beri.Error.Reason)
+					if err != nil {
+						reason = err.Error()
+					}
+					indexerStatsLock.Lock()
+					defer indexerStatsLock.Unlock()
+					acknowledged[bii.DocumentID] = true
+					failures = append(failures, bulkFailure{document: doc, status: beri.Status, reason: reason})
 				},
 			},
 		)
 		if err != nil {
-			log.Infof("Error adding document with ID %s: %s", docId, err)
-			return "", fmt.Errorf("unexpected OpenSearch indexing error: %s", err)
+			log.Infof("Error adding document with ID %s: %s", doc.id, err)
+			_ = bi.Close(ctx)
+			return unacknowledged(failures, docs, acknowledged, err), fmt.Errorf("unexpected OpenSearch indexing error: %w", err)
 		}
-		docHash[docId] = true
-		hasher.Reset()
-	}
-	if err := bi.Close(context.Background()); err != nil {
-		return "", fmt.Errorf("unexpected OpenSearch error: %s", err)
-	}
-	dur := time.Since(start)
-	for stat, val := range indexerStats {
-		statString += fmt.Sprintf(" %s=%d", stat, val)
 	}
-	if redundantSkipped > 0 {
-		statString += fmt.Sprintf(" redundantskipped=%d", redundantSkipped)
+	if err := bi.Close(ctx); err != nil {
+		return unacknowledged(failures, docs, acknowledged, err), fmt.Errorf("unexpected OpenSearch error: %w", err)
 	}
-	return fmt.Sprintf("Indexing finished in %v:%v", dur.Truncate(time.Millisecond), statString), nil
+	return unacknowledged(failures, docs, acknowledged, flushErr), nil
 }
@@ -1,11 +1,16 @@
 package indexers
 
 import (
+	"context"
 	"errors"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -71,11 +76,60 @@ var _ = Describe("Tests for opensearch.go", func() {
 			Expect(err).To(BeEquivalentTo(errors.New("index name not specified")))
 		})
 
+		It("Retries the health check with backoff", func() {
+			var healthChecks atomic.Int32
+			testcase.mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasPrefix(r.URL.Path, "/_cluster/health") && healthChecks.Add(1) < 3 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				_, _ = w.Write(payload)
+			}))
+			defer testcase.mockServer.Close()
+			testcase.indexerConfig.Servers = []string{testcase.mockServer.URL}
+			testcase.indexerConfig.Retry = RetryConfig{MaxAttempts: 3, BackoffBase: time.Millisecond}
+			_, err := NewOpenSearchIndexer(testcase.indexerConfig)
+			Expect(err).To(BeNil())
+			Expect(healthChecks.Load()).To(BeEquivalentTo(3))
+		})
+
+		It("Returns err when the health check retries are exhausted", func() {
+			var healthChecks atomic.Int32
+			testcase.mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasPrefix(r.URL.Path, "/_cluster/health") {
+					healthChecks.Add(1)
+					w.WriteHeader(http.StatusTooManyRequests)
+					return
+				}
+				_, _ = w.Write(payload)
+			}))
+			defer testcase.mockServer.Close()
+			testcase.indexerConfig.Servers = []string{testcase.mockServer.URL}
+			testcase.indexerConfig.Retry = RetryConfig{MaxAttempts: 2, BackoffBase: time.Millisecond}
+			_, err := NewOpenSearchIndexer(testcase.indexerConfig)
+			Expect(err).To(BeEquivalentTo(errors.New("unexpected OpenSearch status code: 429")))
+			Expect(healthChecks.Load()).To(BeEquivalentTo(2))
+		})
+
+		It("Returns err invalid failure threshold", func() {
+			defer testcase.mockServer.Close()
+			testcase.indexerConfig.Servers = []string{testcase.mockServer.URL}
+			testcase.indexerConfig.FailureThreshold = 1.5
+			_, err := NewOpenSearchIndexer(testcase.indexerConfig)
+			Expect(err).To(BeEquivalentTo(errors.New("failure threshold must be between 0 and 1")))
+		})
+
 	})
 
 	Context("Tests for Index()", func() {
 		var testcase indexMethodTestcase
+		var indexer *OpenSearch
+		var server *httptest.Server
 		BeforeEach(func() {
+			var err error
+			server = newBulkMockServer(createdItem)
+			indexer, err = NewOpenSearchIndexer(IndexerConfig{Type: OpenSearchIndexer, Servers: []string{server.URL}, Index: "go-commons-test"})
+			Expect(err).To(BeNil())
 			testcase = indexMethodTestcase{
 				documents: []interface{}{
 					"example document",
@@ -99,8 +153,10 @@ var _ = Describe("Tests for opensearch.go", func() {
 				},
 			}
 		})
+		AfterEach(func() {
+			server.Close()
+		})
 
-		var indexer OpenSearch
 		It("No err returned", func() {
 			_, err := indexer.Index(testcase.documents, testcase.opts)
 			Expect(err).To(BeNil())
@@ -124,5 +180,180 @@ var _ = Describe("Tests for opensearch.go", func() {
 			Expect(err.Error()).To(ContainSubstring("cannot encode document"))
 		})
 
+		It("reports created and redundant documents", func() {
+			documents := append(testcase.documents, testcase.documents[0])
+			result, err := indexer.Index(documents, testcase.opts)
+			Expect(err).To(BeNil())
+			Expect(result.Target).To(Equal("go-commons-test"))
+			Expect(result.Indexed).To(Equal(len(testcase.documents)))
+			Expect(result.Created).To(Equal(len(testcase.documents)))
+			Expect(result.SkippedDuplicates).To(Equal(1))
+			Expect(result.String()).To(ContainSubstring("indexed=6 created=6 redundantskipped=1"))
+		})
+
+		It("returns err when documents are rejected", func() {
+			server.Close()
+			server = newBulkMockServer(func(action string, meta map[string]interface{}) map[string]interface{} {
+				return map[string]interface{}{
+					"_id":    meta["_id"],
+					"status": 400,
+					"error":  map[string]interface{}{"type": "mapper_parsing_exception", "reason": "failed to parse"},
+				}
+			})
+			bulkIndexer, err := NewOpenSearchIndexer(IndexerConfig{Type: OpenSearchIndexer, Servers: []string{server.URL}, Index: "go-commons-test"})
+			Expect(err).To(BeNil())
+			result, err := bulkIndexer.Index(testcase.documents, testcase.opts)
+			var bulkErr *BulkIndexError
+			Expect(errors.As(err, &bulkErr)).To(BeTrue())
+			Expect(bulkErr.Total).To(Equal(len(testcase.documents)))
+			Expect(bulkErr.Failures).To(HaveLen(len(testcase.documents)))
+			Expect(err.Error()).To(HavePrefix("6 out of 6 documents rejected by go-commons-test: "))
+			Expect(result.Indexed).To(BeZero())
+			Expect(result.Failed).To(Equal(len(testcase.documents)))
+			Expect(result.Failures).To(HaveLen(len(testcase.documents)))
+			Expect(result.Failures[0].DocumentID).NotTo(BeEmpty())
+			Expect(result.Failures[0].Reason).To(Equal("mapper_parsing_exception: failed to parse"))
+		})
+
+		It("tolerates rejected documents below the failure threshold", func() {
+			server.Close()
+			var rejected atomic.Int32
+			server = newBulkMockServer(func(action string, meta map[string]interface{}) map[string]interface{} {
+				if rejected.Add(1) > 3 {
+					return createdItem(action, meta)
+				}
+				return map[string]interface{}{
+					"_id":    meta["_id"],
+					"status": 400,
+					"error":  map[string]interface{}{"type": "mapper_parsing_exception", "reason": "failed to parse"},
+				}
+			})
+			bulkIndexer, err := NewOpenSearchIndexer(IndexerConfig{Type: OpenSearchIndexer, Servers: []string{server.URL}, Index: "go-commons-test", FailureThreshold: 0.5})
+			Expect(err).To(BeNil())
+			result, err := bulkIndexer.Index(testcase.documents, testcase.opts)
+			Expect(err).To(BeNil())
+			Expect(result.Failed).To(Equal(3))
+			Expect(result.Indexed).To(Equal(3))
+		})
+
+		It("retries documents rejected with a retryable status code", func() {
+			server.Close()
+			var rejected sync.Map
+			server = newBulkMockServer(func(action string, meta map[string]interface{}) map[string]interface{} {
+				if _, seen := rejected.LoadOrStore(meta["_id"], true); seen {
+					return createdItem(action, meta)
+				}
+				return map[string]interface{}{
+					"_id":    meta["_id"],
+					"status": 429,
+					"error":  map[string]interface{}{"type": "es_rejected_execution_exception", "reason": "rejected execution"},
+				}
+			})
+			bulkIndexer, err := NewOpenSearchIndexer(IndexerConfig{
+				Type:    OpenSearchIndexer,
+				Servers: []string{server.URL},
+				Index:   "go-commons-test",
+				Retry:   RetryConfig{MaxAttempts: 2, BackoffBase: time.Millisecond},
+			})
+			Expect(err).To(BeNil())
+			result, err := bulkIndexer.Index(testcase.documents, testcase.opts)
+			Expect(err).To(BeNil())
+			Expect(result.Indexed).To(Equal(len(testcase.documents)))
+			Expect(result.Failed).To(BeZero())
+		})
+
+		It("reports documents of failed bulk requests", func() {
+			server.Close()
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/_bulk") {
+					w.WriteHeader(http.StatusRequestEntityTooLarge)
+					return
+				}
+				_, _ = w.Write(payload)
+			}))
+			bulkIndexer, err := NewOpenSearchIndexer(IndexerConfig{Type: OpenSearchIndexer, Servers: []string{server.URL}, Index: "go-commons-test"})
+			Expect(err).To(BeNil())
+			result, err := bulkIndexer.Index(testcase.documents, testcase.opts)
+			Expect(err).To(BeAssignableToTypeOf(&BulkIndexError{}))
+			Expect(result.Failed).To(Equal(len(testcase.documents)))
+			Expect(result.Failures[0].Reason).To(ContainSubstring("413"))
+		})
+
+		It("indexes to the server of every indexer instance", func() {
+			var archivedDocs atomic.Int32
+			archiveServer := newBulkMockServer(func(action string, meta map[string]interface{}) map[string]interface{} {
+				archivedDocs.Add(1)
+				return createdItem(action, meta)
+			})
+			defer archiveServer.Close()
+			archiveIndexer, err := NewOpenSearchIndexer(IndexerConfig{Type: OpenSearchIndexer, Servers: []string{archiveServer.URL}, Index: "go-commons-archive"})
+			Expect(err).To(BeNil())
+			Expect(archiveIndexer.Client()).NotTo(BeIdenticalTo(indexer.Client()))
+			result, err := indexer.Index(testcase.documents, testcase.opts)
+			Expect(err).To(BeNil())
+			Expect(result.Target).To(Equal("go-commons-test"))
+			Expect(archivedDocs.Load()).To(BeZero())
+			result, err = archiveIndexer.Index(testcase.documents, testcase.opts)
+			Expect(err).To(BeNil())
+			Expect(result.Target).To(Equal("go-commons-archive"))
+			Expect(archivedDocs.Load()).To(BeEquivalentTo(len(testcase.documents)))
+		})
+
+		It("sends gzip compressed bulk requests sized by the bulk settings", func() {
+			server.Close()
+			var bulkRequests, compressedRequests atomic.Int32
+			handler := bulkMockHandler(createdItem)
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/_bulk") {
+					bulkRequests.Add(1)
+					if r.Header.Get("Content-Encoding") == "gzip" {
+						compressedRequests.Add(1)
+					}
+				}
+				handler(w, r)
+			}))
+			bulkIndexer, err := NewOpenSearchIndexer(IndexerConfig{
+				Type:    OpenSearchIndexer,
+				Servers: []string{server.URL},
+				Index:   "go-commons-test",
+				Bulk:    BulkConfig{FlushBytes: 1, Workers: 1, Timeout: time.Minute, Compress: true},
+			})
+			Expect(err).To(BeNil())
+			result, err := bulkIndexer.Index(testcase.documents, testcase.opts)
+			Expect(err).To(BeNil())
+			Expect(result.Indexed).To(Equal(len(testcase.documents)))
+			Expect(bulkRequests.Load()).To(BeEquivalentTo(len(testcase.documents)))
+			Expect(compressedRequests.Load()).To(Equal(bulkRequests.Load()))
+		})
+
+		It("upserts documents with the IDs of the document ID function", func() {
+			server.Close()
+			var actions sync.Map
+			server = newBulkMockServer(func(action string, meta map[string]interface{}) map[string]interface{} {
+				actions.Store(meta["_id"], action)
+				return map[string]interface{}{"_id": meta["_id"], "result": "updated", "status": 200}
+			})
+			bulkIndexer, err := NewOpenSearchIndexer(IndexerConfig{Type: OpenSearchIndexer, Servers: []string{server.URL}, Index: "go-commons-test"})
+			Expect(err).To(BeNil())
+			documents := []interface{}{
+				map[string]interface{}{"uuid": "abc", "metricName": "podLatency", "value": 1},
+				map[string]interface{}{"uuid": "abc", "metricName": "nodeCPU", "value": 2},
+			}
+			result, err := bulkIndexer.Index(documents, IndexingOpts{DocumentID: IDFromFields("uuid", "metricName"), Action: UpsertAction})
+			Expect(err).To(BeNil())
+			Expect(result.Updated).To(Equal(2))
+			action, _ := actions.Load("abc-podLatency")
+			Expect(action).To(Equal("update"))
+			action, _ = actions.Load("abc-nodeCPU")
+			Expect(action).To(Equal("update"))
+		})
+
+		It("returns err when the context is cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := indexer.IndexWithContext(ctx, testcase.documents, testcase.opts)
+			Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+		})
+
 	})
 })
@@ -0,0 +1,197 @@
+// Copyright 2024 The go-commons Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// parquetFile Parquet metric file being written, its schema is inferred from the first batch of documents
+type parquetFile struct {
+	file    *os.File
+	writer  *parquet.GenericWriter[any]
+	columns []column
+}
+
+// writeParquet writes the documents to the Parquet metric file, created with the schema inferred from the
+// first batch of documents. Fields missing from the schema, and values not matching the type of their column,
+// are dropped. The file is complete once the indexer is closed. Parquet metric files can't be appended to, so
+// indexing fails when the file already exists, e.g. written by another indexer or process
+func (l *Local) writeParquet(ctx context.Context, documents []interface{}, opts IndexingOpts) (IndexResult, error) {
+	start := time.Now().UTC()
+	rows, err := flattenDocuments(documents)
+	if err != nil {
+		return IndexResult{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return IndexResult{}, fmt.Errorf("indexing interrupted: %w", err)
+	}
+	filename := path.Join(l.metricsDirectory, opts.MetricName+".parquet")
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	metricFile, ok := l.parquetFiles[filename]
+	if !ok {
+		if metricFile, err = l.createParquet(filename, inferColumns(rows)); err != nil {
+			return IndexResult{}, fmt.Errorf("error writing metrics file %s: %s", filename, err)
+		}
+	}
+	parquetRows := make([]parquet.Row, 0, len(rows))
+	dropped := make(map[string]bool)
+	mismatched := make(map[string]bool)
+	for _, row := range rows {
+		parquetRows = append(parquetRows, metricFile.row(row, dropped, mismatched))
+	}
+	if len(dropped) > 0 {
+		log.Warnf("Fields %s not in the schema of %s, dropping them", strings.Join(sortedKeys(dropped), ", "), filename)
+	}
+	if len(mismatched) > 0 {
+		log.Warnf("Values of fields %s don't match the type of their column in %s, dropping them", strings.Join(sortedKeys(mismatched), ", "), filename)
+	}
+	if _, err := metricFile.writer.WriteRows(parquetRows); err != nil {
+		return IndexResult{}, fmt.Errorf("error writing metrics file %s: %s", filename, err)
+	}
+	return IndexResult{Target: filename, Indexed: len(documents), Duration: time.Since(start)}, nil
+}
+
+// createParquet creates a Parquet metric file with the given columns, all of them optional
+func (l *Local) createParquet(filename string, columns []column) (*parquetFile, error) {
+	group := parquet.Group{}
+	for _, c := range columns {
+		switch c.kind {
+		case numberColumn:
+			group[c.name] = parquet.Optional(parquet.Leaf(parquet.DoubleType))
+		case boolColumn:
+			group[c.name] = parquet.Optional(parquet.Leaf(parquet.BooleanType))
+		default:
+			group[c.name] = parquet.Optional(parquet.String())
+		}
+	}
+	options := []parquet.WriterOption{parquet.NewSchema(path.Base(filename), group)}
+	switch l.config.Compression {
+	case GzipCompression:
+		options = append(options, parquet.Compression(&parquet.Gzip))
+	case ZstdCompression:
+		options = append(options, parquet.Compression(&parquet.Zstd))
+	}
+	// The file is kept open until the indexer is closed, O_EXCL prevents overwriting the file of another writer
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if l.parquetFiles == nil {
+		l.parquetFiles = make(map[string]*parquetFile)
+	}
+	metricFile := &parquetFile{file: file, writer: parquet.NewGenericWriter[any](file, options...), columns: columns}
+	l.parquetFiles[filename] = metricFile
+	return metricFile, nil
+}
+
+// row converts a flattened document into a Parquet row, the fields that aren't columns are added to dropped.
+// Values are converted to the type of their column, the ones that can't be are set to null and added to mismatched
+func (f *parquetFile) row(fields map[string]interface{}, dropped, mismatched map[string]bool) parquet.Row {
+	row := make(parquet.Row, len(f.columns))
+	for i, c := range f.columns {
+		value, ok := columnValue(c.kind, fields[c.name])
+		if !ok {
+			mismatched[c.name] = true
+		}
+		if value.IsNull() {
+			row[i] = value.Level(0, 0, i)
+		} else {
+			row[i] = value.Level(0, 1, i)
+		}
+	}
+	for name := range fields {
+		i := sort.Search(len(f.columns), func(i int) bool { return f.columns[i].name >= name })
+		if i == len(f.columns) || f.columns[i].name != name {
+			dropped[name] = true
+		}
+	}
+	return row
+}
+
+// columnValue converts a flattened value to the type of a column, strings being parsed for number and boolean columns.
+// It returns a null value, and false when the value isn't null, when it can't be converted
+func columnValue(kind columnKind, value interface{}) (parquet.Value, bool) {
+	if value == nil {
+		return parquet.Value{}, true
+	}
+	switch kind {
+	case numberColumn:
+		var number float64
+		var err error
+		switch v := value.(type) {
+		case json.Number:
+			number, err = v.Float64()
+		case string:
+			number, err = strconv.ParseFloat(v, 64)
+		default:
+			return parquet.Value{}, false
+		}
+		if err != nil {
+			return parquet.Value{}, false
+		}
+		return parquet.ValueOf(number), true
+	case boolColumn:
+		switch v := value.(type) {
+		case bool:
+			return parquet.ValueOf(v), true
+		case string:
+			boolean, err := strconv.ParseBool(v)
+			if err != nil {
+				return parquet.Value{}, false
+			}
+			return parquet.ValueOf(boolean), true
+		}
+		return parquet.Value{}, false
+	}
+	return parquet.ValueOf(formatValue(value)), true
+}
+
+// closeParquet writes the footers of the Parquet metric files and closes them
+func (l *Local) closeParquet() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var errs []error
+	for filename, metricFile := range l.parquetFiles {
+		if err := errors.Join(metricFile.writer.Close(), metricFile.file.Close()); err != nil {
+			errs = append(errs, fmt.Errorf("error closing metrics file %s: %s", filename, err))
+		}
+	}
+	l.parquetFiles = nil
+	return errors.Join(errs...)
+}
+
+// sortedKeys returns the keys of the map in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,297 @@
+// Copyright 2024 The go-commons Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+)
+
+// Default remote write settings used when they're not specified in RemoteWriteConfig
+const (
+	defaultRemoteWriteBatchSize = 2000
+	defaultRemoteWriteTimeout   = 30 * time.Second
+	defaultRemoteWriteAttempts  = 3
+)
+
+// RemoteWriteConfig holds the settings of the Prometheus remote write indexer
+type RemoteWriteConfig struct {
+	// URL remote write endpoint, such as http://prometheus:9090/api/v1/write
+	URL string `yaml:"url"`
+	// BatchSize maximum number of samples of every remote write request. Defaults to 2000
+	BatchSize int `yaml:"batchSize"`
+	// Timeout timeout of every remote write request. Defaults to 30s
+	Timeout time.Duration `yaml:"timeout"`
+	// Headers extra HTTP headers of the remote write requests, such as the X-Scope-OrgID tenant header of Mimir
+	Headers map[string]string `yaml:"headers"`
+}
+
+// RemoteWrite indexer instance, it pushes the samples extracted from the documents, as the TSDB indexer does,
+// to a Prometheus compatible remote write endpoint. The timestamp, label fields and relabel configs of the TSDB settings apply to it as well
+type RemoteWrite struct {
+	url         string
+	client      *http.Client
+	credentials credentials
+	headers     map[string]string
+	batchSize   int
+	retry       RetryConfig
+	// failureThreshold fraction of samples of the failed requests tolerated
+	failureThreshold float64
+	// samplesConfig settings of the conversion of the documents into samples
+	samplesConfig TSDBConfig
+}
+
+// RemoteWriteError is returned when a remote write request fails
+type RemoteWriteError struct {
+	// StatusCode status code of the response, 0 when no response was received
+	StatusCode int
+	// Message error message or response body
+	Message string
+}
+
+func (e *RemoteWriteError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("remote write request failed: %s", e.Message)
+	}
+	return fmt.Sprintf("remote write request failed with status %d: %s", e.StatusCode, e.Message)
+}
+
+// NewRemoteWriteIndexer returns a new RemoteWrite indexer
+func NewRemoteWriteIndexer(indexerConfig IndexerConfig) (*RemoteWrite, error) {
+	var remoteWrite RemoteWrite
+	config := indexerConfig.RemoteWrite
+	if config.URL == "" {
+		return &remoteWrite, fmt.Errorf("remote write URL not specified")
+	}
+	creds, err := indexerConfig.Auth.credentials()
+	if err != nil {
+		return &remoteWrite, err
+	}
+	if creds.apiKey != "" {
+		return &remoteWrite, fmt.Errorf("API key authentication isn't supported by the remote write indexer")
+	}
+	if indexerConfig.FailureThreshold < 0 || indexerConfig.FailureThreshold > 1 {
+		return &remoteWrite, fmt.Errorf("failure threshold must be between 0 and 1")
+	}
+	if remoteWrite.samplesConfig, err = indexerConfig.TSDB.withRelabelDefaults("remote write"); err != nil {
+		return &remoteWrite, err
+	}
+	tlsConfig, err := indexerConfig.Auth.tlsConfig(indexerConfig.InsecureSkipVerify)
+	if err != nil {
+		return &remoteWrite, err
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultRemoteWriteTimeout
+	}
+	remoteWrite.url = config.URL
+	remoteWrite.client = &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+	}
+	remoteWrite.credentials = creds
+	remoteWrite.headers = config.Headers
+	remoteWrite.batchSize = config.BatchSize
+	if remoteWrite.batchSize <= 0 {
+		remoteWrite.batchSize = defaultRemoteWriteBatchSize
+	}
+	remoteWrite.failureThreshold = indexerConfig.FailureThreshold
+	remoteWrite.retry = indexerConfig.Retry
+	if remoteWrite.retry.MaxAttempts == 0 {
+		remoteWrite.retry.MaxAttempts = defaultRemoteWriteAttempts
+	}
+	return &remoteWrite, nil
+}
+
+// Index pushes the samples of the documents to the remote write endpoint
+func (r *RemoteWrite) Index(documents []interface{}, opts IndexingOpts) (IndexResult, error) {
+	return r.IndexWithContext(context.Background(), documents, opts)
+}
+
+// IndexWithContext pushes the samples of the documents to the remote write endpoint in batches of BatchSize samples.
+// Failed requests are retried according to the retry policy. The samples of the requests still failing are reported
+// as failures, the error of the request is returned once they exceed the failure threshold. The result holds the
+// samples pushed before an error, and the documents whose samples were all pushed
+func (r *RemoteWrite) IndexWithContext(ctx context.Context, documents []interface{}, opts IndexingOpts) (IndexResult, error) {
+	result := IndexResult{Target: r.url}
+	if len(documents) == 0 {
+		return result, fmt.Errorf("empty document list in %s", opts.MetricName)
+	}
+	start := time.Now().UTC()
+	samples, indexed, err := r.samplesConfig.documentSamples(ctx, documents, opts)
+	if err != nil {
+		return result, fmt.Errorf("remote write indexer: %w", err)
+	}
+	samples = r.samplesConfig.relabel(samples)
+	// Documents are indexed once all their samples are pushed, the ones whose samples were all dropped by relabeling already are
+	pendingSamples := make(map[int]int)
+	for _, sample := range samples {
+		pendingSamples[sample.document]++
+	}
+	result.Indexed = indexed - len(pendingSamples)
+	for _, batch := range writeRequests(samples, r.batchSize) {
+		if err := r.send(ctx, batch.request); err != nil {
+			if ctx.Err() != nil {
+				result.Duration = time.Since(start)
+				return result, err
+			}
+			for _, s := range batch.samples {
+				result.Failures = append(result.Failures, DocumentFailure{DocumentID: fmt.Sprintf("%s@%d", s.labels, s.timestamp), Reason: err.Error()})
+			}
+			result.Failed = len(result.Failures)
+			if checkFailureThreshold(result, len(samples), r.failureThreshold) != nil {
+				result.Duration = time.Since(start)
+				return result, err
+			}
+			continue
+		}
+		result.Samples += len(batch.samples)
+		for _, sample := range batch.samples {
+			if pendingSamples[sample.document]--; pendingSamples[sample.document] == 0 {
+				result.Indexed++
+			}
+		}
+	}
+	result.Duration = time.Since(start)
+	return result, nil
+}
+
+// writeRequest is a remote write request along with the samples it holds
+type writeRequest struct {
+	request *prompb.WriteRequest
+	samples []tsdbSample
+}
+
+// writeRequests groups the samples by series and splits them into write requests of at most batchSize samples.
+// The samples of every series are sorted by timestamp, as the remote write protocol requires
+func writeRequests(samples []tsdbSample, batchSize int) []writeRequest {
+	seriesSamples := make(map[string][]tsdbSample)
+	var seriesKeys []string
+	for _, sample := range samples {
+		key := sample.labels.String()
+		if _, ok := seriesSamples[key]; !ok {
+			seriesKeys = append(seriesKeys, key)
+		}
+		seriesSamples[key] = append(seriesSamples[key], sample)
+	}
+	sort.Strings(seriesKeys)
+	var requests []writeRequest
+	request := writeRequest{request: &prompb.WriteRequest{}}
+	for _, key := range seriesKeys {
+		series := seriesSamples[key]
+		sort.SliceStable(series, func(i, j int) bool {
+			return series[i].timestamp < series[j].timestamp
+		})
+		for len(series) > 0 {
+			if len(request.samples) == batchSize {
+				requests = append(requests, request)
+				request = writeRequest{request: &prompb.WriteRequest{}}
+			}
+			chunk := series[:min(len(series), batchSize-len(request.samples))]
+			series = series[len(chunk):]
+			timeSeries := prompb.TimeSeries{Labels: promLabels(chunk[0].labels)}
+			for _, sample := range chunk {
+				timeSeries.Samples = append(timeSeries.Samples, prompb.Sample{Timestamp: sample.timestamp, Value: sample.value})
+			}
+			request.request.Timeseries = append(request.request.Timeseries, timeSeries)
+			request.samples = append(request.samples, chunk...)
+		}
+	}
+	if len(request.samples) > 0 {
+		requests = append(requests, request)
+	}
+	return requests
+}
+
+// promLabels converts the labels of a sample to their protobuf representation
+func promLabels(lbls labels.Labels) []prompb.Label {
+	var promLbls []prompb.Label
+	lbls.Range(func(l labels.Label) {
+		promLbls = append(promLbls, prompb.Label{Name: l.Name, Value: l.Value})
+	})
+	return promLbls
+}
+
+// send sends a write request, retrying on network errors and retryable status codes
+func (r *RemoteWrite) send(ctx context.Context, request *prompb.WriteRequest) error {
+	payload, err := request.Marshal()
+	if err != nil {
+		return fmt.Errorf("error encoding write request: %s", err)
+	}
+	body := snappy.Encode(nil, payload)
+	for attempt := 1; ; attempt++ {
+		err = r.post(ctx, body)
+		if err == nil {
+			return nil
+		}
+		remoteWriteErr, ok := err.(*RemoteWriteError)
+		if !ok || attempt >= r.retry.maxAttempts() || (remoteWriteErr.StatusCode != 0 && !r.retry.retryable(remoteWriteErr.StatusCode)) {
+			return err
+		}
+		backoff := r.retry.backoff(attempt)
+		log.Infof("Retrying remote write request in %v, attempt %d/%d: %s", backoff, attempt+1, r.retry.maxAttempts(), err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("indexing interrupted: %w", ctx.Err())
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// post posts the encoded write request to the remote write endpoint
+func (r *RemoteWrite) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "go-commons")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	for name, value := range r.headers {
+		req.Header.Set(name, value)
+	}
+	switch {
+	case r.credentials.username != "" || r.credentials.password != "":
+		req.SetBasicAuth(r.credentials.username, r.credentials.password)
+	case r.credentials.bearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+r.credentials.bearerToken)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("indexing interrupted: %w", ctx.Err())
+		}
+		return &RemoteWriteError{Message: err.Error()}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return &RemoteWriteError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+}
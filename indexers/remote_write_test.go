@@ -0,0 +1,188 @@
+package indexers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/prompb"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tests for remote_write.go", func() {
+	var server *httptest.Server
+	var requests []*prompb.WriteRequest
+	var headers []http.Header
+	var statusCodes []int
+	var lock sync.Mutex
+	var indexerConfig IndexerConfig
+	var documents []interface{}
+	BeforeEach(func() {
+		requests, headers, statusCodes = nil, nil, nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			lock.Lock()
+			defer lock.Unlock()
+			headers = append(headers, r.Header.Clone())
+			if len(statusCodes) > 0 {
+				statusCode := statusCodes[0]
+				statusCodes = statusCodes[1:]
+				w.WriteHeader(statusCode)
+				w.Write([]byte("receiver unavailable\n"))
+				return
+			}
+			compressed, err := io.ReadAll(r.Body)
+			Expect(err).To(BeNil())
+			payload, err := snappy.Decode(nil, compressed)
+			Expect(err).To(BeNil())
+			var request prompb.WriteRequest
+			Expect(request.Unmarshal(payload)).To(Succeed())
+			requests = append(requests, &request)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		indexerConfig = IndexerConfig{
+			Type:        RemoteWriteIndexer,
+			RemoteWrite: RemoteWriteConfig{URL: server.URL + "/api/v1/write", Headers: map[string]string{"X-Scope-OrgID": "perf"}},
+			Auth:        AuthConfig{BearerToken: Secret{Value: "token"}},
+			Retry:       RetryConfig{BackoffBase: time.Millisecond},
+		}
+		now := time.Now().UTC()
+		documents = []interface{}{
+			map[string]interface{}{"timestamp": now.Add(time.Second).Format(time.RFC3339Nano), "value": 2.0, "labels": map[string]interface{}{"namespace": "default"}},
+			map[string]interface{}{"timestamp": now.Format(time.RFC3339Nano), "value": 1.0, "labels": map[string]interface{}{"namespace": "default"}},
+			map[string]interface{}{"timestamp": now.Format(time.RFC3339Nano), "value": 3.0, "labels": map[string]interface{}{"namespace": "kube-system"}},
+		}
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("pushes the samples grouped by series with auth and custom headers", func() {
+		indexer, err := NewIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		result, err := (*indexer).Index(documents, IndexingOpts{MetricName: "cpuUsage"})
+		Expect(err).To(BeNil())
+		Expect(result.Target).To(Equal(indexerConfig.RemoteWrite.URL))
+		Expect(result.Indexed).To(Equal(3))
+		Expect(result.Samples).To(Equal(3))
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].Timeseries).To(HaveLen(2))
+		series := requests[0].Timeseries[0]
+		Expect(series.Labels).To(Equal([]prompb.Label{{Name: "__name__", Value: "cpuUsage"}, {Name: "namespace", Value: "default"}}))
+		Expect(series.Samples).To(HaveLen(2))
+		Expect(series.Samples[0].Value).To(Equal(1.0))
+		Expect(series.Samples[0].Timestamp).To(BeNumerically("<", series.Samples[1].Timestamp))
+		Expect(headers[0].Get("Content-Encoding")).To(Equal("snappy"))
+		Expect(headers[0].Get("Content-Type")).To(Equal("application/x-protobuf"))
+		Expect(headers[0].Get("X-Prometheus-Remote-Write-Version")).To(Equal("0.1.0"))
+		Expect(headers[0].Get("Authorization")).To(Equal("Bearer token"))
+		Expect(headers[0].Get("X-Scope-OrgID")).To(Equal("perf"))
+	})
+
+	It("splits the samples into batches", func() {
+		indexerConfig.RemoteWrite.BatchSize = 1
+		indexer, err := NewRemoteWriteIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		result, err := indexer.Index(documents, IndexingOpts{MetricName: "cpuUsage"})
+		Expect(err).To(BeNil())
+		Expect(result.Samples).To(Equal(3))
+		Expect(requests).To(HaveLen(3))
+		for _, request := range requests {
+			Expect(request.Timeseries).To(HaveLen(1))
+			Expect(request.Timeseries[0].Samples).To(HaveLen(1))
+		}
+	})
+
+	It("retries the requests failing with retryable status codes", func() {
+		statusCodes = []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}
+		indexer, err := NewRemoteWriteIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		result, err := indexer.Index(documents, IndexingOpts{MetricName: "cpuUsage"})
+		Expect(err).To(BeNil())
+		Expect(result.Samples).To(Equal(3))
+		Expect(headers).To(HaveLen(3))
+		statusCodes = []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable}
+		_, err = indexer.Index(documents, IndexingOpts{MetricName: "cpuUsage"})
+		Expect(err).To(MatchError("remote write request failed with status 503: receiver unavailable"))
+	})
+
+	It("doesn't retry the requests rejected by the receiver", func() {
+		statusCodes = []int{http.StatusBadRequest}
+		indexer, err := NewRemoteWriteIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		result, err := indexer.Index(documents, IndexingOpts{MetricName: "cpuUsage"})
+		var remoteWriteErr *RemoteWriteError
+		Expect(err).To(BeAssignableToTypeOf(remoteWriteErr))
+		Expect(err.(*RemoteWriteError).StatusCode).To(Equal(http.StatusBadRequest))
+		Expect(result.Samples).To(BeZero())
+		Expect(headers).To(HaveLen(1))
+	})
+
+	It("counts the documents of the batches pushed before a failure", func() {
+		indexerConfig.RemoteWrite.BatchSize = 1
+		statusCodes = []int{http.StatusNoContent, http.StatusBadRequest}
+		indexer, err := NewRemoteWriteIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		result, err := indexer.Index(documents, IndexingOpts{MetricName: "cpuUsage"})
+		Expect(err).To(BeAssignableToTypeOf(&RemoteWriteError{}))
+		Expect(result.Indexed).To(Equal(1))
+		Expect(result.Samples).To(Equal(1))
+		Expect(result.Failed).To(Equal(1))
+		Expect(headers).To(HaveLen(2))
+	})
+
+	It("tolerates the failed requests below the failure threshold", func() {
+		indexerConfig.RemoteWrite.BatchSize = 1
+		indexerConfig.FailureThreshold = 0.5
+		statusCodes = []int{http.StatusBadRequest}
+		indexer, err := NewRemoteWriteIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		result, err := indexer.Index(documents, IndexingOpts{MetricName: "cpuUsage"})
+		Expect(err).To(BeNil())
+		Expect(result.Indexed).To(Equal(2))
+		Expect(result.Samples).To(Equal(2))
+		Expect(result.Failed).To(Equal(1))
+		Expect(result.Failures[0].DocumentID).To(HavePrefix(`{__name__="cpuUsage", namespace="default"}@`))
+		Expect(requests).To(HaveLen(2))
+	})
+
+	It("applies the relabel configs to the samples", func() {
+		indexerConfig.TSDB.RelabelConfigs = []*relabel.Config{
+			{Action: relabel.Drop, SourceLabels: model.LabelNames{"namespace"}, Regex: relabel.MustNewRegexp("kube-system"), Separator: ";"},
+		}
+		indexer, err := NewRemoteWriteIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		result, err := indexer.Index(documents, IndexingOpts{MetricName: "cpuUsage"})
+		Expect(err).To(BeNil())
+		Expect(result.Indexed).To(Equal(3))
+		Expect(result.Samples).To(Equal(2))
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].Timeseries).To(HaveLen(1))
+		Expect(requests[0].Timeseries[0].Labels).To(ContainElement(prompb.Label{Name: "namespace", Value: "default"}))
+	})
+
+	It("returns err with invalid relabel configs or failure threshold", func() {
+		indexerConfig.TSDB.RelabelConfigs = []*relabel.Config{{Action: relabel.Replace}}
+		_, err := NewRemoteWriteIndexer(indexerConfig)
+		Expect(err).To(MatchError("invalid relabel config 0 for remote write indexer: relabel configuration for replace action requires 'target_label' value"))
+		indexerConfig.TSDB.RelabelConfigs = nil
+		indexerConfig.FailureThreshold = -0.1
+		_, err = NewRemoteWriteIndexer(indexerConfig)
+		Expect(err).To(MatchError("failure threshold must be between 0 and 1"))
+	})
+
+	It("returns err without URL or with API key auth", func() {
+		_, err := NewRemoteWriteIndexer(IndexerConfig{Type: RemoteWriteIndexer})
+		Expect(err).To(MatchError("remote write URL not specified"))
+		indexerConfig.Auth = AuthConfig{APIKey: Secret{Value: "key"}}
+		_, err = NewRemoteWriteIndexer(indexerConfig)
+		Expect(err).To(MatchError("API key authentication isn't supported by the remote write indexer"))
+	})
+})
@@ -0,0 +1,113 @@
+// Copyright 2024 The go-commons Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	awscredentials "github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// Default service name used to sign requests sent to Amazon OpenSearch Service
+const defaultSigV4Service = "es"
+
+// SigV4Config holds the AWS SigV4 request signing settings of the OpenSearch indexer.
+// Signing is enabled when Region is set
+type SigV4Config struct {
+	// Region AWS region of the OpenSearch domain
+	Region string `yaml:"region"`
+	// Service name of the signed service, "es" for Amazon OpenSearch Service or "aoss" for OpenSearch Serverless. Defaults to "es"
+	Service string `yaml:"service"`
+	// AccessKey AWS access key ID, the credentials are read from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+	// and AWS_SESSION_TOKEN environment variables when not set
+	AccessKey Secret `yaml:"accessKey"`
+	// SecretKey AWS secret access key
+	SecretKey Secret `yaml:"secretKey"`
+	// SessionToken optional AWS session token of temporary credentials
+	SessionToken Secret `yaml:"sessionToken"`
+}
+
+// sigV4Signer signs the OpenSearch client requests with AWS SigV4
+type sigV4Signer struct {
+	signer  *v4.Signer
+	region  string
+	service string
+}
+
+// newSigV4Signer returns a signer using the static credentials of the configuration, or the environment ones
+func newSigV4Signer(config SigV4Config) (*sigV4Signer, error) {
+	var creds *awscredentials.Credentials
+	accessKey, err := config.AccessKey.Resolve()
+	if err != nil {
+		return nil, fmt.Errorf("error loading AWS access key: %s", err)
+	}
+	if accessKey != "" {
+		secretKey, err := config.SecretKey.Resolve()
+		if err != nil {
+			return nil, fmt.Errorf("error loading AWS secret key: %s", err)
+		}
+		sessionToken, err := config.SessionToken.Resolve()
+		if err != nil {
+			return nil, fmt.Errorf("error loading AWS session token: %s", err)
+		}
+		creds = awscredentials.NewStaticCredentials(accessKey, secretKey, sessionToken)
+	} else {
+		creds = awscredentials.NewEnvCredentials()
+	}
+	if _, err := creds.Get(); err != nil {
+		return nil, fmt.Errorf("error loading AWS credentials: %s", err)
+	}
+	service := config.Service
+	if service == "" {
+		service = defaultSigV4Service
+	}
+	return &sigV4Signer{
+		signer:  v4.NewSigner(creds),
+		region:  config.Region,
+		service: service,
+	}, nil
+}
+
+// SignRequest signs the request, it implements the OpenSearch client signer.Signer interface.
+// The payload hash is sent in the X-Amz-Content-Sha256 header, required by OpenSearch Serverless
+func (s *sigV4Signer) SignRequest(req *http.Request) error {
+	var body io.ReadSeeker
+	var content []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		// The client signs retried requests before rewinding their body, so read it from GetBody when possible
+		reqBody := req.Body
+		var err error
+		if req.GetBody != nil {
+			if reqBody, err = req.GetBody(); err != nil {
+				return err
+			}
+		}
+		if content, err = io.ReadAll(reqBody); err != nil {
+			return err
+		}
+		body = bytes.NewReader(content)
+	}
+	payloadHash := sha256.Sum256(content)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	_, err := s.signer.Sign(req, body, s.service, s.region, time.Now().UTC())
+	return err
+}
@@ -0,0 +1,188 @@
+package indexers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	awscredentials "github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// newSigV4MockServer returns a mock OpenSearch server that verifies the SigV4 signature of every request
+// with the given credentials, the verification errors are returned by the returned function
+func newSigV4MockServer(accessKey, secretKey, region, service string) (*httptest.Server, func() []string) {
+	var lock sync.Mutex
+	var signatureErrors []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if err := verifySigV4(r, awscredentials.NewStaticCredentials(accessKey, secretKey, ""), region, service); err != "" {
+			signatureErrors = append(signatureErrors, err)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/_bulk") {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"took":1,"errors":false,"items":[{"index":{"_id":"1","result":"created","status":201}}]}`))
+			return
+		}
+		_, _ = w.Write(payload)
+	}))
+	return server, func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return signatureErrors
+	}
+}
+
+// verifySigV4 signs a copy of the request with the given credentials and compares both signatures
+func verifySigV4(r *http.Request, creds *awscredentials.Credentials, region, service string) string {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 ") {
+		return "missing SigV4 authorization header"
+	}
+	signTime, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return "invalid X-Amz-Date header"
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err.Error()
+	}
+	payloadHash := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(payloadHash[:]) {
+		return "invalid X-Amz-Content-Sha256 header for " + r.Method + " " + r.URL.Path
+	}
+	expected, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	if err != nil {
+		return err.Error()
+	}
+	signedHeaders := authorization[strings.Index(authorization, "SignedHeaders=")+len("SignedHeaders=") : strings.Index(authorization, ", Signature=")]
+	for _, header := range strings.Split(signedHeaders, ";") {
+		if header != "host" {
+			expected.Header[http.CanonicalHeaderKey(header)] = r.Header.Values(header)
+		}
+	}
+	if _, err := v4.NewSigner(creds).Sign(expected, bytes.NewReader(body), service, region, signTime); err != nil {
+		return err.Error()
+	}
+	if expected.Header.Get("Authorization") != authorization {
+		return "signature mismatch for " + r.Method + " " + r.URL.Path
+	}
+	return ""
+}
+
+var _ = Describe("Tests for sigv4.go", func() {
+	var server *httptest.Server
+	var signatureErrors func() []string
+	BeforeEach(func() {
+		server, signatureErrors = newSigV4MockServer("AKIDTEST", "secretkey", "us-west-2", "es")
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("signs every request with static credentials", func() {
+		indexer, err := NewOpenSearchIndexer(IndexerConfig{
+			Type:    OpenSearchIndexer,
+			Servers: []string{server.URL},
+			Index:   "go-commons-test",
+			SigV4: SigV4Config{
+				Region:    "us-west-2",
+				AccessKey: Secret{Value: "AKIDTEST"},
+				SecretKey: Secret{Value: "secretkey"},
+			},
+		})
+		Expect(err).To(BeNil())
+		_, err = indexer.Index([]interface{}{map[string]interface{}{"key": "value"}}, IndexingOpts{})
+		Expect(err).To(BeNil())
+		Expect(signatureErrors()).To(BeEmpty())
+	})
+
+	It("signs every request with credentials from the environment", func() {
+		GinkgoT().Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+		GinkgoT().Setenv("AWS_SECRET_ACCESS_KEY", "secretkey")
+		_, err := NewOpenSearchIndexer(IndexerConfig{
+			Type:    OpenSearchIndexer,
+			Servers: []string{server.URL},
+			Index:   "go-commons-test",
+			SigV4:   SigV4Config{Region: "us-west-2"},
+		})
+		Expect(err).To(BeNil())
+		Expect(signatureErrors()).To(BeEmpty())
+	})
+
+	It("is rejected when signing with the wrong service name", func() {
+		_, err := NewOpenSearchIndexer(IndexerConfig{
+			Type:    OpenSearchIndexer,
+			Servers: []string{server.URL},
+			Index:   "go-commons-test",
+			SigV4: SigV4Config{
+				Region:    "us-west-2",
+				Service:   "aoss",
+				AccessKey: Secret{Value: "AKIDTEST"},
+				SecretKey: Secret{Value: "secretkey"},
+			},
+		})
+		Expect(err).NotTo(BeNil())
+		Expect(signatureErrors()).NotTo(BeEmpty())
+	})
+
+	It("signs every request for OpenSearch Serverless", func() {
+		server.Close()
+		server, signatureErrors = newSigV4MockServer("AKIDTEST", "secretkey", "us-west-2", "aoss")
+		indexer, err := NewOpenSearchIndexer(IndexerConfig{
+			Type:    OpenSearchIndexer,
+			Servers: []string{server.URL},
+			Index:   "go-commons-test",
+			SigV4: SigV4Config{
+				Region:    "us-west-2",
+				Service:   "aoss",
+				AccessKey: Secret{Value: "AKIDTEST"},
+				SecretKey: Secret{Value: "secretkey"},
+			},
+		})
+		Expect(err).To(BeNil())
+		_, err = indexer.Index([]interface{}{map[string]interface{}{"key": "value"}}, IndexingOpts{})
+		Expect(err).To(BeNil())
+		Expect(signatureErrors()).To(BeEmpty())
+	})
+
+	It("returns err when combined with another authentication method", func() {
+		_, err := NewOpenSearchIndexer(IndexerConfig{
+			Type:    OpenSearchIndexer,
+			Servers: []string{server.URL},
+			Index:   "go-commons-test",
+			Auth:    AuthConfig{BearerToken: Secret{Value: "token"}},
+			SigV4: SigV4Config{
+				Region:    "us-west-2",
+				AccessKey: Secret{Value: "AKIDTEST"},
+				SecretKey: Secret{Value: "secretkey"},
+			},
+		})
+		Expect(err).To(MatchError("SigV4 signing can't be combined with basic auth, API key or bearer token"))
+	})
+
+	It("returns err when no credentials are available", func() {
+		GinkgoT().Setenv("AWS_ACCESS_KEY_ID", "")
+		GinkgoT().Setenv("AWS_ACCESS_KEY", "")
+		GinkgoT().Setenv("AWS_SECRET_ACCESS_KEY", "")
+		GinkgoT().Setenv("AWS_SECRET_KEY", "")
+		_, err := NewOpenSearchIndexer(IndexerConfig{
+			Type:    OpenSearchIndexer,
+			Servers: []string{server.URL},
+			Index:   "go-commons-test",
+			SigV4:   SigV4Config{Region: "us-west-2"},
+		})
+		Expect(err.Error()).To(HavePrefix("error loading AWS credentials"))
+	})
+})
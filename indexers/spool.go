@@ -0,0 +1,500 @@
+// Copyright 2024 The go-commons Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Default minimum time between connection attempts to the remote indexer
+	defaultReconnectInterval = 30 * time.Second
+	// Name of the spool file of the documents indexed without metric name
+	defaultSpoolMetricName = "_default"
+	// Subdirectory of the spool directory holding the spooled documents rejected when replayed
+	rejectedSpoolDirectory = "rejected"
+)
+
+// SpoolConfig holds the settings of the disk spool of the ElasticSearch and OpenSearch indexers
+type SpoolConfig struct {
+	// Directory where the documents are spooled, using the local indexer format, while the remote indexer is unavailable.
+	// Spooling is enabled when set
+	Directory string `yaml:"directory"`
+	// IDFields document fields used to build the document IDs, as in IDFromFields, when the documents don't get an ID
+	// function. The SHA256 of the documents is used when not set. Spooled documents are stored with their ID and bulk
+	// action, so they're replayed as they would have been indexed
+	IDFields []string `yaml:"idFields"`
+	// ReconnectInterval minimum time between connection attempts to the remote indexer. Defaults to 30s
+	ReconnectInterval time.Duration `yaml:"reconnectInterval"`
+}
+
+// Spool indexer instance, it sends the documents to a remote indexer and spools them to disk while it's unavailable.
+// The spooled documents are replayed on the next successful connection
+type Spool struct {
+	indexerConfig IndexerConfig
+	remote        Indexer
+	local         *Local
+	lastAttempt   time.Time
+	// pending is set when documents are spooled while the remote indexer is connected
+	pending bool
+	lock    sync.Mutex
+}
+
+// spooledDocument is a document written to the spool directory, along with the ID and bulk action it was indexed with,
+// and the rejection reason once moved to the rejected directory
+type spooledDocument struct {
+	ID       string          `json:"id"`
+	Action   BulkAction      `json:"action,omitempty"`
+	Document json.RawMessage `json:"document"`
+	Reason   string          `json:"reason,omitempty"`
+}
+
+// replayedDocument is a spooled document sent to the remote indexer, it's encoded as the original document
+type replayedDocument spooledDocument
+
+// MarshalJSON returns the original document
+func (d replayedDocument) MarshalJSON() ([]byte, error) {
+	return d.Document, nil
+}
+
+// replayedDocumentID returns the ID a replayed document was spooled with
+func replayedDocumentID(document interface{}) (string, error) {
+	replayed, ok := document.(replayedDocument)
+	if !ok {
+		return "", fmt.Errorf("not a spooled document")
+	}
+	return replayed.ID, nil
+}
+
+// NewSpoolIndexer returns a new Spool indexer for the remote ElasticSearch or OpenSearch indexer of the given configuration.
+// Failing to connect to the remote indexer isn't an error, the documents are spooled until it becomes available
+func NewSpoolIndexer(indexerConfig IndexerConfig) (*Spool, error) {
+	spool := Spool{indexerConfig: indexerConfig}
+	if indexerConfig.Type != ElasticIndexer && indexerConfig.Type != OpenSearchIndexer {
+		return &spool, fmt.Errorf("spooling is only supported by the ElasticSearch and OpenSearch indexers")
+	}
+	if indexerConfig.Index == "" {
+		return &spool, fmt.Errorf("index name not specified")
+	}
+	var err error
+	if spool.local, err = NewLocalIndexer(IndexerConfig{Type: LocalIndexer, MetricsDirectory: indexerConfig.Spool.Directory}); err != nil {
+		return &spool, err
+	}
+	spool.lock.Lock()
+	defer spool.lock.Unlock()
+	spool.available(context.Background())
+	return &spool, nil
+}
+
+// Index sends the documents to the remote indexer, or spools them when it's unavailable
+func (s *Spool) Index(documents []interface{}, opts IndexingOpts) (IndexResult, error) {
+	return s.IndexWithContext(context.Background(), documents, opts)
+}
+
+// IndexWithContext sends the documents to the remote indexer, or spools them when it's unavailable.
+// Only the documents the remote indexer didn't acknowledge, or rejected with a retryable status code, are spooled:
+// the other rejected documents would fail again when replayed. The remote indexer is considered unavailable
+// when documents aren't acknowledged or its requests fail. Permanent errors, such as an index mapping incompatible
+// with the configured one, are returned without spooling. Nothing is spooled when the context is cancelled while indexing
+func (s *Spool) IndexWithContext(ctx context.Context, documents []interface{}, opts IndexingOpts) (IndexResult, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	opts = s.indexingOpts(opts)
+	if len(documents) == 0 || !s.available(ctx) {
+		return s.spool(documents, opts)
+	}
+	result, indexErr := s.remote.IndexWithContext(ctx, documents, opts)
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+	var bulkErr *BulkIndexError
+	if indexErr != nil && !errors.As(indexErr, &bulkErr) && len(result.Failures) == 0 && !s.transient(indexErr) {
+		return result, indexErr
+	}
+	undelivered, failures, disconnected, err := s.undelivered(documents, opts, result)
+	if err != nil {
+		return result, err
+	}
+	if indexErr != nil && bulkErr == nil {
+		log.Warnf("Indexing failed, spooling %d documents to %s: %s", len(undelivered), s.indexerConfig.Spool.Directory, indexErr)
+		disconnected = true
+	}
+	if len(undelivered) == 0 {
+		return result, indexErr
+	}
+	log.Warnf("%d documents not delivered, spooling them to %s", len(undelivered), s.indexerConfig.Spool.Directory)
+	if disconnected {
+		s.remote = nil
+	} else {
+		s.pending = true
+	}
+	spoolResult, err := s.spool(undelivered, opts)
+	if err != nil {
+		return result, err
+	}
+	result.Spooled = spoolResult.Spooled
+	result.Failed = len(failures)
+	result.Failures = failures
+	if bulkErr != nil {
+		return result, checkFailureThreshold(result, bulkErr.Total, s.indexerConfig.FailureThreshold)
+	}
+	return result, nil
+}
+
+// spool writes the documents to the spool directory, with the ID and bulk action of the indexing options
+func (s *Spool) spool(documents []interface{}, opts IndexingOpts) (IndexResult, error) {
+	if len(documents) == 0 {
+		return IndexResult{Target: s.indexerConfig.Spool.Directory}, nil
+	}
+	metricName := opts.MetricName
+	if metricName == "" {
+		metricName = defaultSpoolMetricName
+	}
+	spooled := make([]interface{}, 0, len(documents))
+	for _, document := range documents {
+		j, err := json.Marshal(document)
+		if err != nil {
+			return IndexResult{}, fmt.Errorf("cannot encode document %v: %s", document, err)
+		}
+		docId, err := documentID(document, j, opts)
+		if err != nil {
+			return IndexResult{}, err
+		}
+		spooled = append(spooled, spooledDocument{ID: docId, Action: opts.Action, Document: j})
+	}
+	// Spool the documents even when the context is cancelled, they'd be lost otherwise
+	result, err := s.local.IndexWithContext(context.Background(), spooled, IndexingOpts{MetricName: metricName})
+	if err != nil {
+		return result, fmt.Errorf("error spooling documents: %w", err)
+	}
+	result.Spooled, result.Indexed = result.Indexed, 0
+	return result, nil
+}
+
+// undelivered returns the documents that weren't acknowledged by the remote indexer, or were rejected with a
+// retryable status code, along with the remaining failures of result. All the documents are undelivered when the
+// remote indexer reported none of them. disconnected is true when documents weren't acknowledged
+func (s *Spool) undelivered(documents []interface{}, opts IndexingOpts, result IndexResult) (undelivered []interface{}, remaining []DocumentFailure, disconnected bool, err error) {
+	if result.Indexed == 0 && len(result.Failures) == 0 {
+		return documents, nil, true, nil
+	}
+	undeliveredIDs := make(map[string]bool)
+	for _, failure := range result.Failures {
+		if failure.Status == 0 || s.indexerConfig.Retry.retryable(failure.Status) {
+			undeliveredIDs[failure.DocumentID] = true
+			disconnected = disconnected || failure.Status == 0
+			continue
+		}
+		remaining = append(remaining, failure)
+	}
+	if len(undeliveredIDs) == 0 {
+		return nil, result.Failures, false, nil
+	}
+	for _, document := range documents {
+		j, err := json.Marshal(document)
+		if err != nil {
+			return nil, result.Failures, false, fmt.Errorf("cannot encode document %v: %s", document, err)
+		}
+		docId, err := documentID(document, j, opts)
+		if err != nil {
+			return nil, result.Failures, false, err
+		}
+		if undeliveredIDs[docId] {
+			undelivered = append(undelivered, document)
+		}
+	}
+	return undelivered, remaining, disconnected, nil
+}
+
+// Replay indexes the documents spooled in the given directory into the remote indexer, the spool files are removed once indexed.
+// Documents rejected by the remote indexer are moved to the rejected subdirectory
+func (s *Spool) Replay(dir string) (IndexResult, error) {
+	return s.ReplayWithContext(context.Background(), dir)
+}
+
+// ReplayWithContext indexes the documents spooled in the given directory into the remote indexer, the spool files are removed once indexed.
+// Documents rejected by the remote indexer are moved to the rejected subdirectory. Replayed documents keep the ID and bulk action they were spooled with, so documents indexed before a failure aren't duplicated
+func (s *Spool) ReplayWithContext(ctx context.Context, dir string) (IndexResult, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.remote == nil {
+		// Explicit replays don't wait for the reconnect interval
+		s.lastAttempt = time.Time{}
+		if !s.connect() {
+			return IndexResult{}, fmt.Errorf("%s indexer not available", s.indexerConfig.Type)
+		}
+	}
+	return s.replay(ctx, dir)
+}
+
+// replay indexes the spooled documents of the given directory, the spool lock must be held. The spool files are trimmed
+// after every replayed batch, so the delivered documents aren't sent again. Replaying a file stops at the first batch with
+// documents to retry, the next files are still replayed
+func (s *Spool) replay(ctx context.Context, dir string) (IndexResult, error) {
+	result := IndexResult{Target: s.indexerConfig.Index}
+	start := time.Now().UTC()
+	spoolFiles, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return result, err
+	}
+	sort.Strings(spoolFiles)
+	var pending int
+	for _, spoolFile := range spoolFiles {
+		requeued, err := s.replayFile(ctx, spoolFile, &result)
+		if err != nil {
+			result.Duration = time.Since(start)
+			return result, err
+		}
+		pending += requeued
+	}
+	result.Duration = time.Since(start)
+	if pending > 0 {
+		return result, fmt.Errorf("%d spooled documents not delivered", pending)
+	}
+	return result, nil
+}
+
+// replayFile indexes the documents of the given spool file, adding the outcome to result. It returns the number of
+// documents left in the file to retry later
+func (s *Spool) replayFile(ctx context.Context, spoolFile string, result *IndexResult) (int, error) {
+	content, err := os.ReadFile(spoolFile)
+	if err != nil {
+		return 0, fmt.Errorf("error reading spool file %s: %s", spoolFile, err)
+	}
+	var spooled []spooledDocument
+	if err := json.Unmarshal(content, &spooled); err != nil {
+		return 0, fmt.Errorf("JSON decoding error in %s: %s", spoolFile, err)
+	}
+	spoolName := strings.TrimSuffix(filepath.Base(spoolFile), ".json")
+	metricName := spoolName
+	if metricName == defaultSpoolMetricName {
+		metricName = ""
+	}
+	// Consecutive documents with the same bulk action are replayed together, keeping the order they were spooled in
+	for replayed := 0; replayed < len(spooled); {
+		action := spooled[replayed].Action
+		batch := spooled[replayed:]
+		for i := range batch {
+			if batch[i].Action != action {
+				batch = batch[:i]
+				break
+			}
+		}
+		documents := make([]interface{}, 0, len(batch))
+		for _, document := range batch {
+			documents = append(documents, replayedDocument(document))
+		}
+		batchResult, indexErr := s.remote.IndexWithContext(ctx, documents, IndexingOpts{MetricName: metricName, DocumentID: replayedDocumentID, Action: action})
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		requeued, rejected, err := s.replayed(batch, action, batchResult, indexErr, result)
+		if err != nil {
+			return 0, fmt.Errorf("error replaying spool file %s: %w", spoolFile, err)
+		}
+		if err := s.reject(filepath.Join(filepath.Dir(spoolFile), rejectedSpoolDirectory), spoolName, rejected); err != nil {
+			return 0, err
+		}
+		replayed += len(batch)
+		if err := trimSpoolFile(spoolFile, replayed, requeued); err != nil {
+			return 0, err
+		}
+		if len(requeued) > 0 {
+			log.Warnf("%d documents of %s not delivered, they'll be replayed later", len(requeued), spoolFile)
+			return len(requeued), nil
+		}
+	}
+	log.Infof("Replayed %d documents from %s", len(spooled), spoolFile)
+	return 0, nil
+}
+
+// replayed sorts out the documents of a replayed batch from the indexing result, which is added to result: the ones
+// not acknowledged, or rejected with a retryable status code, are requeued, the other rejected ones are returned with
+// their reason. Conflicts of created documents mean they were delivered by a previous replay. Transient errors
+// without rejected documents are returned, permanent ones reject the whole batch as it would fail on every replay
+func (s *Spool) replayed(batch []spooledDocument, action BulkAction, batchResult IndexResult, indexErr error, result *IndexResult) (requeued, rejected []spooledDocument, err error) {
+	var bulkErr *BulkIndexError
+	if indexErr != nil && !errors.As(indexErr, &bulkErr) && len(batchResult.Failures) == 0 {
+		if s.transient(indexErr) {
+			return nil, nil, indexErr
+		}
+		for _, document := range batch {
+			batchResult.Failures = append(batchResult.Failures, DocumentFailure{DocumentID: document.ID, Reason: indexErr.Error()})
+		}
+		batchResult.Failed = len(batch)
+	}
+	failures := make(map[string]DocumentFailure)
+	var remaining []DocumentFailure
+	for _, failure := range batchResult.Failures {
+		if failure.Status == http.StatusConflict && (action == CreateAction || s.indexerConfig.Lifecycle.DataStream) {
+			batchResult.Indexed++
+			batchResult.Failed--
+			continue
+		}
+		failures[failure.DocumentID] = failure
+		remaining = append(remaining, failure)
+	}
+	batchResult.Failures = remaining
+	result.add(batchResult)
+	for _, document := range batch {
+		failure, ok := failures[document.ID]
+		switch {
+		case !ok:
+		case failure.Status == 0 || s.indexerConfig.Retry.retryable(failure.Status):
+			requeued = append(requeued, document)
+		default:
+			document.Reason = failure.Reason
+			rejected = append(rejected, document)
+		}
+	}
+	return requeued, rejected, nil
+}
+
+// reject moves the given documents to the spool file of the same name in the rejected directory, so they aren't replayed again
+func (s *Spool) reject(dir, spoolName string, rejected []spooledDocument) error {
+	if len(rejected) == 0 {
+		return nil
+	}
+	local, err := NewLocalIndexer(IndexerConfig{Type: LocalIndexer, MetricsDirectory: dir})
+	if err != nil {
+		return fmt.Errorf("error creating rejected documents directory %s: %s", dir, err)
+	}
+	documents := make([]interface{}, 0, len(rejected))
+	for _, document := range rejected {
+		documents = append(documents, document)
+	}
+	result, err := local.IndexWithContext(context.Background(), documents, IndexingOpts{MetricName: spoolName})
+	if err != nil {
+		return fmt.Errorf("error writing rejected documents: %w", err)
+	}
+	log.Warnf("%d spooled documents rejected by the %s indexer, moved to %s", len(rejected), s.indexerConfig.Type, result.Target)
+	return nil
+}
+
+// trimSpoolFile removes the first replayed documents of the given spool file, the requeued ones are put back in front of
+// the remaining ones. Documents spooled meanwhile are kept, and the file is removed once empty
+func trimSpoolFile(spoolFile string, replayed int, requeued []spooledDocument) error {
+	unlock, err := lockFile(spoolFile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	content, err := os.ReadFile(spoolFile)
+	if err != nil {
+		return fmt.Errorf("error reading spool file %s: %s", spoolFile, err)
+	}
+	var spooled []spooledDocument
+	if err := json.Unmarshal(content, &spooled); err != nil {
+		return fmt.Errorf("JSON decoding error in %s: %s", spoolFile, err)
+	}
+	remaining := append(requeued, spooled[min(replayed, len(spooled)):]...)
+	if len(remaining) == 0 {
+		if err := os.Remove(spoolFile); err != nil {
+			return fmt.Errorf("error removing spool file %s: %s", spoolFile, err)
+		}
+		return nil
+	}
+	if content, err = json.Marshal(remaining); err != nil {
+		return fmt.Errorf("JSON encoding error: %s", err)
+	}
+	if err := writeFileAtomic(spoolFile, content); err != nil {
+		return fmt.Errorf("error writing spool file %s: %s", spoolFile, err)
+	}
+	return nil
+}
+
+// available returns true when the remote indexer is available, connecting to it when needed.
+// The spooled documents are replayed on every new connection, and at most once every reconnect interval
+// while documents spooled without disconnecting are pending. The spool lock must be held
+func (s *Spool) available(ctx context.Context) bool {
+	switch {
+	case s.remote == nil:
+		if !s.connect() {
+			return false
+		}
+	case !s.pending || !s.attempt():
+		return true
+	}
+	s.pending = false
+	if _, err := s.replay(ctx, s.indexerConfig.Spool.Directory); err != nil {
+		log.Errorf("Error replaying spooled documents: %s", err)
+		s.pending = true
+	}
+	return true
+}
+
+// attempt records a new connection or replay attempt, it returns false when the last one is more recent
+// than the reconnect interval. The spool lock must be held
+func (s *Spool) attempt() bool {
+	reconnectInterval := s.indexerConfig.Spool.ReconnectInterval
+	if reconnectInterval <= 0 {
+		reconnectInterval = defaultReconnectInterval
+	}
+	if !s.lastAttempt.IsZero() && time.Since(s.lastAttempt) < reconnectInterval {
+		return false
+	}
+	s.lastAttempt = time.Now()
+	return true
+}
+
+// connect creates the remote indexer, trying at most once every reconnect interval. The spool lock must be held
+func (s *Spool) connect() bool {
+	if !s.attempt() {
+		return false
+	}
+	var remote Indexer
+	var err error
+	switch s.indexerConfig.Type {
+	case ElasticIndexer:
+		remote, err = NewElasticIndexer(s.indexerConfig)
+	case OpenSearchIndexer:
+		remote, err = NewOpenSearchIndexer(s.indexerConfig)
+	}
+	if err != nil {
+		log.Warnf("%s indexer not available, documents are spooled to %s: %s", s.indexerConfig.Type, s.indexerConfig.Spool.Directory, err)
+		return false
+	}
+	s.remote = remote
+	return true
+}
+
+// transient returns true when the given error is a transport error, or a response with a retryable status code,
+// so the request may succeed later
+func (s *Spool) transient(err error) bool {
+	var netErr net.Error
+	var statusErr *statusError
+	return errors.As(err, &netErr) || (errors.As(err, &statusErr) && s.indexerConfig.Retry.retryable(statusErr.status))
+}
+
+// indexingOpts sets the ID function of the spool to the indexing options without one
+func (s *Spool) indexingOpts(opts IndexingOpts) IndexingOpts {
+	if opts.DocumentID == nil && len(s.indexerConfig.Spool.IDFields) > 0 {
+		opts.DocumentID = IDFromFields(s.indexerConfig.Spool.IDFields...)
+	}
+	return opts
+}
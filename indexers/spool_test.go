@@ -0,0 +1,292 @@
+package indexers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tests for spool.go", func() {
+	var server *httptest.Server
+	var clusterDown, bulkDown, throttled, rejected atomic.Bool
+	var indexStatus atomic.Int32
+	var indexedIDs map[string]int
+	var indexedActions map[string]string
+	var indexedIDsLock sync.Mutex
+	var indexerConfig IndexerConfig
+	var documents []interface{}
+	BeforeEach(func() {
+		clusterDown.Store(false)
+		bulkDown.Store(false)
+		throttled.Store(false)
+		rejected.Store(false)
+		indexStatus.Store(0)
+		indexedIDs = map[string]int{}
+		indexedActions = map[string]string{}
+		bulkHandler := bulkMockHandler(func(action string, meta map[string]interface{}) map[string]interface{} {
+			if throttled.Load() && meta["_id"] == "abc-2" {
+				return map[string]interface{}{
+					"_id":    meta["_id"],
+					"status": http.StatusTooManyRequests,
+					"error":  map[string]interface{}{"type": "es_rejected_execution_exception", "reason": "rejected execution"},
+				}
+			}
+			if rejected.Load() && meta["_id"] == "abc-1" {
+				return map[string]interface{}{
+					"_id":    meta["_id"],
+					"status": http.StatusBadRequest,
+					"error":  map[string]interface{}{"type": "mapper_parsing_exception", "reason": "failed to parse"},
+				}
+			}
+			indexedIDsLock.Lock()
+			defer indexedIDsLock.Unlock()
+			if action == "create" && indexedIDs[meta["_id"].(string)] > 0 {
+				return map[string]interface{}{
+					"_id":    meta["_id"],
+					"status": http.StatusConflict,
+					"error":  map[string]interface{}{"type": "version_conflict_engine_exception", "reason": "document already exists"},
+				}
+			}
+			indexedIDs[meta["_id"].(string)]++
+			indexedActions[meta["_id"].(string)] = action
+			return createdItem(action, meta)
+		})
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if clusterDown.Load() || (bulkDown.Load() && strings.HasSuffix(r.URL.Path, "/_bulk")) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if status := indexStatus.Load(); status != 0 && strings.HasPrefix(r.URL.Path, "/go-commons-test-") {
+				w.WriteHeader(int(status))
+				return
+			}
+			bulkHandler(w, r)
+		}))
+		indexerConfig = IndexerConfig{
+			Type:    ElasticIndexer,
+			Servers: []string{server.URL},
+			Index:   "go-commons-test",
+			Retry:   RetryConfig{MaxAttempts: 1},
+			Spool:   SpoolConfig{Directory: GinkgoT().TempDir(), IDFields: []string{"uuid", "value"}, ReconnectInterval: time.Millisecond},
+		}
+		documents = []interface{}{
+			map[string]interface{}{"uuid": "abc", "value": 1},
+			map[string]interface{}{"uuid": "abc", "value": 2},
+		}
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("spools the documents while the cluster is down and replays them on the next connection", func() {
+		clusterDown.Store(true)
+		indexer, err := NewIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		result, err := (*indexer).Index(documents, IndexingOpts{MetricName: "podLatency"})
+		Expect(err).To(BeNil())
+		Expect(result.Spooled).To(Equal(2))
+		Expect(result.String()).To(ContainSubstring("spooled=2"))
+		spoolFile := filepath.Join(indexerConfig.Spool.Directory, "podLatency.json")
+		Expect(spoolFile).To(BeAnExistingFile())
+		Expect(indexedIDs).To(BeEmpty())
+		clusterDown.Store(false)
+		time.Sleep(time.Millisecond)
+		result, err = (*indexer).Index([]interface{}{map[string]interface{}{"uuid": "abc", "value": 3}}, IndexingOpts{MetricName: "podLatency"})
+		Expect(err).To(BeNil())
+		Expect(result.Indexed).To(Equal(1))
+		Expect(spoolFile).NotTo(BeAnExistingFile())
+		Expect(indexedIDs).To(Equal(map[string]int{"abc-1": 1, "abc-2": 1, "abc-3": 1}))
+	})
+
+	It("spools the documents of failed bulk requests and replays them exactly once", func() {
+		indexer, err := NewSpoolIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		bulkDown.Store(true)
+		result, err := indexer.Index(documents, IndexingOpts{})
+		Expect(err).To(BeNil())
+		Expect(result.Spooled).To(Equal(2))
+		Expect(result.Failed).To(BeZero())
+		Expect(filepath.Join(indexerConfig.Spool.Directory, defaultSpoolMetricName+".json")).To(BeAnExistingFile())
+		_, err = indexer.Index(documents[:1], IndexingOpts{})
+		Expect(err).To(BeNil())
+		bulkDown.Store(false)
+		result, err = indexer.Replay(indexerConfig.Spool.Directory)
+		Expect(err).To(BeNil())
+		Expect(result.Indexed).To(Equal(2))
+		Expect(result.SkippedDuplicates).To(Equal(1))
+		Expect(indexedIDs).To(Equal(map[string]int{"abc-1": 1, "abc-2": 1}))
+		result, err = indexer.Replay(indexerConfig.Spool.Directory)
+		Expect(err).To(BeNil())
+		Expect(result.Indexed).To(BeZero())
+	})
+
+	It("replays the documents with the ID and action they were spooled with", func() {
+		clusterDown.Store(true)
+		indexer, err := NewSpoolIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		documentID := func(document interface{}) (string, error) {
+			return "upsert-" + document.(map[string]interface{})["uuid"].(string), nil
+		}
+		result, err := indexer.Index(documents[:1], IndexingOpts{MetricName: "podLatency", DocumentID: documentID, Action: UpsertAction})
+		Expect(err).To(BeNil())
+		Expect(result.Spooled).To(Equal(1))
+		result, err = indexer.Index(documents[1:], IndexingOpts{MetricName: "podLatency"})
+		Expect(err).To(BeNil())
+		Expect(result.Spooled).To(Equal(1))
+		clusterDown.Store(false)
+		result, err = indexer.Replay(indexerConfig.Spool.Directory)
+		Expect(err).To(BeNil())
+		Expect(result.Indexed).To(Equal(2))
+		Expect(indexedActions).To(Equal(map[string]string{"upsert-abc": "update", "abc-2": "index"}))
+	})
+
+	It("spools documents rejected with a retryable status code without disconnecting", func() {
+		indexer, err := NewSpoolIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		throttled.Store(true)
+		result, err := indexer.Index(documents, IndexingOpts{MetricName: "podLatency"})
+		Expect(err).To(BeNil())
+		Expect(result.Indexed).To(Equal(1))
+		Expect(result.Spooled).To(Equal(1))
+		Expect(indexer.remote).NotTo(BeNil())
+		throttled.Store(false)
+		time.Sleep(time.Millisecond)
+		_, err = indexer.Index([]interface{}{map[string]interface{}{"uuid": "abc", "value": 3}}, IndexingOpts{MetricName: "podLatency"})
+		Expect(err).To(BeNil())
+		Expect(filepath.Join(indexerConfig.Spool.Directory, "podLatency.json")).NotTo(BeAnExistingFile())
+		Expect(indexedIDs).To(Equal(map[string]int{"abc-1": 1, "abc-2": 1, "abc-3": 1}))
+	})
+
+	It("doesn't spool the documents when the context is cancelled", func() {
+		indexer, err := NewSpoolIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		result, err := indexer.IndexWithContext(ctx, documents, IndexingOpts{MetricName: "podLatency"})
+		Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+		Expect(result.Spooled).To(BeZero())
+		Expect(filepath.Join(indexerConfig.Spool.Directory, "podLatency.json")).NotTo(BeAnExistingFile())
+		Expect(indexer.remote).NotTo(BeNil())
+	})
+
+	It("doesn't spool rejected documents", func() {
+		server.Close()
+		server = newBulkMockServer(func(action string, meta map[string]interface{}) map[string]interface{} {
+			return map[string]interface{}{
+				"_id":    meta["_id"],
+				"status": 400,
+				"error":  map[string]interface{}{"type": "mapper_parsing_exception", "reason": "failed to parse"},
+			}
+		})
+		indexerConfig.Servers = []string{server.URL}
+		indexer, err := NewSpoolIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		result, err := indexer.Index(documents, IndexingOpts{})
+		Expect(err).To(BeAssignableToTypeOf(&BulkIndexError{}))
+		Expect(result.Spooled).To(BeZero())
+		Expect(result.Failures[0].Status).To(Equal(400))
+		Expect(filepath.Join(indexerConfig.Spool.Directory, defaultSpoolMetricName+".json")).NotTo(BeAnExistingFile())
+	})
+
+	It("trims the spool files as documents are replayed and replays the next files", func() {
+		clusterDown.Store(true)
+		indexer, err := NewSpoolIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		_, err = indexer.Index(documents, IndexingOpts{MetricName: "jobSummary"})
+		Expect(err).To(BeNil())
+		_, err = indexer.Index([]interface{}{map[string]interface{}{"uuid": "abc", "value": 3}}, IndexingOpts{MetricName: "podLatency"})
+		Expect(err).To(BeNil())
+		clusterDown.Store(false)
+		throttled.Store(true)
+		result, err := indexer.Replay(indexerConfig.Spool.Directory)
+		Expect(err).To(MatchError("1 spooled documents not delivered"))
+		Expect(result.Indexed).To(Equal(2))
+		Expect(filepath.Join(indexerConfig.Spool.Directory, "podLatency.json")).NotTo(BeAnExistingFile())
+		content, err := os.ReadFile(filepath.Join(indexerConfig.Spool.Directory, "jobSummary.json"))
+		Expect(err).To(BeNil())
+		Expect(string(content)).To(Equal(`[{"id":"abc-2","document":{"uuid":"abc","value":2}}]`))
+		throttled.Store(false)
+		result, err = indexer.Replay(indexerConfig.Spool.Directory)
+		Expect(err).To(BeNil())
+		Expect(result.Indexed).To(Equal(1))
+		Expect(indexedIDs).To(Equal(map[string]int{"abc-1": 1, "abc-2": 1, "abc-3": 1}))
+	})
+
+	It("counts conflicts of replayed created documents as delivered", func() {
+		clusterDown.Store(true)
+		indexer, err := NewSpoolIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		_, err = indexer.Index(documents, IndexingOpts{MetricName: "podLatency", Action: CreateAction})
+		Expect(err).To(BeNil())
+		indexedIDs["abc-1"] = 1
+		clusterDown.Store(false)
+		result, err := indexer.Replay(indexerConfig.Spool.Directory)
+		Expect(err).To(BeNil())
+		Expect(result.Indexed).To(Equal(2))
+		Expect(result.Failed).To(BeZero())
+		Expect(filepath.Join(indexerConfig.Spool.Directory, "podLatency.json")).NotTo(BeAnExistingFile())
+		Expect(indexedIDs).To(Equal(map[string]int{"abc-1": 1, "abc-2": 1}))
+	})
+
+	It("moves the documents rejected when replayed to the rejected directory", func() {
+		clusterDown.Store(true)
+		indexer, err := NewSpoolIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		_, err = indexer.Index(documents, IndexingOpts{MetricName: "podLatency"})
+		Expect(err).To(BeNil())
+		clusterDown.Store(false)
+		rejected.Store(true)
+		result, err := indexer.Replay(indexerConfig.Spool.Directory)
+		Expect(err).To(BeNil())
+		Expect(result.Indexed).To(Equal(1))
+		Expect(result.Failed).To(Equal(1))
+		Expect(filepath.Join(indexerConfig.Spool.Directory, "podLatency.json")).NotTo(BeAnExistingFile())
+		content, err := os.ReadFile(filepath.Join(indexerConfig.Spool.Directory, rejectedSpoolDirectory, "podLatency.json"))
+		Expect(err).To(BeNil())
+		Expect(string(content)).To(Equal(`[{"id":"abc-1","document":{"uuid":"abc","value":1},"reason":"mapper_parsing_exception: failed to parse"}]`))
+		result, err = indexer.Replay(indexerConfig.Spool.Directory)
+		Expect(err).To(BeNil())
+		Expect(result.Indexed).To(BeZero())
+	})
+
+	It("returns permanent errors without spooling the documents", func() {
+		indexerConfig.Index = "go-commons-test-{{.MetricName}}"
+		indexer, err := NewSpoolIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		indexStatus.Store(http.StatusBadRequest)
+		result, err := indexer.Index(documents, IndexingOpts{MetricName: "podLatency"})
+		Expect(err).To(MatchError(ContainSubstring("error creating index go-commons-test-podlatency on ES: [400 Bad Request]")))
+		Expect(result.Spooled).To(BeZero())
+		Expect(filepath.Join(indexerConfig.Spool.Directory, "podLatency.json")).NotTo(BeAnExistingFile())
+		Expect(indexer.remote).NotTo(BeNil())
+		indexStatus.Store(http.StatusServiceUnavailable)
+		result, err = indexer.Index(documents, IndexingOpts{MetricName: "podLatency"})
+		Expect(err).To(BeNil())
+		Expect(result.Spooled).To(Equal(2))
+		Expect(indexer.remote).To(BeNil())
+	})
+
+	It("returns err when replaying without cluster", func() {
+		clusterDown.Store(true)
+		indexer, err := NewSpoolIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		_, err = indexer.Replay(indexerConfig.Spool.Directory)
+		Expect(err).To(MatchError("elastic indexer not available"))
+	})
+
+	It("returns err for indexers other than ElasticSearch and OpenSearch", func() {
+		indexerConfig.Type = LocalIndexer
+		_, err := NewSpoolIndexer(indexerConfig)
+		Expect(err).To(MatchError("spooling is only supported by the ElasticSearch and OpenSearch indexers"))
+	})
+})
@@ -0,0 +1,423 @@
+// Copyright 2024 The go-commons Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexers
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Name of the manifest file of the metrics tarballs
+	manifestName = "manifest.json"
+	// Number of NDJSON documents sent per indexing call when reindexing a tarball
+	reindexBatchSize = 1000
+)
+
+// ndjsonFile matches the optional rotation sequence number and the extension of the NDJSON metric files
+var ndjsonFile = regexp.MustCompile(`(\.[0-9]+)?\.ndjson(\.gz|\.zst)?$`)
+
+// TarballManifest describes the content of a metrics tarball
+type TarballManifest struct {
+	// Created creation time of the tarball
+	Created time.Time `json:"created"`
+	// Files metric files of the tarball
+	Files []ManifestFile `json:"files"`
+}
+
+// ManifestFile describes a file of a metrics tarball
+type ManifestFile struct {
+	// Name path of the file relative to the metrics directory
+	Name string `json:"name"`
+	// Size size of the file in bytes
+	Size int64 `json:"size"`
+	// Documents number of documents of the JSON and NDJSON metric files
+	Documents int `json:"documents"`
+}
+
+// createTarball packages the files of the metrics directory into a gzip tarball, along with a manifest
+func createTarball(metricsDirectory, tarballName string) error {
+	manifest := TarballManifest{Created: time.Now().UTC()}
+	tarballPath, err := filepath.Abs(tarballName)
+	if err != nil {
+		return err
+	}
+	err = filepath.WalkDir(metricsDirectory, func(filename string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Skip the lock files of the metric files
+		if entry.IsDir() && entry.Name() == lockDirectory {
+			return filepath.SkipDir
+		}
+		// Skip the temporary files of the metric files
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			return nil
+		}
+		// Skip the tarball itself when it's written within the metrics directory
+		if absPath, err := filepath.Abs(filename); err != nil || absPath == tarballPath {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(metricsDirectory, filename)
+		if err != nil {
+			return err
+		}
+		documents, err := countDocuments(filename)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, ManifestFile{Name: filepath.ToSlash(name), Size: info.Size(), Documents: documents})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error reading metrics directory %s: %s", metricsDirectory, err)
+	}
+	tarball, err := os.Create(tarballName)
+	if err != nil {
+		return fmt.Errorf("error creating tarball %s: %s", tarballName, err)
+	}
+	gzipWriter := gzip.NewWriter(tarball)
+	tarWriter := tar.NewWriter(gzipWriter)
+	err = writeTarball(tarWriter, metricsDirectory, manifest)
+	err = errors.Join(err, tarWriter.Close(), gzipWriter.Close(), tarball.Close())
+	if err != nil {
+		return fmt.Errorf("error creating tarball %s: %s", tarballName, err)
+	}
+	log.Infof("Metrics tarball %s created with %d files", tarballName, len(manifest.Files))
+	return nil
+}
+
+// writeTarball writes the manifest, then the files it describes, to the tarball
+func writeTarball(tarWriter *tar.Writer, metricsDirectory string, manifest TarballManifest) error {
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{Name: manifestName, Mode: 0644, Size: int64(len(content)), ModTime: manifest.Created}
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := tarWriter.Write(content); err != nil {
+		return err
+	}
+	for _, manifestFile := range manifest.Files {
+		if err := addTarballFile(tarWriter, metricsDirectory, manifestFile.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addTarballFile copies a file of the metrics directory to the tarball
+func addTarballFile(tarWriter *tar.Writer, metricsDirectory, name string) error {
+	file, err := os.Open(filepath.Join(metricsDirectory, filepath.FromSlash(name)))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tarWriter, file)
+	return err
+}
+
+// countDocuments returns the number of documents of a metric file, 0 for other files
+func countDocuments(filename string) (int, error) {
+	var documents int
+	if ndjsonFile.MatchString(filename) {
+		reader := NewNDJSONReader(filename)
+		defer reader.Close()
+		for {
+			var document json.RawMessage
+			err := reader.Next(&document)
+			if errors.Is(err, io.EOF) {
+				return documents, nil
+			} else if err != nil {
+				return documents, err
+			}
+			documents++
+		}
+	}
+	switch filepath.Ext(filename) {
+	case ".parquet":
+		return countParquetRows(filename)
+	case ".csv":
+		return countCSVRecords(filename)
+	case ".json":
+	default:
+		return 0, nil
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	if _, err := decoder.Token(); err != nil {
+		return 0, fmt.Errorf("JSON decoding error in %s: %s", filename, err)
+	}
+	for decoder.More() {
+		var document json.RawMessage
+		if err := decoder.Decode(&document); err != nil {
+			return documents, fmt.Errorf("JSON decoding error in %s: %s", filename, err)
+		}
+		documents++
+	}
+	return documents, nil
+}
+
+// countParquetRows returns the number of rows of a Parquet metric file
+func countParquetRows(filename string) (int, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	parquetFile, err := parquet.OpenFile(file, info.Size())
+	if err != nil {
+		return 0, fmt.Errorf("error reading Parquet file %s: %s", filename, err)
+	}
+	return int(parquetFile.NumRows()), nil
+}
+
+// countCSVRecords returns the number of records of a CSV metric file, excluding its header
+func countCSVRecords(filename string) (int, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	var records int
+	for {
+		_, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, fmt.Errorf("CSV decoding error in %s: %s", filename, err)
+		}
+		records++
+	}
+	if records == 0 {
+		return 0, nil
+	}
+	return records - 1, nil
+}
+
+// ReindexTarball indexes the metric files of a tarball created by the Local indexer into the given indexer
+func ReindexTarball(tarball string, indexer Indexer) (IndexResult, error) {
+	return ReindexTarballWithContext(context.Background(), tarball, indexer)
+}
+
+// ReindexTarballWithContext indexes the metric files of a tarball created by the Local indexer into the given indexer.
+// The documents of every JSON and NDJSON metric file are indexed with the metric name of the file. The flattened
+// Parquet and CSV metric files can't be reindexed, an error is returned before indexing anything when the tarball has some
+func ReindexTarballWithContext(ctx context.Context, tarball string, indexer Indexer) (IndexResult, error) {
+	start := time.Now().UTC()
+	var result IndexResult
+	directory, err := os.MkdirTemp("", "go-commons-tarball")
+	if err != nil {
+		return result, err
+	}
+	defer os.RemoveAll(directory)
+	manifest, err := extractTarball(tarball, directory)
+	if err != nil {
+		return result, err
+	}
+	for _, manifestFile := range manifest.Files {
+		switch filepath.Ext(manifestFile.Name) {
+		case ".parquet", ".csv":
+			return result, fmt.Errorf("error reindexing %s: Parquet and CSV metric files can't be reindexed", manifestFile.Name)
+		}
+	}
+	var targets []string
+	seenTargets := make(map[string]bool)
+	ndjsonMetrics := make(map[string]bool)
+	for _, manifestFile := range manifest.Files {
+		name := filepath.Base(manifestFile.Name)
+		var metricResult IndexResult
+		switch {
+		case ndjsonFile.MatchString(name):
+			// Rotated NDJSON files are reindexed along with the rest of the files of their metric
+			metricName := ndjsonFile.ReplaceAllString(name, "")
+			metricDirectory := filepath.Join(directory, filepath.Dir(filepath.FromSlash(manifestFile.Name)))
+			if ndjsonMetrics[filepath.Join(metricDirectory, metricName)] {
+				continue
+			}
+			ndjsonMetrics[filepath.Join(metricDirectory, metricName)] = true
+			metricResult, err = reindexNDJSON(ctx, metricDirectory, metricName, indexer)
+		case filepath.Ext(name) == ".json":
+			metricResult, err = reindexJSON(ctx, filepath.Join(directory, filepath.FromSlash(manifestFile.Name)), indexer)
+		default:
+			continue
+		}
+		if metricResult.Target != "" && !seenTargets[metricResult.Target] {
+			seenTargets[metricResult.Target] = true
+			targets = append(targets, metricResult.Target)
+		}
+		result.add(metricResult)
+		if err != nil {
+			result.Target = strings.Join(targets, ",")
+			return result, fmt.Errorf("error reindexing %s: %w", manifestFile.Name, err)
+		}
+	}
+	result.Target = strings.Join(targets, ",")
+	result.Duration = time.Since(start)
+	return result, nil
+}
+
+// extractTarball extracts the tarball into the given directory and returns its manifest
+func extractTarball(tarball, directory string) (TarballManifest, error) {
+	var manifest TarballManifest
+	file, err := os.Open(tarball)
+	if err != nil {
+		return manifest, err
+	}
+	defer file.Close()
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		return manifest, fmt.Errorf("error reading tarball %s: %s", tarball, err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+	var manifestFound bool
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return manifest, fmt.Errorf("error reading tarball %s: %s", tarball, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if header.Name == manifestName {
+			if err := json.NewDecoder(tarReader).Decode(&manifest); err != nil {
+				return manifest, fmt.Errorf("error decoding manifest of tarball %s: %s", tarball, err)
+			}
+			manifestFound = true
+			continue
+		}
+		name := filepath.FromSlash(header.Name)
+		if !filepath.IsLocal(name) {
+			return manifest, fmt.Errorf("invalid file name %s in tarball %s", header.Name, tarball)
+		}
+		if err := extractTarballFile(tarReader, filepath.Join(directory, name)); err != nil {
+			return manifest, fmt.Errorf("error extracting %s from tarball %s: %s", header.Name, tarball, err)
+		}
+	}
+	if !manifestFound {
+		return manifest, fmt.Errorf("manifest not found in tarball %s", tarball)
+	}
+	return manifest, nil
+}
+
+// extractTarballFile writes the current tarball file to the given path
+func extractTarballFile(tarReader *tar.Reader, filename string) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0744); err != nil {
+		return err
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, tarReader)
+	return errors.Join(err, file.Close())
+}
+
+// reindexJSON indexes the documents of a JSON metric file
+func reindexJSON(ctx context.Context, filename string, indexer Indexer) (IndexResult, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return IndexResult{}, err
+	}
+	var documents []interface{}
+	if err := json.Unmarshal(content, &documents); err != nil {
+		return IndexResult{}, fmt.Errorf("JSON decoding error in %s: %s", filename, err)
+	}
+	if len(documents) == 0 {
+		return IndexResult{}, nil
+	}
+	return indexer.IndexWithContext(ctx, documents, IndexingOpts{MetricName: strings.TrimSuffix(filepath.Base(filename), ".json")})
+}
+
+// reindexNDJSON indexes the documents of the NDJSON metric files of a metric in batches
+func reindexNDJSON(ctx context.Context, directory, metricName string, indexer Indexer) (IndexResult, error) {
+	var result IndexResult
+	reader, err := OpenNDJSON(directory, metricName)
+	if err != nil {
+		return result, err
+	}
+	defer reader.Close()
+	var documents []interface{}
+	flush := func() error {
+		if len(documents) == 0 {
+			return nil
+		}
+		batchResult, err := indexer.IndexWithContext(ctx, documents, IndexingOpts{MetricName: metricName})
+		result.Target = batchResult.Target
+		result.add(batchResult)
+		documents = nil
+		return err
+	}
+	for {
+		var document interface{}
+		err := reader.Next(&document)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return result, err
+		}
+		documents = append(documents, document)
+		if len(documents) == reindexBatchSize {
+			if err := flush(); err != nil {
+				return result, err
+			}
+		}
+	}
+	return result, flush()
+}
@@ -0,0 +1,118 @@
+package indexers
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tests for tarball.go", func() {
+	var indexerConfig IndexerConfig
+	var documents []interface{}
+	BeforeEach(func() {
+		indexerConfig = IndexerConfig{
+			Type:             LocalIndexer,
+			MetricsDirectory: GinkgoT().TempDir(),
+			CreateTarball:    true,
+			TarballName:      filepath.Join(GinkgoT().TempDir(), "metrics.tar.gz"),
+		}
+		documents = []interface{}{
+			map[string]interface{}{"metricName": "podLatency", "value": 1},
+			map[string]interface{}{"metricName": "podLatency", "value": 2},
+		}
+	})
+
+	It("packages the metrics directory with a manifest when closed", func() {
+		indexer, err := NewLocalIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		_, err = indexer.Index(documents, IndexingOpts{MetricName: "podLatency"})
+		Expect(err).To(BeNil())
+		ndjsonConfig := indexerConfig
+		ndjsonConfig.Local = LocalConfig{Format: NDJSONFormat, Compression: ZstdCompression, MaxFileSize: 1}
+		ndjsonIndexer, err := NewLocalIndexer(ndjsonConfig)
+		Expect(err).To(BeNil())
+		for _, document := range documents {
+			_, err = ndjsonIndexer.Index([]interface{}{document, document}, IndexingOpts{MetricName: "jobSummary"})
+			Expect(err).To(BeNil())
+		}
+		Expect(indexer.Close()).To(Succeed())
+		manifest, err := extractTarball(indexerConfig.TarballName, GinkgoT().TempDir())
+		Expect(err).To(BeNil())
+		Expect(manifest.Files).To(HaveLen(3))
+		documentCounts := map[string]int{}
+		for _, manifestFile := range manifest.Files {
+			documentCounts[manifestFile.Name] = manifestFile.Documents
+		}
+		Expect(documentCounts).To(Equal(map[string]int{"podLatency.json": 2, "jobSummary.1.ndjson.zst": 2, "jobSummary.ndjson.zst": 2}))
+	})
+
+	It("doesn't create the tarball when CreateTarball isn't set", func() {
+		indexerConfig.CreateTarball = false
+		indexer, err := NewLocalIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		_, err = indexer.Index(documents, IndexingOpts{MetricName: "podLatency"})
+		Expect(err).To(BeNil())
+		Expect(indexer.Close()).To(Succeed())
+		Expect(indexerConfig.TarballName).NotTo(BeAnExistingFile())
+	})
+
+	It("reindexes the tarball into another indexer", func() {
+		indexerConfig.Local = LocalConfig{Format: NDJSONFormat, Compression: GzipCompression, MaxFileSize: 1}
+		indexer, err := NewLocalIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		for _, document := range documents {
+			_, err = indexer.Index([]interface{}{document}, IndexingOpts{MetricName: "podLatency"})
+			Expect(err).To(BeNil())
+		}
+		Expect(indexer.Close()).To(Succeed())
+		server := newBulkMockServer(createdItem)
+		defer server.Close()
+		target, err := NewOpenSearchIndexer(IndexerConfig{Type: OpenSearchIndexer, Servers: []string{server.URL}, Index: "go-commons-test"})
+		Expect(err).To(BeNil())
+		result, err := ReindexTarball(indexerConfig.TarballName, target)
+		Expect(err).To(BeNil())
+		Expect(result.Target).To(Equal("go-commons-test"))
+		Expect(result.Indexed).To(Equal(2))
+		Expect(result.Created).To(Equal(2))
+	})
+
+	It("returns err when reindexing Parquet or CSV metric files", func() {
+		indexerConfig.Local = LocalConfig{Format: CSVFormat}
+		indexer, err := NewLocalIndexer(indexerConfig)
+		Expect(err).To(BeNil())
+		_, err = indexer.Index(documents, IndexingOpts{MetricName: "podLatency"})
+		Expect(err).To(BeNil())
+		Expect(indexer.Close()).To(Succeed())
+		target := &Local{metricsDirectory: GinkgoT().TempDir()}
+		_, err = ReindexTarball(indexerConfig.TarballName, target)
+		Expect(err).To(MatchError("error reindexing podLatency.csv: Parquet and CSV metric files can't be reindexed"))
+		Expect(filepath.Join(target.metricsDirectory, "podLatency.json")).NotTo(BeAnExistingFile())
+	})
+
+	It("returns err when the tarball has no manifest or unsafe file names", func() {
+		writeTarball := func(name string) {
+			file, err := os.Create(indexerConfig.TarballName)
+			Expect(err).To(BeNil())
+			defer file.Close()
+			gzipWriter := gzip.NewWriter(file)
+			defer gzipWriter.Close()
+			tarWriter := tar.NewWriter(gzipWriter)
+			defer tarWriter.Close()
+			content, _ := json.Marshal(documents)
+			Expect(tarWriter.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))})).To(Succeed())
+			_, err = tarWriter.Write(content)
+			Expect(err).To(BeNil())
+		}
+		writeTarball("podLatency.json")
+		_, err := ReindexTarball(indexerConfig.TarballName, &Local{metricsDirectory: indexerConfig.MetricsDirectory})
+		Expect(err).To(MatchError("manifest not found in tarball " + indexerConfig.TarballName))
+		writeTarball("../podLatency.json")
+		_, err = ReindexTarball(indexerConfig.TarballName, &Local{metricsDirectory: indexerConfig.MetricsDirectory})
+		Expect(err).To(MatchError("invalid file name ../podLatency.json in tarball " + indexerConfig.TarballName))
+	})
+})
@@ -1,7 +1,13 @@
 package indexers
 
 import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
 	"net/http/httptest"
+	"strings"
 
 	. "github.com/onsi/ginkgo/v2"
 )
@@ -36,3 +42,60 @@ type indexMethodTestcase struct {
 	documents []interface{}
 	opts      IndexingOpts
 }
+
+// bulkItemResponder builds the response of a single bulk item, given its action and metadata
+type bulkItemResponder func(action string, meta map[string]interface{}) map[string]interface{}
+
+// createdItem acknowledges every bulk item as a created document
+func createdItem(action string, meta map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"_index": meta["_index"], "_id": meta["_id"], "result": "created", "status": 201}
+}
+
+// newBulkMockServer returns a mock ElasticSearch/OpenSearch server answering the
+// bulk API with the responses built by itemResponse
+func newBulkMockServer(itemResponse bulkItemResponder) *httptest.Server {
+	return httptest.NewServer(bulkMockHandler(itemResponse))
+}
+
+// bulkMockHandler handles the requests of the mock ElasticSearch/OpenSearch server, gzip compressed bodies are supported
+func bulkMockHandler(itemResponse bulkItemResponder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/_bulk") {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write(payload)
+			return
+		}
+		body := io.Reader(r.Body)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = zr
+		}
+		var items []map[string]interface{}
+		hasErrors := false
+		scanner := bufio.NewScanner(body)
+		scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+		for scanner.Scan() {
+			var line map[string]map[string]interface{}
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			for action, meta := range line {
+				if action != "delete" {
+					scanner.Scan()
+				}
+				item := itemResponse(action, meta)
+				if status, ok := item["status"].(int); ok && status > 201 {
+					hasErrors = true
+				}
+				items = append(items, map[string]interface{}{action: item})
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"took": 1, "errors": hasErrors, "items": items})
+	}
+}
@@ -17,39 +17,127 @@ package indexers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	gokitlog "github.com/go-kit/log"
-	log "github.com/sirupsen/logrus"
 	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	log "github.com/sirupsen/logrus"
+)
+
+// Default maximum duration of the blocks written from the persistent head, as the Prometheus
+// default maximum block duration
+const defaultMaxBlockDuration = 31 * 24 * time.Hour
+
+// Labels identifying the series of a document, document fields with the same name are exported as exported_<name>
+const (
+	fieldLabel    = "field"
+	quantileLabel = "quantile"
 )
 
+// Prefixes of the label names reserved by Prometheus, and of the document labels renamed to keep them from
+// replacing a reserved or series identifying label
+const (
+	reservedLabelPrefix = "__"
+	exportedLabelPrefix = "exported_"
+)
+
+// seriesLabels label names identifying the series of a document
+var seriesLabels = []string{fieldLabel, quantileLabel, labels.BucketLabel}
+
+// reportedCollisions holds the document fields already reported as colliding with another one once sanitized,
+// so every collision is logged once
+var reportedCollisions sync.Map
+
+// Chunk range of the persistent head. The head rejects samples older than half its chunk range before its
+// latest sample, so it's large enough to accept samples of any time span
+const persistentChunkRange = math.MaxInt64 / 4
+
+// TSDBConfig holds the settings of the TSDB indexer
+type TSDBConfig struct {
+	// Persistent appends the samples of every Index call into a head kept open across calls instead of writing a block
+	// per call. The head is written when the indexer is closed, as the minimal set of non-overlapping blocks covering
+	// the time span of the samples. Samples of a series older than the latest one already appended are dropped
+	Persistent bool `yaml:"persistent"`
+	// MaxBlockDuration maximum duration of the blocks written from the persistent head. Defaults to 31 days
+	MaxBlockDuration time.Duration `yaml:"maxBlockDuration"`
+	// RelabelConfigs Prometheus relabel configs applied in order to the labels of every sample, once metric and label names
+	// are sanitized. They rename, drop or keep labels, or drop whole series, as in the relabel_configs of a scrape job.
+	// Configs built in code should start from relabel.DefaultRelabelConfig
+	RelabelConfigs []*relabel.Config `yaml:"relabelConfigs"`
+	// TimestampField field holding the timestamp of the documents, it can be a dotted path such as metadata.timestamp.
+	// Defaults to timestamp. Timestamps are RFC3339 strings, strings in one of TimestampLayouts, or epoch numbers
+	// in seconds, milliseconds, microseconds or nanoseconds, the unit being inferred from their magnitude
+	TimestampField string `yaml:"timestampField"`
+	// TimestampLayouts Go time layouts, such as 2006-01-02 15:04:05, tried in order before RFC3339 to parse timestamp strings
+	TimestampLayouts []string `yaml:"timestampLayouts"`
+	// LabelFields fields, or dotted prefixes of nested fields, whose values become labels even when they're numbers or booleans.
+	// Defaults to metadata. Other nested fields are flattened as the top level ones: strings become labels, numbers and booleans
+	// become series, such as stats.p99 with the field="stats.p99" label
+	LabelFields []string `yaml:"labelFields"`
+}
+
 // TSDB indexer creates native Prometheus TSDB blocks from indexed documents.
-// Each Index() call writes a complete TSDB block to the metrics directory.
-// It handles two document formats:
+// Each Index() call writes a complete TSDB block to the metrics directory, unless
+// the persistent mode is enabled, then blocks are written once the indexer is closed.
+// It handles four document formats:
 //   - Prometheus-style metrics: documents with "value" (number) and optional "labels" (map)
 //   - Runtime measurements: documents with multiple numeric fields (e.g. latencies),
 //     each numeric field becomes a separate time series with a "field" label.
+//   - Quantile documents: documents with percentile fields such as P99, written as summary series.
+//   - Histogram documents: documents with a "buckets" field, written as classic histogram series.
+//
+// Document fields named as a reserved label, starting with __, or as the field, quantile and le labels
+// identifying the series, become labels with the exported_ prefix.
 type TSDB struct {
 	metricsDirectory string
+	config           TSDBConfig
+	failureThreshold float64
+	// head persistent head, created on the first Index call
+	head     *tsdb.Head
+	chunkDir string
+	lock     sync.Mutex
 }
 
 type tsdbSample struct {
 	labels    labels.Labels
 	timestamp int64
 	value     float64
+	// document position of the document producing the sample in the indexed documents
+	document int
 }
 
 // Fields to skip when decomposing measurement documents into samples.
 var measurementSkipKeys = map[string]bool{
 	"timestamp":  true,
 	"metricName": true,
-	"metadata":   true,
 }
 
+// Default settings of the conversion of documents into samples used when they're not specified in TSDBConfig
+const defaultTimestampField = "timestamp"
+
+var defaultLabelFields = []string{"metadata"}
+
+// Epoch timestamps below these magnitudes are in seconds, milliseconds and microseconds respectively, nanoseconds above
+const (
+	maxEpochSeconds = 1e11
+	maxEpochMillis  = 1e14
+	maxEpochMicros  = 1e17
+)
+
 // NewTSDBIndexer returns a new TSDB indexer that writes Prometheus TSDB blocks
 func NewTSDBIndexer(indexerConfig IndexerConfig) (*TSDB, error) {
 	if indexerConfig.MetricsDirectory == "" {
@@ -58,48 +146,136 @@ func NewTSDBIndexer(indexerConfig IndexerConfig) (*TSDB, error) {
 	if err := os.MkdirAll(indexerConfig.MetricsDirectory, 0744); err != nil {
 		return nil, fmt.Errorf("error creating metrics directory: %v", err)
 	}
+	if indexerConfig.TSDB.MaxBlockDuration < 0 {
+		return nil, fmt.Errorf("invalid maxBlockDuration %v for TSDB indexer", indexerConfig.TSDB.MaxBlockDuration)
+	}
+	if indexerConfig.FailureThreshold < 0 || indexerConfig.FailureThreshold > 1 {
+		return nil, fmt.Errorf("failure threshold must be between 0 and 1")
+	}
+	config, err := indexerConfig.TSDB.withRelabelDefaults("TSDB")
+	if err != nil {
+		return nil, err
+	}
 	return &TSDB{
 		metricsDirectory: indexerConfig.MetricsDirectory,
+		config:           config,
+		failureThreshold: indexerConfig.FailureThreshold,
 	}, nil
 }
 
 // Index converts documents to TSDB samples and writes them as a TSDB block.
-func (t *TSDB) Index(documents []interface{}, opts IndexingOpts) (string, error) {
+func (t *TSDB) Index(documents []interface{}, opts IndexingOpts) (IndexResult, error) {
+	return t.IndexWithContext(context.Background(), documents, opts)
+}
+
+// IndexWithContext converts documents to TSDB samples and writes them as a TSDB block, or appends
+// them to the persistent head in persistent mode. Cancelling the context rolls back the pending samples.
+// Samples that can't be appended, such as duplicate or out of order samples, are reported as failures and
+// a BulkIndexError is returned when they exceed the failure threshold.
+func (t *TSDB) IndexWithContext(ctx context.Context, documents []interface{}, opts IndexingOpts) (IndexResult, error) {
 	if len(documents) == 0 {
-		return "", fmt.Errorf("empty document list in %s", opts.MetricName)
+		return IndexResult{}, fmt.Errorf("empty document list in %s", opts.MetricName)
+	}
+
+	start := time.Now().UTC()
+	samples, indexed, err := t.config.documentSamples(ctx, documents, opts)
+	if err != nil {
+		return IndexResult{}, fmt.Errorf("TSDB indexer: %w", err)
+	}
+
+	if samples = t.config.relabel(samples); len(samples) == 0 {
+		return IndexResult{Target: t.metricsDirectory, Indexed: indexed, Duration: time.Since(start)}, nil
+	}
+
+	result := IndexResult{Target: t.metricsDirectory, Indexed: indexed}
+	if t.config.Persistent {
+		result.Failures, err = t.appendHead(ctx, samples)
+	} else {
+		result.Target, result.Failures, err = t.writeBlock(ctx, samples)
 	}
+	if err != nil {
+		return IndexResult{}, err
+	}
+	result.Failed = len(result.Failures)
+	result.Samples = len(samples) - result.Failed
+	result.Duration = time.Since(start)
+	return result, checkFailureThreshold(result, len(samples), t.failureThreshold)
+}
+
+// withRelabelDefaults returns a copy of the settings with validated relabel configs. The relabel configs are copied
+// before setting their defaults, the ones of the caller are left untouched
+func (c TSDBConfig) withRelabelDefaults(indexerName string) (TSDBConfig, error) {
+	relabelConfigs := make([]*relabel.Config, 0, len(c.RelabelConfigs))
+	for i, relabelConfig := range c.RelabelConfigs {
+		relabelConfig := *relabelConfig
+		if relabelConfig.Regex.Regexp == nil {
+			relabelConfig.Regex = relabel.DefaultRelabelConfig.Regex
+		}
+		if err := relabelConfig.Validate(); err != nil {
+			return c, fmt.Errorf("invalid relabel config %d for %s indexer: %v", i, indexerName, err)
+		}
+		relabelConfigs = append(relabelConfigs, &relabelConfig)
+	}
+	c.RelabelConfigs = relabelConfigs
+	return c, nil
+}
 
+// relabel applies the relabel configs to the samples, dropping the samples of the series they drop
+func (c TSDBConfig) relabel(samples []tsdbSample) []tsdbSample {
+	if len(c.RelabelConfigs) == 0 {
+		return samples
+	}
+	relabeled := samples[:0]
+	for _, s := range samples {
+		lbls, keep := relabel.Process(s.labels, c.RelabelConfigs...)
+		if !keep || lbls.Get(labels.MetricName) == "" {
+			log.Debugf("Series %s dropped by relabeling", s.labels)
+			continue
+		}
+		s.labels = lbls
+		relabeled = append(relabeled, s)
+	}
+	return relabeled
+}
+
+// documentSamples converts the documents to samples, it returns the samples and the number of documents producing them
+func (c TSDBConfig) documentSamples(ctx context.Context, documents []interface{}, opts IndexingOpts) ([]tsdbSample, int, error) {
 	var samples []tsdbSample
-	for _, doc := range documents {
+	var indexed int
+	for i, doc := range documents {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, fmt.Errorf("indexing interrupted: %w", err)
+		}
 		jsonBytes, err := json.Marshal(doc)
 		if err != nil {
-			log.Warnf("TSDB indexer: error marshalling document: %v", err)
+			log.Warnf("Error marshalling document: %v", err)
 			continue
 		}
 		var docMap map[string]interface{}
 		if err := json.Unmarshal(jsonBytes, &docMap); err != nil {
-			log.Warnf("TSDB indexer: error unmarshalling document: %v", err)
+			log.Warnf("Error unmarshalling document: %v", err)
 			continue
 		}
-		samples = append(samples, extractSamples(docMap, opts)...)
+		docSamples := c.extractSamples(docMap, opts)
+		if len(docSamples) > 0 {
+			indexed++
+		}
+		for j := range docSamples {
+			docSamples[j].document = i
+		}
+		samples = append(samples, docSamples...)
 	}
-
 	if len(samples) == 0 {
-		return "", fmt.Errorf("TSDB indexer: no valid samples for %s", opts.MetricName)
-	}
-
-	if err := t.writeBlock(samples); err != nil {
-		return "", err
+		return nil, 0, fmt.Errorf("no valid samples for %s", opts.MetricName)
 	}
-
-	return fmt.Sprintf("TSDB indexer: wrote block with %d samples for %s", len(samples), opts.MetricName), nil
+	return samples, indexed, nil
 }
 
 // extractSamples converts a document map into one or more TSDB samples.
 // Prometheus-style docs (with "value" and optional "labels" map) produce a single sample.
 // Measurement-style docs produce one sample per numeric field.
-func extractSamples(doc map[string]interface{}, opts IndexingOpts) []tsdbSample {
-	ts := extractTimestamp(doc)
+func (c TSDBConfig) extractSamples(doc map[string]interface{}, opts IndexingOpts) []tsdbSample {
+	ts := c.extractTimestamp(doc)
 	if ts == 0 {
 		return nil
 	}
@@ -130,25 +306,39 @@ func extractSamples(doc map[string]interface{}, opts IndexingOpts) []tsdbSample
 		}
 	}
 
+	stringFields, numericFields := c.documentFields(doc)
+
+	// Bucketed histogram documents: classic histogram series
+	if samples := histogramSamples(metricName, ts, doc[bucketsField], stringFields, numericFields); samples != nil {
+		return samples
+	}
+
+	// Quantile documents: summary series
+	if samples := summarySamples(metricName, ts, stringFields, numericFields); samples != nil {
+		return samples
+	}
+
 	// Runtime measurement style: decompose numeric fields into separate samples
-	return measurementSamples(metricName, ts, doc)
+	return measurementSamples(metricName, ts, stringFields, numericFields)
 }
 
 // promStyleSample creates a single TSDB sample from a prometheus-style document.
 func promStyleSample(metricName string, labelsMap map[string]interface{}, value float64, ts int64, doc map[string]interface{}) []tsdbSample {
 	b := labels.NewBuilder(labels.EmptyLabels())
-	b.Set(labels.MetricName, metricName)
+	stringLabels := make(map[string]string, len(labelsMap))
 	for k, v := range labelsMap {
 		if sv, ok := v.(string); ok {
-			b.Set(k, sv)
+			stringLabels[k] = sv
 		}
 	}
+	setDocumentLabels(b, stringLabels, nil)
 	if uuid, ok := doc["uuid"].(string); ok && uuid != "" {
 		b.Set("uuid", uuid)
 	}
 	if jobName, ok := doc["jobName"].(string); ok && jobName != "" {
 		b.Set("job_name", jobName)
 	}
+	b.Set(labels.MetricName, sanitizeMetricName(metricName))
 	return []tsdbSample{{
 		labels:    b.Labels(),
 		timestamp: ts,
@@ -159,7 +349,22 @@ func promStyleSample(metricName string, labelsMap map[string]interface{}, value
 // measurementSamples decomposes a measurement document into multiple TSDB samples.
 // Each numeric field becomes a separate sample with a "field" label identifying it.
 // All string fields become labels on every sample.
-func measurementSamples(metricName string, ts int64, doc map[string]interface{}) []tsdbSample {
+func measurementSamples(metricName string, ts int64, stringFields map[string]string, numericFields map[string]float64) []tsdbSample {
+	if len(numericFields) == 0 {
+		return nil
+	}
+
+	var samples []tsdbSample
+	for field, value := range numericFields {
+		samples = append(samples, fieldSample(metricName, field, value, ts, stringFields))
+	}
+	return samples
+}
+
+// documentFields splits the fields of a measurement document into the non-empty string fields and the numeric ones.
+// Nested fields are flattened into their dotted path, booleans are numeric fields valued 1 or 0, and every
+// value of the label fields is a string field
+func (c TSDBConfig) documentFields(doc map[string]interface{}) (map[string]string, map[string]float64) {
 	stringFields := map[string]string{}
 	numericFields := map[string]float64{}
 
@@ -167,39 +372,100 @@ func measurementSamples(metricName string, ts int64, doc map[string]interface{})
 		if measurementSkipKeys[k] {
 			continue
 		}
-		switch val := v.(type) {
+		c.flattenFields(k, v, stringFields, numericFields)
+	}
+	return stringFields, numericFields
+}
+
+// flattenFields adds the field, or the leaves of a nested field, to the string or numeric fields
+func (c TSDBConfig) flattenFields(name string, value interface{}, stringFields map[string]string, numericFields map[string]float64) {
+	if name == c.timestampField() {
+		return
+	}
+	if nested, ok := value.(map[string]interface{}); ok {
+		for k, v := range nested {
+			c.flattenFields(name+"."+k, v, stringFields, numericFields)
+		}
+		return
+	}
+	if c.isLabelField(name) {
+		switch val := value.(type) {
 		case string:
 			if val != "" {
-				stringFields[k] = val
+				stringFields[name] = val
 			}
 		case float64:
-			numericFields[k] = val
+			stringFields[name] = strconv.FormatFloat(val, 'f', -1, 64)
+		case bool:
+			stringFields[name] = strconv.FormatBool(val)
 		}
+		return
 	}
+	switch val := value.(type) {
+	case string:
+		if val != "" {
+			stringFields[name] = val
+		}
+	case float64:
+		numericFields[name] = val
+	case bool:
+		if val {
+			numericFields[name] = 1
+		} else {
+			numericFields[name] = 0
+		}
+	}
+}
 
-	if len(numericFields) == 0 {
-		return nil
+// isLabelField returns true when the field is one of the label fields, or nested in one of them
+func (c TSDBConfig) isLabelField(name string) bool {
+	labelFields := c.LabelFields
+	if labelFields == nil {
+		labelFields = defaultLabelFields
 	}
+	for _, labelField := range labelFields {
+		if name == labelField || strings.HasPrefix(name, labelField+".") {
+			return true
+		}
+	}
+	return false
+}
 
-	var samples []tsdbSample
-	for field, value := range numericFields {
-		b := labels.NewBuilder(labels.EmptyLabels())
-		b.Set(labels.MetricName, metricName)
-		b.Set("field", field)
-		for k, v := range stringFields {
-			b.Set(k, v)
-		}
-		samples = append(samples, tsdbSample{
-			labels:    b.Labels(),
-			timestamp: ts,
-			value:     value,
-		})
+// timestampField returns the field holding the timestamp of the documents
+func (c TSDBConfig) timestampField() string {
+	if c.TimestampField == "" {
+		return defaultTimestampField
+	}
+	return c.TimestampField
+}
+
+// fieldSample creates the sample of a numeric field of a measurement document, labelled with the field name
+func fieldSample(metricName, field string, value float64, ts int64, stringFields map[string]string) tsdbSample {
+	return seriesSample(metricName, ts, value, stringFields, labels.Label{Name: fieldLabel, Value: field})
+}
+
+// seriesSample creates a sample of the given series, labelled with the string fields of the document and the extra labels.
+// The extra labels and the metric name are set last, so the document fields can't replace them
+func seriesSample(name string, ts int64, value float64, stringFields map[string]string, extraLabels ...labels.Label) tsdbSample {
+	b := labels.NewBuilder(labels.EmptyLabels())
+	setDocumentLabels(b, stringFields, seriesLabels)
+	for _, l := range extraLabels {
+		b.Set(l.Name, l.Value)
+	}
+	b.Set(labels.MetricName, sanitizeMetricName(name))
+	return tsdbSample{
+		labels:    b.Labels(),
+		timestamp: ts,
+		value:     value,
 	}
-	return samples
 }
 
-// writeBlock writes all samples as a single TSDB block to the metrics directory.
-func (t *TSDB) writeBlock(samples []tsdbSample) error {
+// Number of appended samples between context checks in writeBlock.
+const tsdbCtxCheckInterval = 1000
+
+// writeBlock writes all samples as a single TSDB block to the metrics directory and returns the block path,
+// along with the samples that couldn't be appended. No block is written when none of them could.
+func (t *TSDB) writeBlock(ctx context.Context, samples []tsdbSample) (string, []DocumentFailure, error) {
 	minTime := samples[0].timestamp
 	maxTime := samples[0].timestamp
 	for _, s := range samples[1:] {
@@ -218,7 +484,7 @@ func (t *TSDB) writeBlock(samples []tsdbSample) error {
 
 	w, err := tsdb.NewBlockWriter(gokitlog.NewNopLogger(), t.metricsDirectory, blockDuration)
 	if err != nil {
-		return fmt.Errorf("error creating TSDB block writer: %v", err)
+		return "", nil, fmt.Errorf("error creating TSDB block writer: %v", err)
 	}
 	defer func() {
 		if closeErr := w.Close(); closeErr != nil {
@@ -226,35 +492,221 @@ func (t *TSDB) writeBlock(samples []tsdbSample) error {
 		}
 	}()
 
-	app := w.Appender(context.Background())
-	for _, s := range samples {
+	failures, err := appendSamples(ctx, w.Appender(ctx), samples)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(failures) == len(samples) {
+		return t.metricsDirectory, failures, nil
+	}
+
+	blockID, err := w.Flush(ctx)
+	if err != nil {
+		return "", nil, fmt.Errorf("error flushing TSDB block: %v", err)
+	}
+
+	log.Infof("TSDB indexer: created block %s with %d samples", blockID, len(samples)-len(failures))
+	return filepath.Join(t.metricsDirectory, blockID.String()), failures, nil
+}
+
+// appendSamples appends the samples in timestamp order and commits them, it returns the samples that
+// couldn't be appended, identified by their series and timestamp. The samples are rolled back when the context is cancelled
+func appendSamples(ctx context.Context, app storage.Appender, samples []tsdbSample) ([]DocumentFailure, error) {
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].timestamp < samples[j].timestamp
+	})
+	var failures []DocumentFailure
+	for i, s := range samples {
+		if i%tsdbCtxCheckInterval == 0 && ctx.Err() != nil {
+			if err := app.Rollback(); err != nil {
+				log.Infof("TSDB indexer: error rolling back samples: %v", err)
+			}
+			return nil, fmt.Errorf("TSDB indexer: indexing interrupted: %w", ctx.Err())
+		}
 		if _, err := app.Append(0, s.labels, s.timestamp, s.value); err != nil {
-			log.Infof("TSDB indexer: error appending sample: %v", err)
+			log.Debugf("TSDB indexer: error appending sample: %v", err)
+			failures = append(failures, DocumentFailure{DocumentID: fmt.Sprintf("%s@%d", s.labels, s.timestamp), Reason: err.Error()})
 		}
 	}
 
 	if err := app.Commit(); err != nil {
-		return fmt.Errorf("error committing TSDB samples: %v", err)
+		return nil, fmt.Errorf("error committing TSDB samples: %v", err)
+	}
+	if len(failures) > 0 {
+		log.Warnf("TSDB indexer: %d out of %d samples couldn't be appended", len(failures), len(samples))
 	}
+	return failures, nil
+}
 
-	blockID, err := w.Flush(context.Background())
-	if err != nil {
-		return fmt.Errorf("error flushing TSDB block: %v", err)
+// appendHead appends the samples to the persistent head, creating it when needed. It returns the samples that couldn't be appended
+func (t *TSDB) appendHead(ctx context.Context, samples []tsdbSample) ([]DocumentFailure, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.head == nil {
+		chunkDir, err := os.MkdirTemp("", "tsdb-head")
+		if err != nil {
+			return nil, fmt.Errorf("error creating TSDB head: %v", err)
+		}
+		opts := tsdb.DefaultHeadOptions()
+		opts.ChunkRange = persistentChunkRange
+		opts.ChunkDirRoot = chunkDir
+		head, err := tsdb.NewHead(nil, gokitlog.NewNopLogger(), nil, nil, opts, tsdb.NewHeadStats())
+		if err == nil {
+			err = head.Init(math.MinInt64)
+		}
+		if err != nil {
+			os.RemoveAll(chunkDir)
+			return nil, fmt.Errorf("error creating TSDB head: %v", err)
+		}
+		t.head, t.chunkDir = head, chunkDir
 	}
+	return appendSamples(ctx, t.head.Appender(ctx), samples)
+}
 
-	log.Infof("TSDB indexer: created block %s with %d samples", blockID, len(samples))
+// Close writes the samples of the persistent head as blocks spanning from the earliest to the latest sample,
+// split into consecutive blocks of at most MaxBlockDuration. It's a no-op when the persistent mode isn't enabled
+func (t *TSDB) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.head == nil {
+		return nil
+	}
+	head, chunkDir := t.head, t.chunkDir
+	t.head, t.chunkDir = nil, ""
+	err := t.writeHead(head)
+	err = errors.Join(err, head.Close(), os.RemoveAll(chunkDir))
+	return err
+}
+
+// writeHead writes the samples of the head as non-overlapping blocks aligned to their time span
+func (t *TSDB) writeHead(head *tsdb.Head) error {
+	if head.NumSeries() == 0 {
+		return nil
+	}
+	maxBlockDuration := t.config.MaxBlockDuration.Milliseconds()
+	if maxBlockDuration <= 0 {
+		maxBlockDuration = defaultMaxBlockDuration.Milliseconds()
+	}
+	compactor, err := tsdb.NewLeveledCompactor(context.Background(), nil, gokitlog.NewNopLogger(), []int64{maxBlockDuration}, chunkenc.NewPool(), nil)
+	if err != nil {
+		return fmt.Errorf("error creating TSDB compactor: %v", err)
+	}
+	// Block intervals are half-open, the last block ends a millisecond after the latest sample
+	minTime, maxTime := head.MinTime(), head.MaxTime()+1
+	for blockStart := minTime; blockStart < maxTime; blockStart += maxBlockDuration {
+		blockEnd := min(blockStart+maxBlockDuration, maxTime)
+		blockIDs, err := compactor.Write(t.metricsDirectory, tsdb.NewRangeHead(head, blockStart, blockEnd-1), blockStart, blockEnd, nil)
+		if err != nil {
+			return fmt.Errorf("error writing TSDB block: %v", err)
+		}
+		for _, blockID := range blockIDs {
+			log.Infof("TSDB indexer: created block %s from %v to %v", blockID, time.UnixMilli(blockStart).UTC(), time.UnixMilli(blockEnd).UTC())
+		}
+	}
 	return nil
 }
 
-// extractTimestamp parses the "timestamp" field from a document map.
-func extractTimestamp(doc map[string]interface{}) int64 {
-	tsRaw, ok := doc["timestamp"]
-	if ok {
-		for _, layout := range []string{time.RFC3339Nano, time.RFC3339} {
-			if t, err := time.Parse(layout, tsRaw.(string)); err == nil {
+// setDocumentLabels sets the labels of the given document fields. Label names are sanitized, the ones reserved by
+// Prometheus, starting with __, and the reserved ones given get the exported_ prefix. When the names of several fields
+// collide, the first field in sorted order is kept and the collision is reported
+func setDocumentLabels(b *labels.Builder, fields map[string]string, reserved []string) {
+	labelFields := make(map[string]string, len(fields))
+	for _, field := range sortedKeys(fields) {
+		name := sanitizeLabelName(field)
+		if strings.HasPrefix(name, reservedLabelPrefix) || slices.Contains(reserved, name) {
+			name = exportedLabelPrefix + name
+		}
+		if kept, ok := labelFields[name]; ok {
+			if _, reported := reportedCollisions.LoadOrStore(field, true); !reported {
+				log.Warnf("TSDB indexer: fields %s and %s both map to label %s, dropping %s", kept, field, name, field)
+			}
+			continue
+		}
+		labelFields[name] = field
+		b.Set(name, fields[field])
+	}
+}
+
+// sanitizeMetricName replaces the characters not allowed in Prometheus metric names with underscores,
+// metric names match [a-zA-Z_:][a-zA-Z0-9_:]*
+func sanitizeMetricName(name string) string {
+	return sanitizeName(name, true)
+}
+
+// sanitizeLabelName replaces the characters not allowed in Prometheus label names with underscores,
+// label names match [a-zA-Z_][a-zA-Z0-9_]*
+func sanitizeLabelName(name string) string {
+	return sanitizeName(name, false)
+}
+
+// sanitizeName replaces the invalid characters of a metric or label name with underscores,
+// names starting with a digit are prefixed with an underscore
+func sanitizeName(name string, allowColons bool) string {
+	if name == "" {
+		return "_"
+	}
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':' && allowColons:
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// extractTimestamp parses the timestamp field from a document map and returns it in milliseconds,
+// 0 when it's missing or invalid.
+func (c TSDBConfig) extractTimestamp(doc map[string]interface{}) int64 {
+	switch ts := lookupField(doc, c.timestampField()).(type) {
+	case string:
+		for _, layout := range slices.Concat(c.TimestampLayouts, []string{time.RFC3339Nano, time.RFC3339}) {
+			if t, err := time.Parse(layout, ts); err == nil {
 				return t.UnixMilli()
 			}
 		}
+		if epoch, err := strconv.ParseFloat(ts, 64); err == nil {
+			return epochMillis(epoch)
+		}
+	case float64:
+		return epochMillis(ts)
 	}
 	return 0
 }
+
+// epochMillis converts an epoch timestamp to milliseconds, inferring its unit from its magnitude. The result
+// is rounded since large epochs, nanoseconds in particular, aren't exactly represented as float64
+func epochMillis(epoch float64) int64 {
+	switch abs := math.Abs(epoch); {
+	case abs < maxEpochSeconds:
+		return int64(math.Round(epoch * 1e3))
+	case abs < maxEpochMillis:
+		return int64(math.Round(epoch))
+	case abs < maxEpochMicros:
+		return int64(math.Round(epoch / 1e3))
+	}
+	return int64(math.Round(epoch / 1e6))
+}
+
+// lookupField returns the value of a field of the document given its dotted path, nil when it's missing
+func lookupField(doc map[string]interface{}, path string) interface{} {
+	if value, ok := doc[path]; ok {
+		return value
+	}
+	name, rest, found := strings.Cut(path, ".")
+	if !found {
+		return nil
+	}
+	nested, ok := doc[name].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	return lookupField(nested, rest)
+}
@@ -0,0 +1,175 @@
+// Copyright 2024 The go-commons Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexers
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// Fields of the quantile and histogram documents
+const (
+	bucketsField = "buckets"
+	sumField     = "sum"
+	countField   = "count"
+	avgField     = "avg"
+)
+
+// percentileField matches the percentile fields of quantile documents, such as P99, P95 or p99.9
+var percentileField = regexp.MustCompile(`^[Pp]([0-9]{1,2}(\.[0-9]+)?)$`)
+
+// summarySamples converts a quantile document, such as the latency quantiles of kube-burner, into the series of a
+// Prometheus summary: every percentile field becomes a sample of the metric with its quantile label, the sum and count
+// fields become the _sum and _count series. When the document has an average but no sum, the sum is derived from it.
+// The remaining numeric fields, such as min and max, are decomposed as in measurement documents.
+// It returns nil when the document has no percentile field
+func summarySamples(metricName string, ts int64, stringFields map[string]string, numericFields map[string]float64) []tsdbSample {
+	var samples []tsdbSample
+	for field, value := range numericFields {
+		if quantile, ok := percentileQuantile(field); ok {
+			samples = append(samples, seriesSample(metricName, ts, value, stringFields, labels.Label{Name: quantileLabel, Value: quantile}))
+		}
+	}
+	if len(samples) == 0 {
+		return nil
+	}
+	count, hasCount := numericFields[countField]
+	sum, hasSum := numericFields[sumField]
+	if avg, hasAvg := numericFields[avgField]; !hasSum && hasAvg && hasCount {
+		sum, hasSum = avg*count, true
+	}
+	if hasSum {
+		samples = append(samples, seriesSample(metricName+"_sum", ts, sum, stringFields))
+	}
+	if hasCount {
+		samples = append(samples, seriesSample(metricName+"_count", ts, count, stringFields))
+	}
+	for field, value := range numericFields {
+		if _, ok := percentileQuantile(field); ok || field == sumField || field == countField {
+			continue
+		}
+		samples = append(samples, fieldSample(metricName, field, value, ts, stringFields))
+	}
+	return samples
+}
+
+// percentileQuantile returns the quantile label of a percentile field, 0.99 for P99
+func percentileQuantile(field string) (string, bool) {
+	match := percentileField.FindStringSubmatch(field)
+	if match == nil {
+		return "", false
+	}
+	percentile, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return "", false
+	}
+	return strconv.FormatFloat(percentile/100, 'g', 12, 64), true
+}
+
+type histogramBucket struct {
+	upperBound float64
+	count      float64
+}
+
+// histogramSamples converts a bucketed histogram document into the series of a Prometheus classic histogram, so
+// histogram_quantile can be used on them. The buckets field holds the cumulative count of every bucket, either as a
+// map of upper bound to count such as {"0.5": 3, "1": 7, "+Inf": 9}, or as a list of objects such as {"le": 0.5, "count": 3}.
+// Every bucket becomes a sample of the <metric>_bucket series with its le label, the +Inf bucket being added from the count
+// field, or from the largest bucket, when missing. The sum and count fields become the _sum and _count series.
+// It returns nil when the document has no valid buckets
+func histogramSamples(metricName string, ts int64, rawBuckets interface{}, stringFields map[string]string, numericFields map[string]float64) []tsdbSample {
+	buckets := histogramBuckets(rawBuckets)
+	if len(buckets) == 0 {
+		return nil
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].upperBound < buckets[j].upperBound
+	})
+	count, hasCount := numericFields[countField]
+	if last := buckets[len(buckets)-1]; !math.IsInf(last.upperBound, 1) {
+		if !hasCount {
+			count = last.count
+		}
+		buckets = append(buckets, histogramBucket{upperBound: math.Inf(1), count: count})
+	} else if !hasCount {
+		count = last.count
+	}
+	var samples []tsdbSample
+	for _, bucket := range buckets {
+		le := labels.Label{Name: labels.BucketLabel, Value: formatUpperBound(bucket.upperBound)}
+		samples = append(samples, seriesSample(metricName+"_bucket", ts, bucket.count, stringFields, le))
+	}
+	samples = append(samples, seriesSample(metricName+"_count", ts, count, stringFields))
+	if sum, hasSum := numericFields[sumField]; hasSum {
+		samples = append(samples, seriesSample(metricName+"_sum", ts, sum, stringFields))
+	}
+	return samples
+}
+
+// histogramBuckets parses the buckets of a histogram document, invalid buckets are ignored
+func histogramBuckets(raw interface{}) []histogramBucket {
+	var buckets []histogramBucket
+	switch rawBuckets := raw.(type) {
+	case map[string]interface{}:
+		for le, count := range rawBuckets {
+			upperBound, ok := parseUpperBound(le)
+			countValue, isNumber := count.(float64)
+			if ok && isNumber {
+				buckets = append(buckets, histogramBucket{upperBound: upperBound, count: countValue})
+			}
+		}
+	case []interface{}:
+		for _, rawBucket := range rawBuckets {
+			bucket, ok := rawBucket.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			var upperBound float64
+			switch le := bucket[labels.BucketLabel].(type) {
+			case float64:
+				upperBound = le
+			case string:
+				if upperBound, ok = parseUpperBound(le); !ok {
+					continue
+				}
+			default:
+				continue
+			}
+			if count, isNumber := bucket[countField].(float64); isNumber {
+				buckets = append(buckets, histogramBucket{upperBound: upperBound, count: count})
+			}
+		}
+	}
+	return buckets
+}
+
+// parseUpperBound parses the upper bound of a bucket, +Inf included
+func parseUpperBound(le string) (float64, bool) {
+	upperBound, err := strconv.ParseFloat(strings.TrimSpace(le), 64)
+	return upperBound, err == nil && !math.IsNaN(upperBound)
+}
+
+// formatUpperBound formats the upper bound of a bucket as Prometheus does for the le label
+func formatUpperBound(upperBound float64) string {
+	if math.IsInf(upperBound, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(upperBound, 'g', -1, 64)
+}
@@ -1,14 +1,22 @@
 package indexers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/tsdb"
 )
 
 var _ = Describe("Tests for tsdb.go", func() {
@@ -18,6 +26,11 @@ var _ = Describe("Tests for tsdb.go", func() {
 			Expect(err).To(MatchError("metricsDirectory not specified for TSDB indexer"))
 		})
 
+		It("returns error when the failure threshold isn't between 0 and 1", func() {
+			_, err := NewTSDBIndexer(IndexerConfig{Type: TSDBIndexer, MetricsDirectory: GinkgoT().TempDir(), FailureThreshold: 1.5})
+			Expect(err).To(MatchError("failure threshold must be between 0 and 1"))
+		})
+
 		It("creates indexer and directory successfully", func() {
 			dir := filepath.Join(os.TempDir(), "tsdb-test-new")
 			defer func() { Expect(os.RemoveAll(dir)).To(Succeed()) }()
@@ -77,12 +90,30 @@ var _ = Describe("Tests for tsdb.go", func() {
 			}
 			resp, err := indexer.Index(docs, IndexingOpts{MetricName: "cpuUsage"})
 			Expect(err).To(BeNil())
-			Expect(resp).To(ContainSubstring("wrote block with 2 samples"))
+			Expect(resp.Samples).To(Equal(2))
+			Expect(resp.Indexed).To(Equal(2))
+			Expect(filepath.Dir(resp.Target)).To(Equal(dir))
 
 			// Verify a TSDB block directory was created
 			verifyBlockExists(dir)
 		})
 
+		It("does not write a block when the context is cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			docs := []interface{}{
+				map[string]interface{}{
+					"timestamp": time.Now().UTC().Format(time.RFC3339Nano),
+					"value":     1.0,
+				},
+			}
+			_, err := indexer.IndexWithContext(ctx, docs, IndexingOpts{MetricName: "test"})
+			Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+			entries, err := os.ReadDir(dir)
+			Expect(err).To(BeNil())
+			Expect(entries).To(BeEmpty())
+		})
+
 		It("skips documents with zero timestamp", func() {
 			docs := []interface{}{
 				map[string]interface{}{
@@ -133,8 +164,8 @@ var _ = Describe("Tests for tsdb.go", func() {
 			}
 			resp, err := indexer.Index(docs, IndexingOpts{MetricName: "podLatencyMeasurement"})
 			Expect(err).To(BeNil())
-			// 4 latency fields + jobIteration-like fields if any
-			Expect(resp).To(ContainSubstring("wrote block with"))
+			// 4 latency fields
+			Expect(resp.Samples).To(Equal(4))
 			verifyBlockExists(dir)
 		})
 
@@ -158,7 +189,7 @@ var _ = Describe("Tests for tsdb.go", func() {
 			resp, err := indexer.Index(docs, IndexingOpts{MetricName: "podLatencyQuantilesMeasurement"})
 			Expect(err).To(BeNil())
 			// 6 numeric fields: P99, P95, P50, min, max, avg
-			Expect(resp).To(ContainSubstring("wrote block with 6 samples"))
+			Expect(resp.Samples).To(Equal(6))
 			verifyBlockExists(dir)
 		})
 
@@ -184,7 +215,7 @@ var _ = Describe("Tests for tsdb.go", func() {
 				"value":     1.0,
 				"labels":    map[string]interface{}{},
 			}
-			samples := extractSamples(doc, IndexingOpts{MetricName: "myMetric"})
+			samples := TSDBConfig{}.extractSamples(doc, IndexingOpts{MetricName: "myMetric"})
 			Expect(samples).To(HaveLen(1))
 			Expect(samples[0].labels.Get("__name__")).To(Equal("myMetric"))
 		})
@@ -197,7 +228,7 @@ var _ = Describe("Tests for tsdb.go", func() {
 				"uuid":      "test-uuid",
 				"jobName":   "test-job",
 			}
-			samples := extractSamples(doc, IndexingOpts{MetricName: "simpleMetric"})
+			samples := TSDBConfig{}.extractSamples(doc, IndexingOpts{MetricName: "simpleMetric"})
 			Expect(samples).To(HaveLen(1))
 			Expect(samples[0].labels.Get("__name__")).To(Equal("simpleMetric"))
 			Expect(samples[0].value).To(Equal(42.5))
@@ -212,7 +243,7 @@ var _ = Describe("Tests for tsdb.go", func() {
 				"schedulingLatency": 100.0,
 				"namespace":         "default",
 			}
-			samples := extractSamples(doc, IndexingOpts{MetricName: "podLatency"})
+			samples := TSDBConfig{}.extractSamples(doc, IndexingOpts{MetricName: "podLatency"})
 			Expect(samples).To(HaveLen(1))
 			Expect(samples[0].labels.Get("__name__")).To(Equal("podLatency"))
 			Expect(samples[0].labels.Get("field")).To(Equal("schedulingLatency"))
@@ -230,7 +261,7 @@ var _ = Describe("Tests for tsdb.go", func() {
 				"uuid":         "abc",
 				"jobName":      "test",
 			}
-			samples := extractSamples(doc, IndexingOpts{MetricName: "quantiles"})
+			samples := TSDBConfig{}.extractSamples(doc, IndexingOpts{MetricName: "quantiles"})
 			Expect(samples).To(HaveLen(2))
 			for _, s := range samples {
 				Expect(s.labels.Get("quantileName")).To(Equal("Ready"))
@@ -240,6 +271,412 @@ var _ = Describe("Tests for tsdb.go", func() {
 		})
 	})
 
+	Context("Timestamps and nested fields", func() {
+		ts := time.Date(2024, 5, 1, 10, 0, 0, 123000000, time.UTC)
+
+		It("parses epoch timestamps in seconds, milliseconds, microseconds and nanoseconds", func() {
+			for _, timestamp := range []interface{}{
+				float64(ts.UnixMilli()) / 1e3,
+				float64(ts.UnixMilli()),
+				float64(ts.UnixMicro()),
+				float64(ts.UnixNano()),
+				fmt.Sprint(ts.UnixMilli()),
+			} {
+				Expect(TSDBConfig{}.extractTimestamp(map[string]interface{}{"timestamp": timestamp})).To(Equal(ts.UnixMilli()), fmt.Sprint(timestamp))
+			}
+		})
+
+		It("parses custom layouts and a custom timestamp field", func() {
+			config := TSDBConfig{TimestampField: "metadata.startTime", TimestampLayouts: []string{"2006-01-02 15:04:05.000"}}
+			doc := map[string]interface{}{
+				"timestamp": "invalid",
+				"metadata":  map[string]interface{}{"startTime": "2024-05-01 10:00:00.123"},
+			}
+			Expect(config.extractTimestamp(doc)).To(Equal(ts.UnixMilli()))
+			Expect(TSDBConfig{}.extractTimestamp(map[string]interface{}{"timestamp": ts.Format(time.RFC3339Nano)})).To(Equal(ts.UnixMilli()))
+		})
+
+		It("ignores timestamps of an unsupported type", func() {
+			for _, timestamp := range []interface{}{true, nil, map[string]interface{}{}, "not a timestamp"} {
+				doc := map[string]interface{}{"timestamp": timestamp, "value": 1.0}
+				Expect(TSDBConfig{}.extractTimestamp(doc)).To(BeZero())
+				Expect(TSDBConfig{}.extractSamples(doc, IndexingOpts{MetricName: "test"})).To(BeEmpty())
+			}
+		})
+
+		It("flattens nested fields into labels and series", func() {
+			doc := map[string]interface{}{
+				"timestamp": float64(ts.Unix()),
+				"podName":   "pod-1",
+				"ready":     true,
+				"stats":     map[string]interface{}{"p99": 10.0, "phase": "Running"},
+				"metadata":  map[string]interface{}{"platform": "AWS", "nodes": 3.0, "sdn": map[string]interface{}{"ovn": true}},
+			}
+			values := make(map[string]float64)
+			for _, s := range (TSDBConfig{}).extractSamples(doc, IndexingOpts{MetricName: "podStatus"}) {
+				Expect(s.timestamp).To(Equal(ts.Unix() * 1000))
+				values[s.labels.String()] = s.value
+			}
+			commonLabels := `metadata_nodes="3", metadata_platform="AWS", metadata_sdn_ovn="true", podName="pod-1", stats_phase="Running"`
+			Expect(values).To(Equal(map[string]float64{
+				`{__name__="podStatus", field="ready", ` + commonLabels + `}`:     1,
+				`{__name__="podStatus", field="stats.p99", ` + commonLabels + `}`: 10,
+			}))
+		})
+
+		It("uses the configured label fields", func() {
+			doc := map[string]interface{}{
+				"timestamp": ts.Format(time.RFC3339),
+				"node":      map[string]interface{}{"cpus": 8.0, "load": 0.5},
+				"metadata":  map[string]interface{}{"nodes": 3.0},
+			}
+			samples := TSDBConfig{LabelFields: []string{"node.cpus"}}.extractSamples(doc, IndexingOpts{MetricName: "nodeLoad"})
+			fields := make(map[string]string)
+			for _, s := range samples {
+				Expect(s.labels.Get("node_cpus")).To(Equal("8"))
+				fields[s.labels.Get("field")] = fmt.Sprint(s.value)
+			}
+			Expect(fields).To(Equal(map[string]string{"node.load": "0.5", "metadata.nodes": "3"}))
+		})
+	})
+
+	Context("extractSamples() with quantile and histogram documents", func() {
+		now := time.Now().UTC()
+
+		seriesValues := func(samples []tsdbSample) map[string]float64 {
+			values := make(map[string]float64)
+			for _, s := range samples {
+				values[s.labels.String()] = s.value
+			}
+			return values
+		}
+
+		It("writes percentile fields as summary series", func() {
+			doc := map[string]interface{}{
+				"timestamp":    now.Format(time.RFC3339Nano),
+				"quantileName": "Ready",
+				"P99":          500.0,
+				"P99.9":        550.0,
+				"P50":          200.0,
+				"max":          600.0,
+				"avg":          250.0,
+				"count":        10.0,
+			}
+			Expect(seriesValues(TSDBConfig{}.extractSamples(doc, IndexingOpts{MetricName: "podLatency"}))).To(Equal(map[string]float64{
+				`{__name__="podLatency", quantile="0.99", quantileName="Ready"}`:  500,
+				`{__name__="podLatency", quantile="0.999", quantileName="Ready"}`: 550,
+				`{__name__="podLatency", quantile="0.5", quantileName="Ready"}`:   200,
+				`{__name__="podLatency_sum", quantileName="Ready"}`:               2500,
+				`{__name__="podLatency_count", quantileName="Ready"}`:             10,
+				`{__name__="podLatency", field="max", quantileName="Ready"}`:      600,
+				`{__name__="podLatency", field="avg", quantileName="Ready"}`:      250,
+			}))
+		})
+
+		It("writes bucket maps as classic histogram series", func() {
+			doc := map[string]interface{}{
+				"timestamp": now.Format(time.RFC3339Nano),
+				"buckets":   map[string]interface{}{"1": 2.0, "0.5": 1.0, "5": 9.0},
+				"sum":       12.5,
+				"count":     10.0,
+				"phase":     "Ready",
+			}
+			Expect(seriesValues(TSDBConfig{}.extractSamples(doc, IndexingOpts{MetricName: "latency"}))).To(Equal(map[string]float64{
+				`{__name__="latency_bucket", le="0.5", phase="Ready"}`:  1,
+				`{__name__="latency_bucket", le="1", phase="Ready"}`:    2,
+				`{__name__="latency_bucket", le="5", phase="Ready"}`:    9,
+				`{__name__="latency_bucket", le="+Inf", phase="Ready"}`: 10,
+				`{__name__="latency_count", phase="Ready"}`:             10,
+				`{__name__="latency_sum", phase="Ready"}`:               12.5,
+			}))
+		})
+
+		It("writes bucket lists as classic histogram series", func() {
+			doc := map[string]interface{}{
+				"timestamp": now.Format(time.RFC3339Nano),
+				"buckets": []interface{}{
+					map[string]interface{}{"le": 0.1, "count": 4.0},
+					map[string]interface{}{"le": "+Inf", "count": 6.0},
+					map[string]interface{}{"le": "invalid", "count": 1.0},
+				},
+			}
+			Expect(seriesValues(TSDBConfig{}.extractSamples(doc, IndexingOpts{MetricName: "latency"}))).To(Equal(map[string]float64{
+				`{__name__="latency_bucket", le="0.1"}`:  4,
+				`{__name__="latency_bucket", le="+Inf"}`: 6,
+				`{__name__="latency_count"}`:             6,
+			}))
+		})
+
+		It("writes blocks histogram_quantile can be evaluated on", func() {
+			dir := filepath.Join(os.TempDir(), "tsdb-test-histogram")
+			defer func() { Expect(os.RemoveAll(dir)).To(Succeed()) }()
+			indexer, err := NewTSDBIndexer(IndexerConfig{Type: TSDBIndexer, MetricsDirectory: dir})
+			Expect(err).To(BeNil())
+			_, err = indexer.Index([]interface{}{
+				map[string]interface{}{
+					"timestamp": now.Format(time.RFC3339Nano),
+					"buckets":   map[string]interface{}{"1": 0.0, "2": 10.0, "+Inf": 10.0},
+				},
+			}, IndexingOpts{MetricName: "latency"})
+			Expect(err).To(BeNil())
+
+			db, err := tsdb.OpenDBReadOnly(dir, "", nil)
+			Expect(err).To(BeNil())
+			defer db.Close()
+			engine := promql.NewEngine(promql.EngineOpts{MaxSamples: 1000, Timeout: time.Minute})
+			query, err := engine.NewInstantQuery(context.Background(), db, nil, "histogram_quantile(0.5, latency_bucket)", now)
+			Expect(err).To(BeNil())
+			defer query.Close()
+			vector, err := query.Exec(context.Background()).Vector()
+			Expect(err).To(BeNil())
+			Expect(vector).To(HaveLen(1))
+			Expect(vector[0].F).To(Equal(1.5))
+		})
+	})
+
+	Context("Sanitization and relabeling", func() {
+		var dir string
+		now := time.Now().UTC()
+
+		BeforeEach(func() {
+			dir = filepath.Join(os.TempDir(), "tsdb-test-relabel")
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		It("sanitizes metric and label names", func() {
+			doc := map[string]interface{}{
+				"timestamp":  now.Format(time.RFC3339Nano),
+				"value":      1.0,
+				"labels":     map[string]interface{}{"pod.name": "pod-1", "1st-node": "node1", "app:kubernetes": "web"},
+				"metricName": "podReadyLatency-avg",
+			}
+			samples := TSDBConfig{}.extractSamples(doc, IndexingOpts{})
+			Expect(samples).To(HaveLen(1))
+			Expect(samples[0].labels.String()).To(Equal(`{_1st_node="node1", __name__="podReadyLatency_avg", app_kubernetes="web", pod_name="pod-1"}`))
+
+			doc = map[string]interface{}{
+				"timestamp":         now.Format(time.RFC3339Nano),
+				"scheduling.p99":    1.0,
+				"k8s.io/node-role":  "worker",
+				"metricName":        "job:latency",
+				"schedulingLatency": 2.0,
+			}
+			for _, s := range (TSDBConfig{}).extractSamples(doc, IndexingOpts{}) {
+				Expect(s.labels.Get("__name__")).To(Equal("job:latency"))
+				Expect(s.labels.Get("k8s_io_node_role")).To(Equal("worker"))
+			}
+		})
+
+		It("keeps document fields from replacing reserved and series labels", func() {
+			doc := map[string]interface{}{
+				"timestamp":  now.Format(time.RFC3339Nano),
+				"value":      1.0,
+				"labels":     map[string]interface{}{"__name__": "other", "pod.name": "pod-1", "pod_name": "pod-2"},
+				"metricName": "podReadyLatency",
+			}
+			samples := TSDBConfig{}.extractSamples(doc, IndexingOpts{})
+			Expect(samples).To(HaveLen(1))
+			Expect(samples[0].labels.String()).To(Equal(`{__name__="podReadyLatency", exported___name__="other", pod_name="pod-1"}`))
+
+			doc = map[string]interface{}{
+				"timestamp":  now.Format(time.RFC3339Nano),
+				"metricName": "podLatency",
+				"field":      "spec",
+				"quantile":   "high",
+				"P99":        10.0,
+				"max":        20.0,
+			}
+			var series []string
+			for _, s := range (TSDBConfig{}).extractSamples(doc, IndexingOpts{}) {
+				series = append(series, s.labels.String())
+			}
+			Expect(series).To(ConsistOf(
+				`{__name__="podLatency", exported_field="spec", exported_quantile="high", quantile="0.99"}`,
+				`{__name__="podLatency", exported_field="spec", exported_quantile="high", field="max"}`,
+			))
+		})
+
+		It("applies the relabel configs to every sample", func() {
+			indexer, err := NewTSDBIndexer(IndexerConfig{
+				Type:             TSDBIndexer,
+				MetricsDirectory: dir,
+				TSDB: TSDBConfig{
+					RelabelConfigs: []*relabel.Config{
+						{Action: relabel.Drop, SourceLabels: model.LabelNames{"field"}, Regex: relabel.MustNewRegexp("max"), Separator: ";"},
+						{Action: relabel.LabelMap, Regex: relabel.MustNewRegexp("nodeName"), Replacement: "node"},
+						{Action: relabel.LabelDrop, Regex: relabel.MustNewRegexp("nodeName|uuid"), Separator: ";", Replacement: "$1"},
+					},
+				},
+			})
+			Expect(err).To(BeNil())
+			resp, err := indexer.Index([]interface{}{
+				map[string]interface{}{
+					"timestamp":  now.Format(time.RFC3339Nano),
+					"avg":        1.0,
+					"max":        2.0,
+					"nodeName":   "node1",
+					"uuid":       "abc",
+					"metricName": "podLatency",
+				},
+			}, IndexingOpts{})
+			Expect(err).To(BeNil())
+			Expect(resp.Samples).To(Equal(1))
+			block, err := tsdb.OpenBlock(nil, resp.Target, nil)
+			Expect(err).To(BeNil())
+			defer block.Close()
+			querier, err := tsdb.NewBlockQuerier(block, 0, now.UnixMilli()+1)
+			Expect(err).To(BeNil())
+			defer querier.Close()
+			var series []string
+			seriesSet := querier.Select(context.Background(), false, nil, labels.MustNewMatcher(labels.MatchRegexp, "__name__", ".+"))
+			for seriesSet.Next() {
+				series = append(series, seriesSet.At().Labels().String())
+			}
+			Expect(series).To(Equal([]string{`{__name__="podLatency", field="avg", node="node1"}`}))
+		})
+
+		It("returns an error for invalid relabel configs", func() {
+			_, err := NewTSDBIndexer(IndexerConfig{
+				Type:             TSDBIndexer,
+				MetricsDirectory: dir,
+				TSDB:             TSDBConfig{RelabelConfigs: []*relabel.Config{{Action: relabel.Replace}}},
+			})
+			Expect(err).To(MatchError("invalid relabel config 0 for TSDB indexer: relabel configuration for replace action requires 'target_label' value"))
+		})
+
+		It("sets the default regex on a copy of the relabel configs", func() {
+			relabelConfigs := []*relabel.Config{{Action: relabel.Drop, SourceLabels: model.LabelNames{"field"}, Separator: ";"}}
+			indexer, err := NewTSDBIndexer(IndexerConfig{
+				Type:             TSDBIndexer,
+				MetricsDirectory: dir,
+				TSDB:             TSDBConfig{RelabelConfigs: relabelConfigs},
+			})
+			Expect(err).To(BeNil())
+			Expect(relabelConfigs[0].Regex.Regexp).To(BeNil())
+			Expect(indexer.config.RelabelConfigs[0].Regex.String()).To(Equal(relabel.DefaultRelabelConfig.Regex.String()))
+		})
+
+		It("reports the samples that couldn't be appended", func() {
+			doc := func(ts time.Time, value float64) interface{} {
+				return map[string]interface{}{"timestamp": ts.Format(time.RFC3339Nano), "value": value}
+			}
+			indexer, err := NewTSDBIndexer(IndexerConfig{Type: TSDBIndexer, MetricsDirectory: dir, TSDB: TSDBConfig{Persistent: true}})
+			Expect(err).To(BeNil())
+			defer indexer.Close()
+			_, err = indexer.Index([]interface{}{doc(now.Add(time.Minute), 1)}, IndexingOpts{MetricName: "test"})
+			Expect(err).To(BeNil())
+			// Samples older than the latest sample of their series are out of order
+			resp, err := indexer.Index([]interface{}{doc(now, 2), doc(now.Add(2*time.Minute), 3)}, IndexingOpts{MetricName: "test"})
+			var bulkErr *BulkIndexError
+			Expect(errors.As(err, &bulkErr)).To(BeTrue())
+			Expect(bulkErr.Total).To(Equal(2))
+			Expect(resp.Samples).To(Equal(1))
+			Expect(resp.Failed).To(Equal(1))
+			Expect(resp.Failures).To(Equal([]DocumentFailure{{
+				DocumentID: fmt.Sprintf(`{__name__="test"}@%d`, now.UnixMilli()),
+				Reason:     "out of order sample",
+			}}))
+
+			indexer, err = NewTSDBIndexer(IndexerConfig{Type: TSDBIndexer, MetricsDirectory: dir, TSDB: TSDBConfig{Persistent: true}, FailureThreshold: 0.5})
+			Expect(err).To(BeNil())
+			defer indexer.Close()
+			_, err = indexer.Index([]interface{}{doc(now.Add(time.Minute), 1)}, IndexingOpts{MetricName: "test"})
+			Expect(err).To(BeNil())
+			resp, err = indexer.Index([]interface{}{doc(now, 2), doc(now.Add(2*time.Minute), 3)}, IndexingOpts{MetricName: "test"})
+			Expect(err).To(BeNil())
+			Expect(resp.Failed).To(Equal(1))
+		})
+	})
+
+	Context("Index() in persistent mode", func() {
+		var indexer *TSDB
+		var dir string
+		start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+		promDoc := func(ts time.Time, instance string, value float64) interface{} {
+			return map[string]interface{}{
+				"timestamp": ts.Format(time.RFC3339Nano),
+				"labels":    map[string]interface{}{"instance": instance},
+				"value":     value,
+			}
+		}
+
+		newIndexer := func(config TSDBConfig) {
+			var err error
+			indexer, err = NewTSDBIndexer(IndexerConfig{
+				Type:             TSDBIndexer,
+				MetricsDirectory: dir,
+				TSDB:             config,
+			})
+			Expect(err).To(BeNil())
+		}
+
+		BeforeEach(func() {
+			dir = filepath.Join(os.TempDir(), "tsdb-test-persistent")
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		It("writes a single block aligned to the samples time span on close", func() {
+			newIndexer(TSDBConfig{Persistent: true})
+			for i := 0; i < 20; i++ {
+				resp, err := indexer.Index([]interface{}{
+					promDoc(start.Add(time.Duration(i)*time.Minute), "node1", float64(i)),
+					promDoc(start.Add(time.Duration(i)*time.Minute), "node2", float64(i)),
+				}, IndexingOpts{MetricName: fmt.Sprintf("metric%d", i)})
+				Expect(err).To(BeNil())
+				Expect(resp.Samples).To(Equal(2))
+				Expect(resp.Target).To(Equal(dir))
+			}
+			// Samples older than the latest ones of other series are accepted
+			_, err := indexer.Index([]interface{}{promDoc(start.Add(-3*time.Hour), "node1", 1)}, IndexingOpts{MetricName: "earlier"})
+			Expect(err).To(BeNil())
+			Expect(blockMetas(dir)).To(BeEmpty())
+
+			Expect(indexer.Close()).To(Succeed())
+			metas := blockMetas(dir)
+			Expect(metas).To(HaveLen(1))
+			Expect(metas[0].MinTime).To(Equal(start.Add(-3 * time.Hour).UnixMilli()))
+			Expect(metas[0].MaxTime).To(Equal(start.Add(19*time.Minute).UnixMilli() + 1))
+			Expect(metas[0].Stats.NumSeries).To(BeEquivalentTo(41))
+			Expect(metas[0].Stats.NumSamples).To(BeEquivalentTo(41))
+		})
+
+		It("splits the head into non-overlapping blocks of at most the maximum block duration", func() {
+			newIndexer(TSDBConfig{Persistent: true, MaxBlockDuration: 2 * time.Hour})
+			var docs []interface{}
+			for i := 0; i <= 10; i++ {
+				docs = append(docs, promDoc(start.Add(time.Duration(i)*30*time.Minute), "node1", float64(i)))
+			}
+			_, err := indexer.Index(docs, IndexingOpts{MetricName: "cpuUsage"})
+			Expect(err).To(BeNil())
+			Expect(indexer.Close()).To(Succeed())
+
+			metas := blockMetas(dir)
+			Expect(metas).To(HaveLen(3))
+			var samples uint64
+			blockStart := start.UnixMilli()
+			for _, meta := range metas {
+				Expect(meta.MinTime).To(Equal(blockStart))
+				blockStart = min(meta.MinTime+(2*time.Hour).Milliseconds(), start.Add(5*time.Hour).UnixMilli()+1)
+				Expect(meta.MaxTime).To(Equal(blockStart))
+				samples += meta.Stats.NumSamples
+			}
+			Expect(samples).To(BeEquivalentTo(11))
+		})
+
+		It("doesn't write any block when nothing was indexed", func() {
+			newIndexer(TSDBConfig{Persistent: true})
+			Expect(indexer.Close()).To(Succeed())
+			Expect(blockMetas(dir)).To(BeEmpty())
+		})
+	})
+
 	Context("Factory integration", func() {
 		It("NewIndexer creates TSDB indexer", func() {
 			dir := filepath.Join(os.TempDir(), "tsdb-test-factory")
@@ -259,6 +696,26 @@ var _ = Describe("Tests for tsdb.go", func() {
 	})
 })
 
+// blockMetas returns the metadata of the blocks of the directory sorted by minimum time
+func blockMetas(dir string) []tsdb.BlockMeta {
+	entries, err := os.ReadDir(dir)
+	Expect(err).To(BeNil())
+	var metas []tsdb.BlockMeta
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		block, err := tsdb.OpenBlock(nil, filepath.Join(dir, entry.Name()), nil)
+		Expect(err).To(BeNil())
+		metas = append(metas, block.Meta())
+		Expect(block.Close()).To(Succeed())
+	}
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].MinTime < metas[j].MinTime
+	})
+	return metas
+}
+
 func verifyBlockExists(dir string) {
 	entries, err := os.ReadDir(dir)
 	Expect(err).To(BeNil())
@@ -14,6 +14,13 @@
 
 package indexers
 
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
 // Types of indexers
 const (
 	// Elastic indexer that sends metrics to the configured ES instance
@@ -24,18 +31,165 @@ const (
 	LocalIndexer IndexerType = "local"
 	// TSDB indexer that writes Prometheus TSDB blocks to local directory
 	TSDBIndexer IndexerType = "tsdb"
+	// Multi indexer that sends metrics to several indexers concurrently
+	MultiIndexer IndexerType = "multi"
+	// RemoteWrite indexer that pushes metrics to a Prometheus remote write endpoint
+	RemoteWriteIndexer IndexerType = "remotewrite"
+	// Kafka indexer that produces metrics to a Kafka topic
+	KafkaIndexer IndexerType = "kafka"
 )
 
-// Indexer interface
+// Indexer interface. Indexers finalizing their output once indexing is done, such as the Local and TSDB ones,
+// also implement io.Closer
 type Indexer interface {
-	Index([]interface{}, IndexingOpts) (string, error)
+	// Index indexes the given documents, it's equivalent to IndexWithContext with context.Background()
+	Index([]interface{}, IndexingOpts) (IndexResult, error)
+	// IndexWithContext indexes the given documents, stopping as soon as the context is cancelled or its deadline expires
+	IndexWithContext(context.Context, []interface{}, IndexingOpts) (IndexResult, error)
+}
+
+// IndexResult holds the outcome of an indexing operation
+type IndexResult struct {
+	// Target index, file or TSDB block the documents were written to. Comma separated list of indexes when the index name is a template
+	Target string
+	// Indexed number of documents successfully indexed
+	Indexed int
+	// Created number of documents created in the target
+	Created int
+	// Updated number of already existing documents updated in the target
+	Updated int
+	// Failed number of documents that couldn't be indexed, or of samples for the TSDB indexer
+	Failed int
+	// SkippedDuplicates number of redundant documents not sent to the target
+	SkippedDuplicates int
+	// Samples number of samples written, only reported by the TSDB and remote write indexers
+	Samples int
+	// Spooled number of documents written to the spool, only reported by the spool indexer
+	Spooled int
+	// Duration time spent indexing the documents
+	Duration time.Duration
+	// Failures holds the reason of every document that couldn't be indexed
+	Failures []DocumentFailure
+	// Backends result of every backend, only reported by the multi indexer
+	Backends []BackendResult
+}
+
+// BackendResult holds the outcome of one of the backends of the multi indexer
+type BackendResult struct {
+	// Type type of the backend indexer
+	Type IndexerType
+	// Result indexing result of the backend
+	Result IndexResult
+	// Err error returned by the backend
+	Err error
+}
+
+// DocumentFailure describes why a document couldn't be indexed
+type DocumentFailure struct {
+	// DocumentID ID of the rejected document, series and timestamp of the rejected sample for the TSDB indexer
+	DocumentID string
+	// Reason error reported by the indexer backend
+	Reason string
+	// Status HTTP status code of the rejection, 0 when the document wasn't acknowledged
+	Status int
+}
+
+// Maximum number of document failures listed in a BulkIndexError message
+const maxReportedFailures = 10
+
+// BulkIndexError is returned when the number of documents rejected by the indexer exceeds the configured failure threshold
+type BulkIndexError struct {
+	// Target index the documents were sent to
+	Target string
+	// Total number of documents sent to the target
+	Total int
+	// Failures rejected documents
+	Failures []DocumentFailure
+}
+
+func (e *BulkIndexError) Error() string {
+	var reasons []string
+	for i, failure := range e.Failures {
+		if i == maxReportedFailures {
+			reasons = append(reasons, fmt.Sprintf("and %d more", len(e.Failures)-i))
+			break
+		}
+		reasons = append(reasons, fmt.Sprintf("%s: %s", failure.DocumentID, failure.Reason))
+	}
+	return fmt.Sprintf("%d out of %d documents rejected by %s: %s", len(e.Failures), e.Total, e.Target, strings.Join(reasons, "; "))
+}
+
+// checkFailureThreshold returns a BulkIndexError when the rejected documents exceed the given fraction of total
+func checkFailureThreshold(result IndexResult, total int, threshold float64) error {
+	if result.Failed == 0 || float64(result.Failed) <= threshold*float64(total) {
+		return nil
+	}
+	return &BulkIndexError{Target: result.Target, Total: total, Failures: result.Failures}
+}
+
+// String returns a human readable summary of the indexing result
+func (r IndexResult) String() string {
+	statString := fmt.Sprintf(" indexed=%d", r.Indexed)
+	if r.Created > 0 {
+		statString += fmt.Sprintf(" created=%d", r.Created)
+	}
+	if r.Updated > 0 {
+		statString += fmt.Sprintf(" updated=%d", r.Updated)
+	}
+	if r.Failed > 0 {
+		statString += fmt.Sprintf(" failed=%d", r.Failed)
+	}
+	if r.SkippedDuplicates > 0 {
+		statString += fmt.Sprintf(" redundantskipped=%d", r.SkippedDuplicates)
+	}
+	if r.Samples > 0 {
+		statString += fmt.Sprintf(" samples=%d", r.Samples)
+	}
+	if r.Spooled > 0 {
+		statString += fmt.Sprintf(" spooled=%d", r.Spooled)
+	}
+	return fmt.Sprintf("Indexing into %s finished in %v:%v", r.Target, r.Duration.Truncate(time.Millisecond), statString)
+}
+
+// add adds the counters and failures of another result
+func (r *IndexResult) add(other IndexResult) {
+	r.Indexed += other.Indexed
+	r.Created += other.Created
+	r.Updated += other.Updated
+	r.Failed += other.Failed
+	r.SkippedDuplicates += other.SkippedDuplicates
+	r.Samples += other.Samples
+	r.Spooled += other.Spooled
+	r.Failures = append(r.Failures, other.Failures...)
 }
 
 // Indexing options
 type IndexingOpts struct {
 	MetricName string // MetricName, required for local indexer
+	// DocumentID returns the ID of every document indexed by the ElasticSearch and OpenSearch indexers.
+	// The SHA256 of the document is used when not set. When several documents of a call get the same ID, only the last
+	// one is sent with the index and upsert actions, the first one with the create action
+	DocumentID DocumentIDFunc
+	// Action bulk action used by the ElasticSearch and OpenSearch indexers. Defaults to IndexAction
+	Action BulkAction
 }
 
+// DocumentIDFunc returns the ID of the given document
+type DocumentIDFunc func(document interface{}) (string, error)
+
+// BulkAction action used to index documents through the bulk API
+type BulkAction string
+
+// Bulk actions
+const (
+	// IndexAction creates the documents, replacing the existing ones with the same ID
+	IndexAction BulkAction = "index"
+	// CreateAction creates the documents, the ones whose ID already exists are rejected
+	CreateAction BulkAction = "create"
+	// UpsertAction updates the existing documents with the same ID, merging their fields, or creates them
+	UpsertAction BulkAction = "upsert"
+)
+
 // IndexerType type of indexer
 type IndexerType string
 
@@ -45,14 +199,70 @@ type IndexerConfig struct {
 	Type IndexerType `yaml:"type"`
 	// Servers List of ElasticSearch instances
 	Servers []string `yaml:"esServers"`
-	// Index index to send documents to server
+	// Index index to send documents to server. It can be a template such as ripsaw-{{.MetricName}}-{{.Date "2006.01"}},
+	// rendered for every document from the indexing options metric name, or the metricName and timestamp fields of the document
 	Index string `yaml:"defaultIndex"`
 	// InsecureSkipVerify disable TLS ceriticate verification
 	InsecureSkipVerify bool `yaml:"insecureSkipVerify"`
+	// Spool disk spool settings of the ElasticSearch and OpenSearch indexers
+	Spool SpoolConfig `yaml:"spool"`
+	// Auth authentication settings of the ElasticSearch, OpenSearch, remote write and Kafka indexers
+	Auth AuthConfig `yaml:"auth"`
+	// SigV4 AWS SigV4 request signing settings of the OpenSearch indexer
+	SigV4 SigV4Config `yaml:"sigV4"`
+	// FailureThreshold fraction of documents, or samples for the TSDB and remote write indexers, between 0 and 1, that can be rejected before Index returns an error
+	FailureThreshold float64 `yaml:"failureThreshold"`
+	// Retry retry policy of the ElasticSearch, OpenSearch and remote write requests
+	Retry RetryConfig `yaml:"retry"`
+	// Bulk bulk indexer tuning of the ElasticSearch and OpenSearch indexers
+	Bulk BulkConfig `yaml:"bulk"`
+	// Mapping mapping settings of the ElasticSearch and OpenSearch indexes
+	Mapping MappingConfig `yaml:"mapping"`
+	// Lifecycle data stream and ILM/ISM policy settings of the ElasticSearch and OpenSearch indexes
+	Lifecycle LifecycleConfig `yaml:"lifecycle"`
 	// Directory to save metrics files in
 	MetricsDirectory string `yaml:"metricsDirectory"`
-	// Create tarball
+	// CreateTarball packages the metrics directory of the Local indexer into a gzip tarball when it's closed
 	CreateTarball bool `yaml:"createTarball"`
-	// TarBall name
+	// TarballName path of the tarball. Defaults to the metrics directory name with the .tar.gz extension
 	TarballName string `yaml:"tarballName"`
+	// Local output format settings of the Local indexer
+	Local LocalConfig `yaml:"local"`
+	// RemoteWrite settings of the Prometheus remote write indexer
+	RemoteWrite RemoteWriteConfig `yaml:"remoteWrite"`
+	// Kafka settings of the Kafka indexer
+	Kafka KafkaConfig `yaml:"kafka"`
+	// TSDB settings of the TSDB indexer
+	TSDB TSDBConfig `yaml:"tsdb"`
+	// Indexers configuration of the backends of the multi indexer
+	Indexers []IndexerConfig `yaml:"indexers"`
+	// FailurePolicy whether a failing backend fails the multi indexer call. Defaults to FailOnAny
+	FailurePolicy FailurePolicy `yaml:"failurePolicy"`
+}
+
+// RetryConfig holds the retry policy of the requests sent to ElasticSearch and OpenSearch
+type RetryConfig struct {
+	// MaxAttempts maximum number of attempts of every request, including the first one. The client defaults are used when not set,
+	// 3 attempts for the remote write indexer
+	MaxAttempts int `yaml:"maxAttempts"`
+	// BackoffBase time to wait before the first retry, doubled on every retry. Defaults to 500ms
+	BackoffBase time.Duration `yaml:"backoffBase"`
+	// BackoffCap maximum time to wait between retries. Defaults to 30s
+	BackoffCap time.Duration `yaml:"backoffCap"`
+	// RetryableStatusCodes HTTP status codes that trigger a retry. Defaults to 429, 502, 503 and 504
+	RetryableStatusCodes []int `yaml:"retryableStatusCodes"`
+}
+
+// BulkConfig holds the bulk indexer tuning of the ElasticSearch and OpenSearch indexers
+type BulkConfig struct {
+	// FlushBytes size in bytes of the bulk requests. Defaults to 5MB
+	FlushBytes int `yaml:"flushBytes"`
+	// FlushInterval maximum time documents are buffered before being flushed. Defaults to 30s
+	FlushInterval time.Duration `yaml:"flushInterval"`
+	// Workers number of concurrent bulk requests. Defaults to the number of CPUs
+	Workers int `yaml:"workers"`
+	// Timeout timeout of every bulk request. Defaults to 10m
+	Timeout time.Duration `yaml:"timeout"`
+	// Compress gzip compress the request bodies
+	Compress bool `yaml:"compress"`
 }
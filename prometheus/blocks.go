@@ -0,0 +1,191 @@
+// Copyright 2024 The go-commons Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+// Limits of the PromQL engine querying TSDB blocks
+const (
+	blocksQueryTimeout    = 2 * time.Minute
+	blocksQueryMaxSamples = 50000000
+)
+
+// OpenBlocks opens the TSDB blocks of the given directory, such as the blocks written by the TSDB indexer, read-only.
+// Overlapping blocks are merged at query time
+func OpenBlocks(directory string) (*Blocks, error) {
+	db, err := tsdb.OpenDBReadOnly(directory, os.TempDir(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error opening TSDB blocks in %s: %s", directory, err)
+	}
+	blockReaders, err := db.Blocks()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error opening TSDB blocks in %s: %s", directory, err)
+	}
+	if len(blockReaders) == 0 {
+		db.Close()
+		return nil, fmt.Errorf("no TSDB blocks found in %s", directory)
+	}
+	return &Blocks{
+		Directory: directory,
+		db:        db,
+		blocks:    blockReaders,
+		engine: promql.NewEngine(promql.EngineOpts{
+			MaxSamples:           blocksQueryMaxSamples,
+			Timeout:              blocksQueryTimeout,
+			EnableAtModifier:     true,
+			EnableNegativeOffset: true,
+		}),
+	}, nil
+}
+
+// Query runs an instant query against the blocks
+func (b *Blocks) Query(query string, time time.Time) (model.Value, error) {
+	q, err := b.engine.NewInstantQuery(context.TODO(), storage.QueryableFunc(b.querier), nil, query, time)
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	return queryValue(q.Exec(context.TODO()))
+}
+
+// QueryRange runs a range query against the blocks
+func (b *Blocks) QueryRange(query string, start, end time.Time, step time.Duration) (model.Value, error) {
+	q, err := b.engine.NewRangeQuery(context.TODO(), storage.QueryableFunc(b.querier), nil, query, start, end, step)
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	return queryValue(q.Exec(context.TODO()))
+}
+
+// Close closes the blocks
+func (b *Blocks) Close() error {
+	return b.db.Close()
+}
+
+// querier returns a querier merging the series of the blocks overlapping the given time range
+func (b *Blocks) querier(mint, maxt int64) (storage.Querier, error) {
+	var queriers []storage.Querier
+	for _, block := range b.blocks {
+		meta := block.Meta()
+		if meta.MaxTime < mint || meta.MinTime > maxt {
+			continue
+		}
+		querier, err := tsdb.NewBlockQuerier(block, mint, maxt)
+		if err != nil {
+			var closeErr error
+			for _, q := range queriers {
+				closeErr = errors.Join(closeErr, q.Close())
+			}
+			return nil, errors.Join(fmt.Errorf("error querying block %s: %w", meta.ULID, err), closeErr)
+		}
+		queriers = append(queriers, querier)
+	}
+	return storage.NewMergeQuerier(queriers, nil, storage.ChainedSeriesMerge), nil
+}
+
+// queryValue converts the result of a PromQL query into the value returned by the Prometheus API client
+func queryValue(result *promql.Result) (model.Value, error) {
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	switch v := result.Value.(type) {
+	case promql.Vector:
+		vector := make(model.Vector, 0, len(v))
+		for _, s := range v {
+			vector = append(vector, &model.Sample{
+				Metric:    modelMetric(s.Metric),
+				Value:     model.SampleValue(s.F),
+				Timestamp: model.Time(s.T),
+				Histogram: sampleHistogram(s.H),
+			})
+		}
+		return vector, nil
+	case promql.Matrix:
+		matrix := make(model.Matrix, 0, len(v))
+		for _, series := range v {
+			stream := &model.SampleStream{Metric: modelMetric(series.Metric)}
+			for _, point := range series.Floats {
+				stream.Values = append(stream.Values, model.SamplePair{Timestamp: model.Time(point.T), Value: model.SampleValue(point.F)})
+			}
+			for _, point := range series.Histograms {
+				stream.Histograms = append(stream.Histograms, model.SampleHistogramPair{Timestamp: model.Time(point.T), Histogram: sampleHistogram(point.H)})
+			}
+			matrix = append(matrix, stream)
+		}
+		return matrix, nil
+	case promql.Scalar:
+		return &model.Scalar{Value: model.SampleValue(v.V), Timestamp: model.Time(v.T)}, nil
+	case promql.String:
+		return &model.String{Value: v.V, Timestamp: model.Time(v.T)}, nil
+	}
+	return nil, fmt.Errorf("unsupported query result type %s", result.Value.Type())
+}
+
+// modelMetric converts a label set into a metric
+func modelMetric(lbls labels.Labels) model.Metric {
+	metric := make(model.Metric, lbls.Len())
+	lbls.Range(func(l labels.Label) {
+		metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+	})
+	return metric
+}
+
+// sampleHistogram converts a native histogram, nil when the sample isn't a histogram. Empty buckets are
+// skipped and bucket boundaries are encoded as in the responses of the Prometheus API
+func sampleHistogram(h *histogram.FloatHistogram) *model.SampleHistogram {
+	if h == nil {
+		return nil
+	}
+	sampleHistogram := &model.SampleHistogram{Count: model.FloatString(h.Count), Sum: model.FloatString(h.Sum)}
+	for it := h.AllBucketIterator(); it.Next(); {
+		bucket := it.At()
+		if bucket.Count == 0 {
+			continue
+		}
+		// Boundaries: 0 lower exclusive and upper inclusive, 1 lower inclusive and upper exclusive,
+		// 2 both exclusive, 3 both inclusive
+		boundaries := int32(2)
+		switch {
+		case bucket.LowerInclusive && bucket.UpperInclusive:
+			boundaries = 3
+		case bucket.LowerInclusive:
+			boundaries = 1
+		case bucket.UpperInclusive:
+			boundaries = 0
+		}
+		sampleHistogram.Buckets = append(sampleHistogram.Buckets, &model.HistogramBucket{
+			Boundaries: boundaries,
+			Lower:      model.FloatString(bucket.Lower),
+			Upper:      model.FloatString(bucket.Upper),
+			Count:      model.FloatString(bucket.Count),
+		})
+	}
+	return sampleHistogram
+}
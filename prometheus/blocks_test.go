@@ -0,0 +1,111 @@
+package prometheus
+
+import (
+	"context"
+	"os"
+	"time"
+
+	gokitlog "github.com/go-kit/log"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+var _ Querier = &Prometheus{}
+var _ Querier = &Blocks{}
+
+// writeTestBlock writes a block with a sample every minute of the given series between start and end
+func writeTestBlock(dir string, lbls labels.Labels, start, end time.Time, value float64) {
+	w, err := tsdb.NewBlockWriter(gokitlog.NewNopLogger(), dir, tsdb.DefaultBlockDuration)
+	Expect(err).To(BeNil())
+	defer w.Close()
+	app := w.Appender(context.Background())
+	for ts := start; !ts.After(end); ts = ts.Add(time.Minute) {
+		_, err := app.Append(0, lbls, ts.UnixMilli(), value)
+		Expect(err).To(BeNil())
+	}
+	Expect(app.Commit()).To(Succeed())
+	_, err = w.Flush(context.Background())
+	Expect(err).To(BeNil())
+}
+
+var _ = Describe("Tests for Blocks", func() {
+	var dir string
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "blocks-test")
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("returns an error when the directory has no blocks", func() {
+		_, err := OpenBlocks(dir)
+		Expect(err).To(MatchError("no TSDB blocks found in " + dir))
+	})
+
+	Context("with overlapping blocks", func() {
+		var blocks *Blocks
+
+		BeforeEach(func() {
+			writeTestBlock(dir, labels.FromStrings("__name__", "cpuUsage", "instance", "node1"), start, start.Add(30*time.Minute), 1)
+			writeTestBlock(dir, labels.FromStrings("__name__", "cpuUsage", "instance", "node2"), start.Add(10*time.Minute), start.Add(time.Hour), 3)
+			var err error
+			blocks, err = OpenBlocks(dir)
+			Expect(err).To(BeNil())
+		})
+
+		AfterEach(func() {
+			Expect(blocks.Close()).To(Succeed())
+		})
+
+		It("runs instant queries", func() {
+			value, err := blocks.Query("sum(cpuUsage)", start.Add(20*time.Minute))
+			Expect(err).To(BeNil())
+			Expect(value).To(Equal(model.Vector{{
+				Metric:    model.Metric{},
+				Value:     4,
+				Timestamp: model.TimeFromUnixNano(start.Add(20 * time.Minute).UnixNano()),
+			}}))
+
+			value, err = blocks.Query(`cpuUsage{instance="node2"}`, start.Add(time.Hour))
+			Expect(err).To(BeNil())
+			Expect(value.(model.Vector)).To(HaveLen(1))
+			Expect(value.(model.Vector)[0].Metric).To(Equal(model.Metric{"__name__": "cpuUsage", "instance": "node2"}))
+		})
+
+		It("runs range queries", func() {
+			value, err := blocks.QueryRange("cpuUsage", start, start.Add(time.Hour), 30*time.Minute)
+			Expect(err).To(BeNil())
+			matrix := value.(model.Matrix)
+			Expect(matrix).To(HaveLen(2))
+			Expect(matrix[0].Metric).To(Equal(model.Metric{"__name__": "cpuUsage", "instance": "node1"}))
+			Expect(matrix[0].Values).To(Equal([]model.SamplePair{
+				{Timestamp: model.TimeFromUnixNano(start.UnixNano()), Value: 1},
+				{Timestamp: model.TimeFromUnixNano(start.Add(30 * time.Minute).UnixNano()), Value: 1},
+			}))
+			Expect(matrix[1].Values).To(HaveLen(2))
+		})
+
+		It("returns scalars and strings", func() {
+			value, err := blocks.Query("scalar(count(cpuUsage))", start.Add(20*time.Minute))
+			Expect(err).To(BeNil())
+			Expect(value).To(Equal(&model.Scalar{Value: 2, Timestamp: model.TimeFromUnixNano(start.Add(20 * time.Minute).UnixNano())}))
+
+			value, err = blocks.Query(`"go-commons"`, start)
+			Expect(err).To(BeNil())
+			Expect(value).To(Equal(&model.String{Value: "go-commons", Timestamp: model.TimeFromUnixNano(start.UnixNano())}))
+		})
+
+		It("returns an error on invalid queries", func() {
+			_, err := blocks.Query("sum(", start)
+			Expect(err).NotTo(BeNil())
+		})
+	})
+})
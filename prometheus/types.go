@@ -16,8 +16,12 @@ package prometheus
 
 import (
 	"net/http"
+	"time"
 
 	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/tsdb"
 )
 
 type Aggregation string
@@ -39,6 +43,23 @@ type Prometheus struct {
 	Endpoint string
 }
 
+// Querier runs PromQL queries, it's implemented by Prometheus for a Prometheus server and by Blocks
+// for TSDB blocks on disk, so the same analysis code works online and offline
+type Querier interface {
+	// Query runs an instant query at the given time
+	Query(query string, time time.Time) (model.Value, error)
+	// QueryRange runs a range query between start and end with the given step
+	QueryRange(query string, start, end time.Time, step time.Duration) (model.Value, error)
+}
+
+// Blocks describes a directory of TSDB blocks opened read-only and queried with the PromQL engine
+type Blocks struct {
+	db        *tsdb.DBReadOnly
+	blocks    []tsdb.BlockReader
+	engine    *promql.Engine
+	Directory string
+}
+
 // This object implements RoundTripper
 type authTransport struct {
 	Transport http.RoundTripper